@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"io/fs"
+	"os"
+)
+
+type config struct {
+	name    string
+	keyFile string
+}
+
+func parseCmdLine(args []string) (*config, error) {
+	var result config
+	for arg := 0; arg < len(args); arg++ {
+		switch {
+		case args[arg] == "-n" || args[arg] == "--name":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--name requires a string argument")
+			}
+			result.name = args[arg]
+		case args[arg] == "-o" || args[arg] == "--key-file":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--key-file requires a file argument")
+			}
+			result.keyFile = args[arg]
+		default:
+			return nil, errors.New("Unknown argument: " + args[arg])
+		}
+	}
+
+	if result.keyFile == "" {
+		return nil, errors.New("No key file given on the command line")
+	}
+	return &result, nil
+}
+
+// Generates a key file for --key-file and prints the public key entry to
+// add to the other side's --peer-keys file
+func main() {
+	config, err := parseCmdLine(os.Args[1:])
+	if err != nil {
+		common.Fatal("Cannot parse command line: " + err.Error())
+	}
+
+	identity, err := e2e.GenerateIdentity(config.name)
+	if err != nil {
+		common.Fatal("Cannot generate keys: " + err.Error())
+	}
+	if err = identity.Save(config.keyFile); errors.Is(err, fs.ErrExist) {
+		common.Fatal(config.keyFile + " already exists")
+	} else if err != nil {
+		common.Fatal("Cannot save key file: " + err.Error())
+	}
+
+	public, err := json.MarshalIndent(identity.Public(), "", "  ")
+	if err != nil {
+		common.Fatal(err.Error())
+	}
+	fmt.Printf("Saved private keys to %s. Add this to the peers list of the other side:\n%s\n", config.keyFile, public)
+}
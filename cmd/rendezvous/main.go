@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/rendezvous"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Slow clients must not hold connections forever. Writing a response may
+// take as long as the longest poll.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = rendezvous.MaxPollTimeout + 10*time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+type config struct {
+	listenAddress string
+	certFile      string
+	keyFile       string
+	options       rendezvous.Options
+}
+
+// The rooms file is a JSON object mapping room IDs to their secrets
+func loadRooms(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rooms map[string]string
+	if err = json.Unmarshal(data, &rooms); err != nil {
+		return nil, errors.New("Cannot parse rooms file: " + err.Error())
+	}
+	return rooms, nil
+}
+
+func parseCmdLine(args []string) (*config, error) {
+	result := config{
+		listenAddress: ":8080",
+		options:       rendezvous.Options{Retention: 10 * time.Minute},
+	}
+
+	var err error
+	for arg := 0; arg < len(args); arg++ {
+		switch {
+		case args[arg] == "-l" || args[arg] == "--listen":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--listen requires a host:port argument")
+			}
+			result.listenAddress = args[arg]
+		case args[arg] == "--cert":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--cert requires a file argument")
+			}
+			result.certFile = args[arg]
+		case args[arg] == "--key":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--key requires a file argument")
+			}
+			result.keyFile = args[arg]
+		case args[arg] == "--retention":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--retention requires a duration argument")
+			}
+			result.options.Retention, err = time.ParseDuration(args[arg])
+			if err != nil {
+				return nil, errors.New("Cannot parse retention: " + err.Error())
+			}
+		case args[arg] == "--rooms":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--rooms requires a file argument")
+			}
+			result.options.Rooms, err = loadRooms(args[arg])
+			if err != nil {
+				return nil, errors.New("Cannot load rooms: " + err.Error())
+			}
+		case args[arg] == "--admin-token":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--admin-token requires a string argument")
+			}
+			result.options.AdminToken = args[arg]
+		case args[arg] == "--max-rooms":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--max-rooms requires an integer argument")
+			}
+			result.options.MaxRooms, err = strconv.Atoi(args[arg])
+			if err != nil || result.options.MaxRooms <= 0 {
+				return nil, errors.New("--max-rooms requires a positive integer argument")
+			}
+		default:
+			return nil, errors.New("Unknown argument: " + args[arg])
+		}
+	}
+
+	if (result.certFile == "") != (result.keyFile == "") {
+		return nil, errors.New("--cert and --key must be given together")
+	}
+	if len(result.options.Rooms) == 0 && result.options.AdminToken == "" {
+		return nil, errors.New("Without --rooms or --admin-token there would be no rooms")
+	}
+	return &result, nil
+}
+
+func main() {
+	config, err := parseCmdLine(os.Args[1:])
+	if err != nil {
+		common.Fatal("Cannot parse command line: " + err.Error())
+	}
+
+	server, err := rendezvous.MakeServer(&config.options)
+	if err != nil {
+		common.Fatal("Cannot start rendezvous server: " + err.Error())
+	}
+	defer server.Close()
+
+	httpServer := &http.Server{
+		Addr:              config.listenAddress,
+		Handler:           server,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	fmt.Printf("Listening on %s\n", config.listenAddress)
+	if config.certFile != "" {
+		err = httpServer.ListenAndServeTLS(config.certFile, config.keyFile)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	common.Fatal(err.Error())
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/policy"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Callback data of the prompt buttons is the action and the prompt ID
+// separated by a colon
+const (
+	approveAction = "approve"
+	denyAction    = "deny"
+)
+
+type approval struct {
+	approved bool
+	by       tgapi.User
+}
+
+// Asks the approvers in the approval chat whether a request may go ahead
+type approver struct {
+	bot       *tgapi.Bot
+	chatId    int64
+	timeout   time.Duration
+	approvers map[int]bool
+
+	mu      sync.Mutex
+	pending map[string]chan approval
+}
+
+func makeApprover(bot *tgapi.Bot, config *common.Config) *approver {
+	approvals := &approver{
+		bot:       bot,
+		chatId:    config.ApprovalChatId,
+		timeout:   config.ApprovalTimeout,
+		approvers: make(map[int]bool),
+		pending:   make(map[string]chan approval),
+	}
+	for _, userId := range config.Approvers {
+		approvals.approvers[userId] = true
+	}
+	return approvals
+}
+
+func describeUser(user *tgapi.User) string {
+	name := user.FirstName
+	if user.UserName != nil {
+		name += " (@" + *user.UserName + ")"
+	}
+	return fmt.Sprintf("%s, ID %d", name, user.Id)
+}
+
+// Posts the approval prompt and waits until someone presses a button, the
+// timeout passes or the session is aborted. Fails unless approved.
+func (approvals *approver) approve(ctx context.Context, request *common.HubMessage) error {
+	var buffer [8]byte
+	if _, err := rand.Read(buffer[:]); err != nil {
+		return errors.New("Cannot generate approval ID: " + err.Error())
+	}
+	id := hex.EncodeToString(buffer[:])
+
+	decision := make(chan approval, 1)
+	approvals.mu.Lock()
+	approvals.pending[id] = decision
+	approvals.mu.Unlock()
+	defer func() {
+		approvals.mu.Lock()
+		delete(approvals.pending, id)
+		approvals.mu.Unlock()
+	}()
+
+	text := fmt.Sprintf("Punching request %d from %s", request.Serial, policy.Describe(request))
+	prompt, err := approvals.bot.SendMessage(&tgapi.SendMessage{
+		ChatId: approvals.chatId,
+		Text:   text,
+		ReplyMarkup: &tgapi.InlineKeyboardMarkup{
+			InlineKeyboard: [][]tgapi.InlineKeyboardButton{{
+				{Text: "Approve", CallbackData: approveAction + ":" + id},
+				{Text: "Deny", CallbackData: denyAction + ":" + id},
+			}},
+		},
+	})
+	if err != nil {
+		return errors.New("Cannot ask for approval: " + err.Error())
+	}
+
+	var outcome string
+	select {
+	case result := <-decision:
+		if result.approved {
+			outcome = "Approved by " + describeUser(&result.by)
+		} else {
+			outcome = "Denied by " + describeUser(&result.by)
+			err = errors.New("denied by the server operator")
+		}
+	case <-time.After(approvals.timeout):
+		outcome = fmt.Sprintf("Nobody decided in %v", approvals.timeout)
+		err = errors.New("not approved in time")
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			outcome = "The session timed out"
+		} else {
+			outcome = "The session was aborted"
+		}
+		err = errors.New("aborted while waiting for approval")
+	}
+	fmt.Printf("Request %d: %s\n", request.Serial, outcome)
+
+	// Remove the buttons, nothing is waiting for them any more
+	_, editErr := approvals.bot.EditMessageText(&tgapi.EditMessageText{
+		ChatId:    prompt.Chat.Id,
+		MessageId: prompt.Id,
+		Text:      text + "\n" + outcome,
+	})
+	if editErr != nil {
+		fmt.Println("Cannot update the approval prompt: " + editErr.Error())
+	}
+	return err
+}
+
+// The first button pressed by an approver decides
+func (approvals *approver) handleCallbackQuery(query *tgapi.CallbackQuery) {
+	answer := &tgapi.AnswerCallbackQuery{CallbackQueryId: query.Id}
+	action, id, _ := strings.Cut(query.Data, ":")
+
+	approvals.mu.Lock()
+	decision, ok := approvals.pending[id]
+	ok = ok && query.Message != nil && query.Message.Chat.Id == approvals.bot.CurrentChatId(approvals.chatId)
+	switch {
+	case ok && !approvals.approvers[query.From.Id]:
+		ok = false
+		answer.Text = "You may not decide on requests"
+		fmt.Printf("Ignoring approval button pressed by %s\n", describeUser(&query.From))
+	case ok && action == approveAction:
+		answer.Text = "Approved"
+	case ok && action == denyAction:
+		answer.Text = "Denied"
+	default:
+		ok = false
+		answer.Text = "This request is no longer pending"
+	}
+	if ok {
+		delete(approvals.pending, id)
+		decision <- approval{approved: action == approveAction, by: query.From}
+	}
+	approvals.mu.Unlock()
+
+	if err := approvals.bot.AnswerCallbackQuery(answer); err != nil {
+		fmt.Println("Cannot answer callback query: " + err.Error())
+	}
+}
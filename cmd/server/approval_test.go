@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapitest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testApprovalChatId = -5
+
+func waitUntil(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting until " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Returns the approver and the prompt it posted for a request
+func askForApproval(t *testing.T, fake *tgapitest.Server, approvers []int) (*approver, chan error, tgapi.Message) {
+	t.Helper()
+	bot := tgapi.MakeBot(http.DefaultClient, fake.URL, "token")
+	approvals := makeApprover(bot, &common.Config{
+		ApprovalChatId:  testApprovalChatId,
+		ApprovalTimeout: time.Minute,
+		Approvers:       approvers,
+	})
+	telegram := signaling.MakeTelegram(bot, &common.Config{ChatId: testApprovalChatId})
+	telegram.OnCallbackQuery = approvals.handleCallbackQuery
+	go telegram.Run()
+	t.Cleanup(func() {
+		telegram.Close()
+	})
+
+	result := make(chan error, 1)
+	go func() {
+		result <- approvals.approve(context.Background(), &common.HubMessage{Serial: 1, From: "client"})
+	}()
+
+	var prompt tgapi.Message
+	waitUntil(t, "the prompt is posted", func() bool {
+		messages := fake.Messages(bot.CurrentChatId(testApprovalChatId))
+		if len(messages) == 0 || messages[0].ReplyMarkup == nil {
+			return false
+		}
+		prompt = messages[0]
+		return true
+	})
+	return approvals, result, prompt
+}
+
+func pressButton(t *testing.T, fake *tgapitest.Server, prompt tgapi.Message, user tgapi.User, button int) string {
+	t.Helper()
+	data := prompt.ReplyMarkup.InlineKeyboard[0][button].CallbackData
+	queryId, err := fake.PressButton(prompt.Chat.Id, prompt.Id, user, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer *tgapi.AnswerCallbackQuery
+	waitUntil(t, "the button press is answered", func() bool {
+		var ok bool
+		answer, ok = fake.CallbackAnswer(queryId)
+		return ok
+	})
+	return answer.Text
+}
+
+func TestOnlyApproversDecide(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	t.Cleanup(fake.Close)
+	fake.AddChat(tgapi.Chat{Id: testApprovalChatId, ChatType: "group"})
+	_, result, prompt := askForApproval(t, fake, []int{42})
+
+	stranger := tgapi.User{Id: 13, FirstName: "Mallory"}
+	if text := pressButton(t, fake, prompt, stranger, 0); text != "You may not decide on requests" {
+		t.Fatalf("Stranger got %q", text)
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("A stranger decided: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	approver := tgapi.User{Id: 42, FirstName: "Alice"}
+	if text := pressButton(t, fake, prompt, approver, 1); text != "Denied" {
+		t.Fatalf("Approver got %q", text)
+	}
+	if err := <-result; err == nil {
+		t.Fatal("Request approved, want denied")
+	}
+	waitUntil(t, "the buttons are removed", func() bool {
+		return fake.Messages(testApprovalChatId)[0].ReplyMarkup == nil
+	})
+}
+
+func TestApproverApproves(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	t.Cleanup(fake.Close)
+	fake.AddChat(tgapi.Chat{Id: testApprovalChatId, ChatType: "group"})
+	_, result, prompt := askForApproval(t, fake, []int{42, 43})
+
+	if text := pressButton(t, fake, prompt, tgapi.User{Id: 43, FirstName: "Bob"}, 0); text != "Approved" {
+		t.Fatalf("Approver got %q", text)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApprovalFollowsMigration(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	t.Cleanup(fake.Close)
+	fake.AddChat(tgapi.Chat{Id: testApprovalChatId, ChatType: "group"})
+	const supergroupId = -1005
+	fake.AddChat(tgapi.Chat{Id: supergroupId, ChatType: "supergroup"})
+	newChatId := int64(supergroupId)
+	fake.InjectError("sendMessage", 400, "Bad Request: group chat was upgraded to a supergroup chat", &tgapi.ResponseParameters{MigrateToChatId: &newChatId})
+	_, result, prompt := askForApproval(t, fake, []int{42})
+
+	if prompt.Chat.Id != supergroupId {
+		t.Fatalf("Prompt posted to %d, want the supergroup", prompt.Chat.Id)
+	}
+	if text := pressButton(t, fake, prompt, tgapi.User{Id: 42, FirstName: "Alice"}, 0); text != "Approved" {
+		t.Fatalf("Approver got %q", text)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/session"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Servers heard from within this long count as online, or within two
+// presence intervals if that is longer
+const peerOnlineWindow = 10 * time.Minute
+
+const (
+	// Servers announce themselves with hub messages of this type, which are
+	// not part of any session
+	presenceType = "server_presence"
+	// The serial of the announcements, so that each one cleans up after the
+	// one before
+	presenceSerial = 0
+)
+
+// Tells the servers sharing the hub that we are up until ctx is done
+func announcePresence(ctx context.Context, signaler signaling.Signaler, config *common.Config) {
+	ticker := time.NewTicker(config.PresenceInterval)
+	defer ticker.Stop()
+	for {
+		signaling.CleanupSession(signaler, presenceSerial, "Server "+config.Name+" was online")
+		err := signaler.Publish(&common.HubMessage{
+			Version: session.ProtocolVersion,
+			Type:    presenceType,
+			Serial:  presenceSerial,
+			From:    config.Name,
+		})
+		if err != nil {
+			fmt.Println("Cannot announce presence: " + err.Error())
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Remembers when every named server last posted to the hub
+type peerTracker struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func makePeerTracker(config *common.Config) *peerTracker {
+	window := peerOnlineWindow
+	if 2*config.PresenceInterval > window {
+		window = 2 * config.PresenceInterval
+	}
+	return &peerTracker{window: window, lastSeen: make(map[string]time.Time)}
+}
+
+// Takes note of the servers posting, see Signaler.Observe
+func (peers *peerTracker) observe(msg *common.HubMessage) {
+	role, ok := session.Sender(msg.Type)
+	if (msg.Type == presenceType || ok && role == session.Server) && msg.From != "" {
+		peers.mu.Lock()
+		peers.lastSeen[msg.From] = time.Now()
+		peers.mu.Unlock()
+	}
+}
+
+func (peers *peerTracker) online() []string {
+	peers.mu.Lock()
+	defer peers.mu.Unlock()
+
+	var names []string
+	for name, lastSeen := range peers.lastSeen {
+		if time.Since(lastSeen) > peers.window {
+			delete(peers.lastSeen, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var botCommands = []tgapi.BotCommand{
+	{Command: "status", Description: "Sessions, uptime, NAT type and public endpoint"},
+	{Command: "peers", Description: "Servers seen in the hub lately"},
+	{Command: "sessions", Description: "Running punching sessions"},
+	{Command: "kick", Description: "Stop a session: /kick <id>"},
+	{Command: "help", Description: "List the commands"},
+}
+
+// Lets the operators look after the server from Telegram
+type commandCenter struct {
+	bot       *tgapi.Bot
+	config    *common.Config
+	sessions  *sessionManager
+	peers     *peerTracker
+	operators map[int]bool
+	started   time.Time
+	// Commands addressed to other bots, like /status@otherbot, are not ours
+	username string
+}
+
+func makeCommandCenter(bot *tgapi.Bot, config *common.Config, sessions *sessionManager, peers *peerTracker) *commandCenter {
+	center := &commandCenter{
+		bot:       bot,
+		config:    config,
+		sessions:  sessions,
+		peers:     peers,
+		operators: make(map[int]bool),
+		started:   time.Now(),
+	}
+	for _, userId := range config.Operators {
+		center.operators[userId] = true
+	}
+	return center
+}
+
+// Learns our username and makes Telegram clients suggest the commands
+func (center *commandCenter) register() error {
+	me, err := center.bot.GetMe()
+	if err != nil {
+		return err
+	}
+	if me.UserName != nil {
+		center.username = *me.UserName
+	}
+	return center.bot.SetMyCommands(&tgapi.SetMyCommands{Commands: botCommands})
+}
+
+func isBotCommand(command string) bool {
+	for _, known := range botCommands {
+		if known.Command == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (center *commandCenter) handle(message *tgapi.Message) {
+	args := strings.Fields(*message.Text)
+	if len(args) == 0 {
+		return
+	}
+	command, addressee, _ := strings.Cut(strings.TrimPrefix(args[0], "/"), "@")
+	if addressee != "" && !strings.EqualFold(addressee, center.username) {
+		return
+	}
+
+	// Strangers learn nothing, not even that the bot takes commands
+	if message.From == nil || !center.operators[message.From.Id] {
+		if isBotCommand(command) {
+			fmt.Printf("Ignoring command /%s from %s\n", command, describeSender(message))
+		}
+		return
+	}
+	fmt.Printf("Command /%s from %s\n", command, describeSender(message))
+
+	var text string
+	switch command {
+	case "status":
+		text = center.status()
+	case "peers":
+		text = center.listPeers()
+	case "sessions":
+		text = center.listSessions()
+	case "kick":
+		text = center.kick(args[1:])
+	case "help", "start":
+		text = help()
+	default:
+		text = "Unknown command /" + command + ", see /help"
+	}
+	center.reply(message, text)
+}
+
+func describeSender(message *tgapi.Message) string {
+	if message.From == nil {
+		return fmt.Sprintf("chat %d", message.Chat.Id)
+	}
+	return describeUser(message.From)
+}
+
+// Answers show our endpoints and sessions, so they go to the operator
+// privately unless the command came from a private chat or the operator
+// chat. Bots may only write to users who have started a chat with them.
+func (center *commandCenter) reply(message *tgapi.Message, text string) {
+	answer := &tgapi.SendMessage{
+		ChatId:           message.Chat.Id,
+		Text:             text,
+		ReplyToMessageId: message.Id,
+		MessageThreadId:  message.MessageThreadId,
+	}
+	if message.Chat.ChatType != "private" && message.Chat.Id != center.bot.CurrentChatId(center.config.OperatorChatId) {
+		answer = &tgapi.SendMessage{ChatId: int64(message.From.Id), Text: text}
+	}
+	if _, err := center.bot.SendMessage(answer); err != nil {
+		fmt.Println("Cannot answer command: " + err.Error())
+	}
+}
+
+func help() string {
+	lines := []string{"Commands:"}
+	for _, command := range botCommands {
+		lines = append(lines, "/"+command.Command+" - "+command.Description)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Only tells whether we are behind a NAT and whether it keeps our port.
+// Telling mapping behaviours apart would take a second STUN server.
+// Asks the STUN server about a socket like the ones sessions punch with
+func probeNat(config *common.Config, listen common.PacketListener) (*common.Endpoint, string, error) {
+	conn, err := listen()
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	local, err := net.ResolveUDPAddr("udp", conn.LocalAddr().String())
+	if err != nil {
+		return nil, "", err
+	}
+	if local.IP.IsUnspecified() {
+		// Connecting a UDP socket sends nothing, but picks the outgoing
+		// address
+		probe, err := net.DialUDP("udp", nil, config.StunServer)
+		if err != nil {
+			return nil, "", err
+		}
+		local.IP = probe.LocalAddr().(*net.UDPAddr).IP
+		probe.Close()
+	}
+
+	endpoint, err := common.GetMyPublicEndpoint(conn, config)
+	if err != nil {
+		return nil, "", err
+	}
+	switch {
+	case net.ParseIP(endpoint.Address).Equal(local.IP):
+		return &endpoint, "none, the address is public", nil
+	case endpoint.Port == local.Port:
+		return &endpoint, "present, keeps ports", nil
+	default:
+		return &endpoint, "present, translates ports", nil
+	}
+}
+
+func (center *commandCenter) status() string {
+	lines := []string{
+		"Server " + center.config.Name,
+		fmt.Sprintf("Uptime: %v", time.Since(center.started).Round(time.Second)),
+		fmt.Sprintf("Active sessions: %d of %d", len(center.sessions.list()), center.config.MaxSessions),
+	}
+	endpoint, nat, err := probeNat(center.config, center.sessions.listen)
+	if err != nil {
+		lines = append(lines, "NAT: unknown, "+err.Error())
+	} else {
+		lines = append(lines, "NAT: "+nat, fmt.Sprintf("Public endpoint: %s:%d", endpoint.Address, endpoint.Port))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (center *commandCenter) listPeers() string {
+	window := center.peers.window.String()
+	lines := []string{"Servers seen in the last " + window + ":"}
+	for _, name := range center.peers.online() {
+		if name == center.config.Name {
+			name += " (this server)"
+		}
+		lines = append(lines, name)
+	}
+	if len(lines) == 1 {
+		return "No servers seen in the last " + window
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (center *commandCenter) listSessions() string {
+	active := center.sessions.list()
+	if len(active) == 0 {
+		return "No sessions"
+	}
+	var lines []string
+	for _, sess := range active {
+		peer := sess.Peer
+		if peer == "" {
+			peer = "unnamed client"
+		}
+		line := fmt.Sprintf("%d: %s, %s for %v", sess.Serial, peer, sess.State(), time.Since(sess.started).Round(time.Second))
+		if sess.endpoint != nil {
+			line += fmt.Sprintf(", endpoint %s:%d", sess.endpoint.Address, sess.endpoint.Port)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (center *commandCenter) kick(args []string) string {
+	if len(args) != 1 {
+		return "Usage: /kick <session id>"
+	}
+	serial, err := strconv.ParseUint(args[0], 10, 64)
+	if err == nil {
+		err = center.sessions.kick(serial)
+	} else {
+		err = errors.New("Invalid session ID " + args[0])
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Kicked session %d", serial)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/natemu"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapitest"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testGroupId    = -5
+	testOperatorId = 42
+	testStrangerId = 13
+)
+
+// Makes a command center of a server with one operator. The operator and
+// a stranger have started private chats with the bot.
+func startCommandCenter(t *testing.T, config *common.Config) (*commandCenter, *tgapitest.Server) {
+	t.Helper()
+	fake := tgapitest.NewServer("token")
+	t.Cleanup(fake.Close)
+	fake.AddChat(tgapi.Chat{Id: testGroupId, ChatType: "group"})
+	fake.AddChat(tgapi.Chat{Id: testOperatorId, ChatType: "private"})
+	fake.AddChat(tgapi.Chat{Id: testStrangerId, ChatType: "private"})
+	if config.OperatorChatId != 0 {
+		fake.AddChat(tgapi.Chat{Id: config.OperatorChatId, ChatType: "group"})
+	}
+
+	config.Name = "server"
+	config.Operators = []int{testOperatorId}
+	signaler := signaling.MakeMemoryHub().Signaler()
+	t.Cleanup(func() {
+		signaler.Close()
+	})
+	bot := tgapi.MakeBot(http.DefaultClient, fake.URL, "token")
+	sessions := makeSessionManager(signaler, config, nil, nil, nil)
+	return makeCommandCenter(bot, config, sessions, makePeerTracker(config)), fake
+}
+
+func sendCommand(t *testing.T, center *commandCenter, fake *tgapitest.Server, chatId int64, userId int, text string) {
+	t.Helper()
+	message, err := fake.PostUserMessage(chatId, 0, tgapi.User{Id: userId, FirstName: "User"}, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	center.handle(message)
+}
+
+// Returns what the bot has posted to the chat
+func botPosts(fake *tgapitest.Server, chatId int64) []tgapi.Message {
+	var posts []tgapi.Message
+	for _, message := range fake.Messages(chatId) {
+		if message.From != nil && message.From.IsBot {
+			posts = append(posts, message)
+		}
+	}
+	return posts
+}
+
+func TestStrangersGetNoAnswer(t *testing.T) {
+	center, fake := startCommandCenter(t, &common.Config{})
+	for _, command := range []string{"/help", "/sessions", "/kick 1"} {
+		sendCommand(t, center, fake, testGroupId, testStrangerId, command)
+		sendCommand(t, center, fake, testStrangerId, testStrangerId, command)
+	}
+	if posts := botPosts(fake, testGroupId); len(posts) != 0 {
+		t.Fatalf("Answered a stranger in the group: %q", *posts[0].Text)
+	}
+	if posts := botPosts(fake, testStrangerId); len(posts) != 0 {
+		t.Fatalf("Answered a stranger privately: %q", *posts[0].Text)
+	}
+}
+
+func TestCommandAnswersStayPrivate(t *testing.T) {
+	const operatorChatId = -7
+	center, fake := startCommandCenter(t, &common.Config{OperatorChatId: operatorChatId})
+
+	tests := []struct {
+		name   string
+		chatId int64
+		answer int64
+	}{
+		{"group", testGroupId, testOperatorId},
+		{"operator chat", operatorChatId, operatorChatId},
+		{"private chat", testOperatorId, testOperatorId},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := len(botPosts(fake, test.answer))
+			sendCommand(t, center, fake, test.chatId, testOperatorId, "/sessions")
+			posts := botPosts(fake, test.answer)
+			if len(posts) != before+1 {
+				t.Fatalf("%d answers in chat %d, want one", len(posts)-before, test.answer)
+			}
+			if text := *posts[len(posts)-1].Text; text != "No sessions" {
+				t.Fatalf("Got %q", text)
+			}
+		})
+	}
+	if posts := botPosts(fake, testGroupId); len(posts) != 0 {
+		t.Fatalf("Answered in the group: %q", *posts[0].Text)
+	}
+}
+
+func TestPeersListsAnnouncedServers(t *testing.T) {
+	hub := signaling.MakeMemoryHub()
+	config := &common.Config{Name: "a", PresenceInterval: time.Hour}
+	signaler := hub.Signaler()
+	defer signaler.Close()
+	peers := makePeerTracker(config)
+	signaler.Observe(peers.observe)
+	sub := subscribeToClients(signaler, config)
+
+	other := hub.Signaler()
+	defer other.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go announcePresence(ctx, other, &common.Config{Name: "b", PresenceInterval: time.Hour})
+
+	waitUntil(t, "the announcement arrives", func() bool {
+		return strings.Join(peers.online(), ",") == "b"
+	})
+	if peers.window != 2*time.Hour {
+		t.Fatalf("Servers count as online for %v, want two presence intervals", peers.window)
+	}
+	select {
+	case msg := <-sub.C:
+		t.Fatalf("The server handles a %s message", msg.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// /status probes with the sockets sessions use, not with a socket of its own
+func TestProbeNatUsesSessionSockets(t *testing.T) {
+	network := natemu.NewNetwork(1)
+	stun, err := natemu.StartStunServer(network, "198.51.100.1", 3478)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Close()
+	nat, err := network.AddNAT(natemu.PortRestrictedCone, "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &common.Config{StunServer: stun.Addr()}
+
+	public := func() (net.PacketConn, error) {
+		conn, err := network.Listen("203.0.113.2", 0)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	endpoint, description, err := probeNat(config, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Address != "203.0.113.2" || !strings.HasPrefix(description, "none") {
+		t.Fatalf("Got %s at %s, want no NAT", description, endpoint.Address)
+	}
+
+	endpoint, description, err = probeNat(config, behind(nat, "192.168.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Address != "203.0.113.1" || !strings.HasPrefix(description, "present") {
+		t.Fatalf("Got %s at %s, want the NAT", description, endpoint.Address)
+	}
+}
@@ -1,146 +1,284 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/policy"
+	"github.com/ovandriyanov/tgpunch/pkg/session"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
 	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
-	"net/http"
+	"github.com/ovandriyanov/tgpunch/pkg/ticket"
     "errors"
     "fmt"
     "os"
-    "strings"
     "net"
 )
 
-func handleHubMessage(client *http.Client, config *common.Config, msg *common.HubMessage) error {
-	fmt.Println("Handling hub message")
-	switch msg.Type {
-	case "start_punching_request":
-		return handleStartPunchingRequest(client, config, msg.PublicEndpoint, msg.Serial)
-
-	default:
+func handleHubMessage(sessions *sessionManager, msg *common.HubMessage) {
+	fmt.Printf("Handling hub message %s\n", msg.Type)
+	if _, ok := session.Sender(msg.Type); !ok {
 		fmt.Println("Unknown message type: " + msg.Type)
+		return
 	}
-	return nil
+	sessions.handle(msg)
+}
+
+// Requests for other servers sharing the channel are none of our business,
+// and neither are the messages servers, us included, post
+func subscribeToClients(signaler signaling.Signaler, config *common.Config) *signaling.Subscription {
+	addressedToUs := signaling.AddressedTo(config.Name)
+	return signaler.Subscribe(func(msg *common.HubMessage) bool {
+		if role, ok := session.Sender(msg.Type); ok && role == session.Server {
+			return false
+		}
+		if msg.Type == presenceType {
+			return false
+		}
+		return addressedToUs(msg)
+	})
 }
 
-func handleStartPunchingRequest(client *http.Client, config *common.Config, clientEndpoint *common.Endpoint, serial uint64) error {
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: 0})
+// The session gives up once its context is done
+func handleStartPunchingRequest(sessions *sessionManager, active *activeSession, request *common.HubMessage) error {
+	if request.PublicEndpoint == nil {
+		return errors.New("Request has no public endpoint")
+	}
+
+	conn, err := sessions.listen()
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	// Closing the socket interrupts whatever is reading from it
+	stop := context.AfterFunc(active.ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	if deadline, ok := active.ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
 
-	myEndpoint, err := common.GetMyPublicEndpoint(conn, config)
+	myEndpoint, err := common.GetMyPublicEndpoint(conn, sessions.config)
 	if err != nil {
-		return err
+		return errors.New("Cannot get my public endpoint: " + err.Error())
 	}
 	fmt.Printf("My public endpoint is %v\n", myEndpoint)
 
 	// Send the message with our public endpoint to the hub
 
-	innerJsonMessage, err := json.Marshal(&common.HubMessage{
-		Type: "start_punching_response",
-		Serial: serial,
-		PublicEndpoint: &myEndpoint,
-	})
-
+	response, err := active.Send(session.TypeResponse, "")
 	if err != nil {
 		return err
 	}
-
-	response, err := client.Post(
-        common.ApiUrlPrefix + config.ApiToken + "/sendMessage",
-        "application/json",
-		strings.NewReader(
-			fmt.Sprintf(
-				`{ "chat_id": %d, "text": %s }`,
-				config.ChatId,
-				string(innerJsonMessage),
-			),
-		),
-	)
+	response.PublicEndpoint = &myEndpoint
+	err = within(active.ctx, func() error {
+		return sessions.signaler.Publish(response)
+	})
 	if err != nil {
 		return err
 	}
 
-	var apiResponse tgapi.SendMessageResponse
-	if err = json.NewDecoder(response.Body).Decode(&apiResponse); err != nil {
-		return err
+	remoteAddr := net.UDPAddr{
+		IP: net.ParseIP(request.PublicEndpoint.Address),
+		Port: request.PublicEndpoint.Port,
 	}
 
-	if !apiResponse.Ok {
-		return errors.New(common.ApiErrorDescription(apiResponse.Description))
+	clientMagic := []byte("client")
+	return common.PunchHole(sessions.guard.Wrap(conn, clientMagic), &remoteAddr, []byte("server"), clientMagic, sessions.config.PunchTimeout)
+}
+
+func getStartOffset(bot *tgapi.Bot, config *common.Config) int {
+	if config.StateFile != "" {
+		saved, err := loadState(config.StateFile)
+		if err != nil {
+			common.Fatal("Cannot load state file: " + err.Error())
+		}
+		if saved != nil {
+			fmt.Printf("Resuming from update ID %d\n", saved.UpdateOffset)
+			return saved.UpdateOffset
+		}
 	}
 
-	remoteAddr := net.UDPAddr{
-		IP: net.ParseIP(clientEndpoint.Address),
-		Port: clientEndpoint.Port,
+	// Take whatever Telegram still keeps and let isStale sort it out
+	if config.BacklogMaxAge > 0 {
+		return 0
 	}
 
-	err = common.PunchHole(conn, &remoteAddr, []byte("server"), []byte("server"))
+	// Get the ID of the last update just to ignore all the previous updates
+
+	var backoff common.ConflictBackoff
+	updateOffset, err := common.GetLastUpdateId(bot)
+	for common.IsConflict(err) {
+		// Nothing can stop the server before it starts
+		backoff.Wait(err, nil)
+		updateOffset, err = common.GetLastUpdateId(bot)
+	}
 	if err != nil {
-		common.Fatal(err.Error())
+		common.Fatal("Cannot get last update ID: " + err.Error())
 	}
-
-	return nil
+	fmt.Printf("Last update ID is %d\n", updateOffset)
+	return updateOffset
 }
 
-func main() {
-    config, err := common.ParseCmdLine(os.Args[1:])
-    if err != nil {
-        common.Fatal("Cannot parse command line: " + err.Error())
-    }
+func pollUpdates(bot *tgapi.Bot, config *common.Config, signaler *signaling.Telegram) {
+	signaler.UpdateOffset = getStartOffset(bot, config)
 
-    client := common.MakeClient(*config)
+	if config.StateFile != "" {
+		signaler.OnUpdate = func(updateId int) error {
+			return saveState(config.StateFile, &state{UpdateOffset: updateId})
+		}
+	}
+
+    // Start receiving updates from the Telegram channel given on the command line
+
+	if err := signaler.Run(); err != nil {
+		common.Fatal("Cannot get updates from server: " + err.Error())
+	}
+}
+
+func setUpTelegram(config *common.Config) (*signaling.Telegram, *tgapi.Bot, func()) {
+    bot := common.MakeBot(config)
 
     // First of all try sending getMe request to test if bot is working
 
-    if err = common.TestBotWithGetMe(client, config); err != nil {
+    if _, err := bot.GetMe(); err != nil {
         common.Fatal("getMe call failed: " + err.Error())
     }
     fmt.Println("getMe works")
 
-	// Get the ID of the last update just to ignore all the previous updates
+	signaler := signaling.MakeTelegram(bot, config)
+	return signaler, bot, func() {
+		if config.Webhook != nil {
+			serveWebhook(bot, config, signaler)
+		} else {
+			pollUpdates(bot, config, signaler)
+		}
+	}
+}
 
-	updateOffset, err := common.GetLastUpdateId(client, config)
+// Picks up the room timeline where the previous run left off
+func resumeMatrix(signaler *signaling.Matrix, config *common.Config) {
+	saved, err := loadState(config.StateFile)
 	if err != nil {
-		common.Fatal("Cannot get last update ID: " + err.Error())
+		common.Fatal("Cannot load state file: " + err.Error())
 	}
-	fmt.Printf("Last update ID is %d\n", updateOffset)
-
-    // Start receiving updates from the Telegram channel given on the command line
+	if saved != nil && saved.MatrixSince != "" {
+		fmt.Println("Resuming from Matrix sync token " + saved.MatrixSince)
+		signaler.Resume(saved.MatrixSince)
+	}
+	signaler.OnSync = func(since string) error {
+		return saveState(config.StateFile, &state{MatrixSince: since})
+	}
+}
 
-    for {
-		updates, err := common.GetUpdates(client, config, updateOffset)
-		if err != nil {
-			common.Fatal("Cannot get updates from server: " + err.Error())
+func setUpSignaler(config *common.Config) (signaling.Signaler, func()) {
+	signaler, err := signaling.Make(config)
+	if err != nil {
+		common.Fatal(err.Error())
+	}
+	if matrix, ok := signaler.(*signaling.Matrix); ok && config.StateFile != "" {
+		resumeMatrix(matrix, config)
+	}
+	return signaler, func() {
+		runner, ok := signaler.(signaling.Runner)
+		if !ok {
+			return
 		}
-		for _, upd := range(updates) {
-			if upd.ChannelPost == nil {
-				continue
-			}
-			if upd.ChannelPost.Chat.Id != config.ChatId {
-				continue
+		if err := runner.Run(); err != nil {
+			common.Fatal("Cannot receive hub messages: " + err.Error())
+		}
+	}
+}
+
+func main() {
+    config, err := common.ParseCmdLine(os.Args[1:])
+    if err != nil {
+        common.Fatal("Cannot parse command line: " + err.Error())
+    }
+
+	var tickets *ticket.Issuer
+	if config.TicketKeyFile != "" {
+		tickets, err = ticket.LoadIssuer(config.TicketKeyFile)
+		if os.IsNotExist(err) {
+			// Another server may be generating it at the same time
+			if err = ticket.GenerateKey(config.TicketKeyFile); err == nil {
+				fmt.Println("Generated ticket key " + config.TicketKeyFile)
 			}
-			if upd.ChannelPost.Text == nil {
-				continue
+			if err == nil || os.IsExist(err) {
+				tickets, err = ticket.LoadIssuer(config.TicketKeyFile)
 			}
-			fmt.Println("Got channel message: " + *upd.ChannelPost.Text)
+		}
+		if err != nil {
+			common.Fatal("Cannot load ticket key: " + err.Error())
+		}
+	}
 
-			var msg common.HubMessage
-			if err = json.Unmarshal([]byte(*upd.ChannelPost.Text), &msg); err != nil {
-				fmt.Println("Cannot parse hub message: " + err.Error())
-				continue
-			}
+	var signaler signaling.Signaler
+	var telegram *signaling.Telegram
+	var bot *tgapi.Bot
+	var run func()
+	if config.Signaling == common.SignalingTelegram {
+		telegram, bot, run = setUpTelegram(config)
+		signaler = telegram
+	} else {
+		signaler, run = setUpSignaler(config)
+	}
+	signaler, err = signaling.Secure(signaler, config)
+	if err != nil {
+		common.Fatal("Cannot set up hub message sealing: " + err.Error())
+	}
+	// Tickets tell clients where to find us, ParseCmdLine makes sure we
+	// seal messages when taking tickets
+	if tickets != nil {
+		serverKey := signaler.(*signaling.Sealed).PublicKey()
+		if err = tickets.SetHub(common.MakeTicketHub(config, serverKey)); err != nil {
+			common.Fatal("Cannot save the hub for tickets: " + err.Error())
+		}
+	}
 
-			if err = handleHubMessage(client, config, &msg); err != nil {
-				common.Fatal("Cannot handle hub message: " + err.Error())
-			}
+	var accessPolicy *policy.Policy
+	if config.PolicyFile != "" {
+		accessPolicy, err = policy.Load(config.PolicyFile)
+		if err != nil {
+			common.Fatal("Cannot load policy: " + err.Error())
 		}
+	}
 
-		if len(updates) > 0 {
-			updateOffset = updates[len(updates) - 1].Id
+	// Approval prompts, inline queries and commands come through the
+	// Telegram signaler, which ParseCmdLine makes sure we use
+	var approvals *approver
+	if config.ApprovalChatId != 0 {
+		approvals = makeApprover(bot, config)
+		telegram.OnCallbackQuery = approvals.handleCallbackQuery
+	}
+	if len(config.TicketIssuers) > 0 {
+		telegram.OnInlineQuery = makeTicketDesk(bot, tickets, config).handleInlineQuery
+	}
+
+	sessions := makeSessionManager(signaler, config, accessPolicy, approvals, tickets)
+
+	if len(config.Operators) > 0 {
+		peers := makePeerTracker(config)
+		signaler.Observe(peers.observe)
+		center := makeCommandCenter(bot, config, sessions, peers)
+		if err = center.register(); err != nil {
+			fmt.Println("Cannot register bot commands: " + err.Error())
 		}
-    }
+		// Commands may take a while, e.g. /status asks the STUN server
+		telegram.OnCommand = func(message *tgapi.Message) {
+			go center.handle(message)
+		}
+	}
+
+	// Subscribe before receiving anything so that no message is missed
+	sub := subscribeToClients(signaler, config)
+	go run()
+	if config.PresenceInterval > 0 {
+		go announcePresence(context.Background(), signaler, config)
+	}
+
+	for msg := range sub.C {
+		handleHubMessage(sessions, msg)
+	}
+	sessions.wait()
 }
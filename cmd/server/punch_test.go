@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/client"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/natemu"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"net"
+	"testing"
+	"time"
+)
+
+func parseTestConfig(t *testing.T, stun *natemu.StunServer, args ...string) *common.Config {
+	t.Helper()
+	config, err := common.ParseCmdLine(append([]string{
+		"--signaling", "manual",
+		"--allow-endpoints", "203.0.113.0/24",
+		"--session-timeout", "10s",
+		"--punch-timeout", "2s",
+	}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.StunServer = stun.Addr()
+	return config
+}
+
+// Binds the sockets of a peer on a host behind the NAT
+func behind(nat *natemu.NAT, ip string) common.PacketListener {
+	return func() (net.PacketConn, error) {
+		conn, err := nat.Listen(ip, 0)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// Runs a session between the real client and server, each behind its own
+// NAT, and returns how punching went for the client
+func punchThroughNats(t *testing.T, clientNat natemu.NatType, serverNat natemu.NatType) error {
+	network := natemu.NewNetwork(1)
+	network.SetLatency(10 * time.Millisecond)
+	stun, err := natemu.StartStunServer(network, "198.51.100.1", 3478)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Close()
+	serverSide, err := network.AddNAT(serverNat, "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSide, err := network.AddNAT(clientNat, "203.0.113.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := signaling.MakeMemoryHub()
+	serverConfig := parseTestConfig(t, stun, "--name", "server")
+	serverSignaler := hub.Signaler()
+	sessions := makeSessionManager(serverSignaler, serverConfig, nil, nil, nil)
+	sessions.listen = behind(serverSide, "192.168.0.2")
+	sub := subscribeToClients(serverSignaler, serverConfig)
+	go func() {
+		for msg := range sub.C {
+			handleHubMessage(sessions, msg)
+		}
+	}()
+	defer sessions.wait()
+	defer serverSignaler.Close()
+
+	clientConfig := parseTestConfig(t, stun, "--target", "server")
+	clientSignaler := hub.Signaler()
+	defer clientSignaler.Close()
+	return client.Run(context.Background(), clientConfig, clientSignaler, behind(clientSide, "192.168.1.2"))
+}
+
+func TestPunchingThroughNats(t *testing.T) {
+	tests := []struct {
+		client natemu.NatType
+		server natemu.NatType
+		ok     bool
+	}{
+		{natemu.FullCone, natemu.PortRestrictedCone, true},
+		{natemu.RestrictedCone, natemu.PortRestrictedCone, true},
+		{natemu.PortRestrictedCone, natemu.PortRestrictedCone, true},
+		{natemu.PortRestrictedCone, natemu.RestrictedCone, true},
+		// A symmetric NAT sends the punching packets from another port than
+		// the one STUN saw, and the peers only listen to the endpoint they
+		// were given
+		{natemu.Symmetric, natemu.FullCone, false},
+		{natemu.PortRestrictedCone, natemu.Symmetric, false},
+		{natemu.Symmetric, natemu.Symmetric, false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(fmt.Sprintf("%v client, %v server", test.client, test.server), func(t *testing.T) {
+			t.Parallel()
+			err := punchThroughNats(t, test.client, test.server)
+			if test.ok && err != nil {
+				t.Fatalf("Punching failed: %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatal("Punching succeeded, want a failure")
+			}
+		})
+	}
+}
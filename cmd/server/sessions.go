@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/guard"
+	"github.com/ovandriyanov/tgpunch/pkg/policy"
+	"github.com/ovandriyanov/tgpunch/pkg/session"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"github.com/ovandriyanov/tgpunch/pkg/ticket"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Time left to tell the client how the session ended once the session
+// itself is out of time
+const farewellTimeout = 10 * time.Second
+
+// Rejections on their way to clients. Beyond that they are dropped and the
+// clients time out.
+const maxPendingRejects = 64
+
+type activeSession struct {
+	*session.Session
+	// Done once the session times out or is aborted. Everything the session
+	// waits for, from the approval to the socket, gives up then.
+	ctx   context.Context
+	abort context.CancelFunc
+
+	started  time.Time
+	endpoint *common.Endpoint
+}
+
+// Runs fn but stops waiting for it once ctx is done. fn keeps running in
+// the background then, so it must not block forever.
+func within(ctx context.Context, fn func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Runs every punching session in its own goroutine, so that a slow or
+// failing client affects nobody else
+type sessionManager struct {
+	signaler     signaling.Signaler
+	config       *common.Config
+	capabilities []string
+	policy       *policy.Policy
+	guard        *guard.Guard
+	approvals    *approver // nil unless requests need approval
+	tickets      *ticket.Issuer
+	listen       common.PacketListener // opens the socket of every session
+	slots        chan struct{}
+	rejects      chan struct{}
+	wg           sync.WaitGroup
+
+	mu       sync.Mutex
+	sessions map[uint64]*activeSession
+}
+
+func makeSessionManager(signaler signaling.Signaler, config *common.Config, accessPolicy *policy.Policy, approvals *approver, tickets *ticket.Issuer) *sessionManager {
+	return &sessionManager{
+		signaler:     signaler,
+		config:       config,
+		capabilities: session.LocalCapabilities(),
+		policy:       accessPolicy,
+		guard:        guard.MakeGuard(config),
+		approvals:    approvals,
+		tickets:      tickets,
+		listen:       common.ListenUDP,
+		slots:        make(chan struct{}, config.MaxSessions),
+		rejects:      make(chan struct{}, maxPendingRejects),
+		sessions:     make(map[uint64]*activeSession),
+	}
+}
+
+func (manager *sessionManager) publish(msg *common.HubMessage) {
+	if err := manager.signaler.Publish(msg); err != nil {
+		fmt.Printf("Cannot send %s for session %d: %v\n", msg.Type, msg.Serial, err)
+	}
+}
+
+// Publishes a message of a running session, giving up once ctx is done
+func (manager *sessionManager) publishWithin(ctx context.Context, msg *common.HubMessage) {
+	err := within(ctx, func() error {
+		return manager.signaler.Publish(msg)
+	})
+	if err != nil {
+		fmt.Printf("Cannot send %s for session %d: %v\n", msg.Type, msg.Serial, err)
+	}
+}
+
+// Time a session may take from the request to the end of punching
+func (manager *sessionManager) sessionTimeout() time.Duration {
+	timeout := manager.config.SessionTimeout
+	if manager.approvals != nil {
+		timeout += manager.approvals.timeout
+	}
+	return timeout
+}
+
+// Rejects a request that never became a running session. The rejection
+// is published in the background, so that a slow signaler does not hold up
+// the requests behind it.
+func (manager *sessionManager) reject(sess *session.Session, reason string) {
+	msg, err := sess.Send(session.TypeReject, reason)
+	if err != nil {
+		fmt.Printf("Session %d: %v\n", sess.Serial, err)
+		return
+	}
+	select {
+	case manager.rejects <- struct{}{}:
+	default:
+		fmt.Printf("Not sending reject for request %d, too many are pending\n", sess.Serial)
+		return
+	}
+
+	manager.wg.Add(1)
+	go func() {
+		defer manager.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), farewellTimeout)
+		defer cancel()
+		err := within(ctx, func() error {
+			defer func() { <-manager.rejects }()
+			return manager.signaler.Publish(msg)
+		})
+		if err != nil {
+			fmt.Printf("Cannot send %s for session %d: %v\n", msg.Type, msg.Serial, err)
+		}
+	}()
+}
+
+// Passes a message to the session it belongs to, starting a new session
+// for a request
+func (manager *sessionManager) handle(msg *common.HubMessage) {
+	if role, _ := session.Sender(msg.Type); role == session.Server {
+		// Ours or another server's
+		return
+	}
+	if msg.Type == session.TypeRequest {
+		manager.start(msg)
+		return
+	}
+
+	manager.mu.Lock()
+	active, ok := manager.sessions[msg.Serial]
+	manager.mu.Unlock()
+	if !ok {
+		fmt.Printf("Ignoring %s for unknown session %d\n", msg.Type, msg.Serial)
+		return
+	}
+	if err := active.Receive(msg); err != nil {
+		fmt.Printf("Session %d: %v\n", msg.Serial, err)
+		return
+	}
+	if active.State() == session.Cancelled {
+		fmt.Printf("Session %d: %v\n", msg.Serial, active.Err())
+		active.abort()
+	}
+}
+
+// Starts handling the request unless too many sessions are running already.
+// Called on the dispatch loop, so everything that may block happens in
+// the session goroutine or in the background.
+func (manager *sessionManager) start(request *common.HubMessage) {
+	sess := session.New(session.Server, request.Serial, manager.config.Name, request.From)
+	sess.Capabilities = manager.capabilities
+	if err := sess.Receive(request); err != nil {
+		fmt.Printf("Session %d: %v\n", request.Serial, err)
+		return
+	}
+
+	err := session.CheckVersion(request)
+	var features *session.Features
+	if err == nil {
+		features, err = session.Negotiate(request.Capabilities, manager.capabilities)
+	}
+	if err != nil {
+		fmt.Printf("Rejecting request %d: %v\n", request.Serial, err)
+		manager.reject(sess, err.Error())
+		return
+	}
+
+	// A valid ticket stands in for an allow rule, deny rules still apply
+	invite, err := manager.checkTicket(request)
+	if err != nil {
+		fmt.Printf("Rejecting request %d: invalid ticket: %v\n", request.Serial, err)
+		manager.reject(sess, "invalid ticket: "+err.Error())
+		return
+	}
+	var decision policy.Decision
+	if invite != nil {
+		decision = manager.policy.CheckDenyRules(request)
+		fmt.Printf("Policy: %s request %d from %s with ticket %s\n", decision, request.Serial, policy.Describe(request), invite.Id)
+	} else {
+		decision = manager.policy.Check(request)
+		fmt.Printf("Policy: %s request %d from %s\n", decision, request.Serial, policy.Describe(request))
+	}
+	if !decision.Allowed {
+		manager.reject(sess, "not authorized")
+		return
+	}
+	if err = guard.CheckEndpoint(request.PublicEndpoint, manager.config.AllowedEndpoints); err != nil {
+		fmt.Printf("Rejecting request %d: %v\n", request.Serial, err)
+		manager.reject(sess, err.Error())
+		return
+	}
+	fmt.Printf("Session %d uses %v\n", request.Serial, features)
+
+	manager.mu.Lock()
+	if _, ok := manager.sessions[request.Serial]; ok {
+		manager.mu.Unlock()
+		fmt.Printf("Ignoring duplicate request %d\n", request.Serial)
+		return
+	}
+	select {
+	case manager.slots <- struct{}{}:
+	default:
+		manager.mu.Unlock()
+		fmt.Printf("Rejecting request %d, %d sessions are running already\n", request.Serial, manager.config.MaxSessions)
+		manager.reject(sess, "server is busy, try again later")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), manager.sessionTimeout())
+	active := &activeSession{
+		Session:  sess,
+		ctx:      ctx,
+		abort:    cancel,
+		started:  time.Now(),
+		endpoint: request.PublicEndpoint,
+	}
+	manager.sessions[request.Serial] = active
+	manager.mu.Unlock()
+
+	manager.wg.Add(1)
+	go func() {
+		defer manager.wg.Done()
+		defer func() {
+			manager.mu.Lock()
+			delete(manager.sessions, request.Serial)
+			manager.mu.Unlock()
+			<-manager.slots
+			cancel()
+		}()
+		defer manager.finish(active, request)
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("Session %d: internal server error: %v\n", request.Serial, r)
+				manager.conclude(active, session.TypeError, errors.New("internal server error"))
+			}
+		}()
+		// Only now, so that a busy server does not waste the ticket. The
+		// ledger is saved to disk, so not on the dispatch loop.
+		if invite != nil {
+			if err := manager.tickets.Redeem(invite, request.SenderKey); err != nil {
+				fmt.Printf("Rejecting request %d: %v\n", request.Serial, err)
+				manager.conclude(active, session.TypeReject, errors.New("invalid ticket: "+err.Error()))
+				return
+			}
+		}
+		manager.run(active, request)
+	}()
+}
+
+func (manager *sessionManager) run(active *activeSession, request *common.HubMessage) {
+	ack, err := active.Send(session.TypeAck, "")
+	if err != nil {
+		fmt.Printf("Session %d: %v\n", request.Serial, err)
+		return
+	}
+	if deadline, ok := active.ctx.Deadline(); ok {
+		ack.ResponseTimeout = int((time.Until(deadline) + time.Second - 1) / time.Second)
+	}
+	manager.publishWithin(active.ctx, ack)
+
+	if manager.approvals != nil {
+		if err = manager.approvals.approve(active.ctx, request); err != nil {
+			manager.conclude(active, session.TypeReject, err)
+			return
+		}
+	}
+
+	err = handleStartPunchingRequest(manager, active, request)
+	if active.State() != session.Punching || active.ctx.Err() != nil {
+		manager.conclude(active, session.TypeError, err)
+		return
+	}
+	report, err := active.Report(err)
+	if err != nil {
+		fmt.Printf("Session %d: %v\n", request.Serial, err)
+		return
+	}
+	manager.publishWithin(active.ctx, report)
+
+	// The client may keep punching for as long as we do
+	reportCtx, cancel := context.WithTimeout(active.ctx, manager.config.PunchTimeout)
+	defer cancel()
+	select {
+	case <-active.PeerReported():
+		if peerErr := active.PeerErr(); peerErr != nil {
+			fmt.Printf("Session %d: client failed to punch: %v\n", request.Serial, peerErr)
+		} else {
+			fmt.Printf("Session %d: client punched through\n", request.Serial)
+		}
+	case <-reportCtx.Done():
+		fmt.Printf("Session %d: no report from the client\n", request.Serial)
+	}
+}
+
+// Tells the client why the session failed unless it is over already. The
+// session may be out of time, so the message gets a little more.
+func (manager *sessionManager) conclude(active *activeSession, msgType string, err error) {
+	var msg *common.HubMessage
+	switch {
+	case active.State().Terminal():
+		// Cancelled by the client or kicked by an operator
+		return
+	case errors.Is(active.ctx.Err(), context.DeadlineExceeded):
+		msg = active.Timeout()
+	case err != nil:
+		msg, err = active.Send(msgType, err.Error())
+		if err != nil {
+			fmt.Printf("Session %d: %v\n", active.Serial, err)
+			return
+		}
+	}
+	if msg == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), farewellTimeout)
+	defer cancel()
+	manager.publishWithin(ctx, msg)
+}
+
+func (manager *sessionManager) finish(active *activeSession, request *common.HubMessage) {
+	fmt.Printf("Session %d is over: %s\n", request.Serial, active.State())
+	ctx, cancel := context.WithTimeout(context.Background(), farewellTimeout)
+	defer cancel()
+	err := within(ctx, func() error {
+		signaling.CleanupSession(manager.signaler, request.Serial, active.Status())
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Cannot clean up messages of session %d: %v\n", request.Serial, err)
+	}
+}
+
+// Fails the session at an operator's request
+func (manager *sessionManager) kick(serial uint64) error {
+	manager.mu.Lock()
+	active, ok := manager.sessions[serial]
+	manager.mu.Unlock()
+	if !ok {
+		return errors.New(fmt.Sprintf("No session %d", serial))
+	}
+
+	msg, err := active.Send(session.TypeError, "kicked by the server operator")
+	if err != nil {
+		return err
+	}
+	manager.publish(msg)
+	active.abort()
+	return nil
+}
+
+// Returns the running sessions, oldest first
+func (manager *sessionManager) list() []*activeSession {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	var result []*activeSession
+	for _, active := range manager.sessions {
+		result = append(result, active)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].started.Before(result[j].started)
+	})
+	return result
+}
+
+// Waits for the running sessions to finish
+func (manager *sessionManager) wait() {
+	manager.wg.Wait()
+}
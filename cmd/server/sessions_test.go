@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/session"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Never gets messages of one type through
+type stuckSignaler struct {
+	signaling.Signaler
+	stuckType string
+	release   chan struct{}
+}
+
+func (signaler *stuckSignaler) Publish(msg *common.HubMessage) error {
+	if msg.Type == signaler.stuckType {
+		<-signaler.release
+	}
+	return signaler.Signaler.Publish(msg)
+}
+
+func parseServerConfig(t *testing.T, args ...string) *common.Config {
+	t.Helper()
+	config, err := common.ParseCmdLine(append([]string{
+		"--signaling", "manual",
+		"--name", "server",
+		"--allow-endpoints", "203.0.113.0/24",
+	}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// Serves the requests coming through the signaler of the session manager
+func serve(t *testing.T, sessions *sessionManager) {
+	sub := subscribeToClients(sessions.signaler, sessions.config)
+	go func() {
+		for msg := range sub.C {
+			handleHubMessage(sessions, msg)
+		}
+	}()
+	t.Cleanup(func() {
+		sessions.signaler.Close()
+		sessions.wait()
+	})
+}
+
+// Serves requests coming through the hub with the session manager of a
+// server named "server" and returns the signaler of a client
+func startServer(t *testing.T, hub *signaling.MemoryHub, signaler signaling.Signaler, args ...string) (*sessionManager, signaling.Signaler) {
+	t.Helper()
+	sessions := makeSessionManager(signaler, parseServerConfig(t, args...), nil, nil, nil)
+	serve(t, sessions)
+
+	clientSignaler := hub.Signaler()
+	t.Cleanup(func() {
+		clientSignaler.Close()
+	})
+	return sessions, clientSignaler
+}
+
+// Sends a request from the named client and returns the first message
+// telling how it ended
+func requestSession(t *testing.T, signaler signaling.Signaler, serial uint64, from string, ticket string) *common.HubMessage {
+	t.Helper()
+	sub := signaler.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.Serial == serial && msg.Type != session.TypeRequest && msg.Type != session.TypeAck
+	})
+	defer sub.Close()
+
+	sess := session.New(session.Client, serial, from, "server")
+	sess.Capabilities = session.LocalCapabilities()
+	request, err := sess.Send(session.TypeRequest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.PublicEndpoint = &common.Endpoint{Address: "203.0.113.2", Port: 4000}
+	request.Ticket = ticket
+	if err = signaler.Publish(request); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-sub.C:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("The server did not end the session")
+		return nil
+	}
+}
+
+func TestSessionTimesOutWhilePublishing(t *testing.T) {
+	hub := signaling.MakeMemoryHub()
+	stuck := &stuckSignaler{
+		Signaler:  hub.Signaler(),
+		stuckType: session.TypeAck,
+		release:   make(chan struct{}),
+	}
+	defer close(stuck.release)
+	sessions, client := startServer(t, hub, stuck, "--session-timeout", "200ms")
+
+	msg := requestSession(t, client, 1, "", "")
+	if msg.Type != session.TypeError || msg.Error != "timed out" {
+		t.Fatalf("Got %s %q, want the session to time out", msg.Type, msg.Error)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(sessions.list()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The session is still running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionSurvivesPanic(t *testing.T) {
+	hub := signaling.MakeMemoryHub()
+	sessions, client := startServer(t, hub, hub.Signaler())
+	sessions.listen = func() (net.PacketConn, error) {
+		panic("no sockets today")
+	}
+
+	for serial := uint64(1); serial <= 2; serial++ {
+		msg := requestSession(t, client, serial, "", "")
+		if msg.Type != session.TypeError || msg.Error != "internal server error" {
+			t.Fatalf("Got %s %q for session %d, want an internal server error", msg.Type, msg.Error, serial)
+		}
+	}
+}
+
+// The dispatch loop goes on while a rejection is stuck in the signaler
+func TestStuckRejectHoldsUpNoRequests(t *testing.T) {
+	hub := signaling.MakeMemoryHub()
+	stuck := &stuckSignaler{
+		Signaler:  hub.Signaler(),
+		stuckType: session.TypeReject,
+		release:   make(chan struct{}),
+	}
+	defer close(stuck.release)
+	sessions, client := startServer(t, hub, stuck)
+	sessions.listen = func() (net.PacketConn, error) {
+		return nil, errors.New("admitted")
+	}
+
+	// The server accepts no tickets
+	sess := session.New(session.Client, 1, "", "server")
+	sess.Capabilities = session.LocalCapabilities()
+	request, err := sess.Send(session.TypeRequest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Ticket = "ticket"
+	if err = client.Publish(request); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := requestSession(t, client, 2, "", "")
+	if msg.Type != session.TypeError || !strings.Contains(msg.Error, "admitted") {
+		t.Fatalf("Got %s %q, want the request admitted", msg.Type, msg.Error)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"github.com/ovandriyanov/tgpunch/pkg/ticket"
+	"strings"
+	"time"
+)
+
+const defaultTicketValidity = 24 * time.Hour
+
+// Tells which ticket an inline query asks for. Words are services, except
+// for a duration, which is how long the ticket is valid, "once", which
+// makes it single-use, and "key:" followed by the name or key ID of the
+// only peer that may use it.
+func parseTicketQuery(query string) ([]string, string, time.Duration, bool) {
+	var services []string
+	peerKey := ""
+	validFor := defaultTicketValidity
+	singleUse := false
+	for _, word := range strings.Fields(query) {
+		if word == "once" {
+			singleUse = true
+		} else if strings.HasPrefix(word, "key:") {
+			peerKey = strings.TrimPrefix(word, "key:")
+		} else if duration, err := time.ParseDuration(word); err == nil && duration > 0 {
+			validFor = duration
+		} else {
+			services = append(services, word)
+		}
+	}
+	return services, peerKey, validFor, singleUse
+}
+
+// Mints tickets for the issuers typing "@bot ssh 2h once key:laptop" in any
+// chat
+type ticketDesk struct {
+	bot     *tgapi.Bot
+	issuer  *ticket.Issuer
+	config  *common.Config
+	issuers map[int]bool
+}
+
+func makeTicketDesk(bot *tgapi.Bot, issuer *ticket.Issuer, config *common.Config) *ticketDesk {
+	desk := &ticketDesk{bot: bot, issuer: issuer, config: config, issuers: make(map[int]bool)}
+	for _, userId := range config.TicketIssuers {
+		desk.issuers[userId] = true
+	}
+	return desk
+}
+
+func (desk *ticketDesk) handleInlineQuery(query *tgapi.InlineQuery) {
+	// Tickets are personal, never let Telegram show them to someone else
+	answer := &tgapi.AnswerInlineQuery{InlineQueryId: query.Id, Results: []interface{}{}, IsPersonal: true}
+
+	if !desk.issuers[query.From.Id] {
+		fmt.Printf("Refusing to mint a ticket for user %d\n", query.From.Id)
+	} else {
+		services, peerKey, validFor, singleUse := parseTicketQuery(query.Query)
+		text, invite, err := desk.issuer.Mint(desk.config.Name, services, peerKey, validFor, singleUse)
+		if err != nil {
+			fmt.Println("Cannot mint ticket: " + err.Error())
+			return
+		}
+		fmt.Printf("Minted ticket %s for user %d\n", invite.Id, query.From.Id)
+
+		description := "Any service"
+		if len(services) > 0 {
+			description = "Services: " + strings.Join(services, ", ")
+		}
+		if peerKey != "" {
+			description += ", for " + peerKey + " only"
+		}
+		description += ", valid until " + invite.Expiry().Format(time.RFC3339)
+		if singleUse {
+			description += ", single use"
+		}
+		answer.Results = append(answer.Results, tgapi.InlineQueryResultArticle{
+			Type:        "article",
+			Id:          invite.Id,
+			Title:       "tgpunch invite",
+			Description: description,
+			InputMessageContent: tgapi.InputTextMessageContent{
+				MessageText: fmt.Sprintf("tgpunch invite (%s):\n\n%s", description, text),
+			},
+		})
+	}
+
+	if err := desk.bot.AnswerInlineQuery(answer); err != nil {
+		fmt.Println("Cannot answer inline query: " + err.Error())
+	}
+}
+
+// Returns the ticket the request presents, nil if none. Peers we only
+// know by the key they presented need one.
+func (manager *sessionManager) checkTicket(request *common.HubMessage) (*ticket.Ticket, error) {
+	if request.Ticket == "" {
+		if request.SenderKeyPresented {
+			return nil, errors.New("Unknown peers need a ticket")
+		}
+		return nil, nil
+	}
+	if manager.tickets == nil {
+		return nil, errors.New("This server does not accept tickets")
+	}
+	// Anyone who has seen the ticket could present it otherwise
+	if request.SenderKey == nil {
+		return nil, errors.New("Tickets are only accepted in sealed requests")
+	}
+	invite, err := manager.tickets.Verify(request.Ticket, manager.config.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !invite.AllowsKey(request.SenderKey) {
+		return nil, errors.New("Ticket is for peer " + invite.PeerKey)
+	}
+	if !invite.Allows(request.Service) {
+		return nil, errors.New("Ticket does not allow service " + request.Service)
+	}
+	return invite, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"github.com/ovandriyanov/tgpunch/pkg/policy"
+	"github.com/ovandriyanov/tgpunch/pkg/session"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"github.com/ovandriyanov/tgpunch/pkg/ticket"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func generateIdentity(t *testing.T, name string) *e2e.Identity {
+	t.Helper()
+	identity, err := e2e.GenerateIdentity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func makeTestIssuer(t *testing.T) *ticket.Issuer {
+	t.Helper()
+	keyPath := filepath.Join(t.TempDir(), "ticket.key")
+	if err := ticket.GenerateKey(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := ticket.LoadIssuer(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer
+}
+
+func mintTicket(t *testing.T, issuer *ticket.Issuer, peerKey string) string {
+	t.Helper()
+	text, _, err := issuer.Mint("server", nil, peerKey, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return text
+}
+
+// Serves sealed requests from the laptop and the phone, denying the laptop
+// and allowing nobody else. Admitted requests fail to get a socket.
+func startTicketServer(t *testing.T, issuer *ticket.Issuer) (laptop signaling.Signaler, phone signaling.Signaler) {
+	t.Helper()
+	hub := signaling.MakeMemoryHub()
+	server := generateIdentity(t, "server")
+	laptopIdentity := generateIdentity(t, "laptop")
+	phoneIdentity := generateIdentity(t, "phone")
+
+	accessPolicy, err := policy.Parse([]byte(`{
+		"default": "deny",
+		"rules": [
+			{"action": "allow", "services": ["web"]},
+			{"action": "deny", "peer_keys": ["laptop"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := []*e2e.PublicKey{laptopIdentity.Public(), phoneIdentity.Public()}
+	signaler := signaling.MakeSealed(hub.Signaler(), server, peers, time.Minute)
+	sessions := makeSessionManager(signaler, parseServerConfig(t), accessPolicy, nil, issuer)
+	sessions.listen = func() (net.PacketConn, error) {
+		return nil, errors.New("admitted")
+	}
+	serve(t, sessions)
+
+	serverKey := []*e2e.PublicKey{server.Public()}
+	laptop = signaling.MakeSealed(hub.Signaler(), laptopIdentity, serverKey, time.Minute)
+	phone = signaling.MakeSealed(hub.Signaler(), phoneIdentity, serverKey, time.Minute)
+	t.Cleanup(func() {
+		laptop.Close()
+		phone.Close()
+	})
+	return laptop, phone
+}
+
+func TestTicketsStillObeyDenyRules(t *testing.T) {
+	issuer := makeTestIssuer(t)
+	laptop, phone := startTicketServer(t, issuer)
+
+	tests := []struct {
+		name     string
+		client   string
+		ticket   string
+		admitted bool
+		error    string
+	}{
+		{"no ticket", "phone", "", false, "not authorized"},
+		{"ticket", "phone", mintTicket(t, issuer, ""), true, ""},
+		{"ticket for the peer", "phone", mintTicket(t, issuer, "phone"), true, ""},
+		{"ticket for another peer", "phone", mintTicket(t, issuer, "laptop"), false, "invalid ticket: Ticket is for peer laptop"},
+		{"denied peer", "laptop", mintTicket(t, issuer, ""), false, "not authorized"},
+		{"denied peer with its own ticket", "laptop", mintTicket(t, issuer, "laptop"), false, "not authorized"},
+	}
+	clients := map[string]signaling.Signaler{"laptop": laptop, "phone": phone}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := requestSession(t, clients[test.client], uint64(i+1), test.client, test.ticket)
+			if test.admitted && (msg.Type != session.TypeError || !strings.Contains(msg.Error, "admitted")) {
+				t.Fatalf("Got %s %q, want the request admitted", msg.Type, msg.Error)
+			}
+			if !test.admitted && (msg.Type != session.TypeReject || msg.Error != test.error) {
+				t.Fatalf("Got %s %q, want it rejected with %q", msg.Type, msg.Error, test.error)
+			}
+		})
+	}
+}
+
+// The sealed signaler drops plaintext, but the manager must not rely on it
+func TestTicketNeedsSealedRequest(t *testing.T) {
+	issuer := makeTestIssuer(t)
+	hub := signaling.MakeMemoryHub()
+	sessions := makeSessionManager(hub.Signaler(), parseServerConfig(t), nil, nil, issuer)
+	defer sessions.signaler.Close()
+
+	request := &common.HubMessage{Ticket: mintTicket(t, issuer, "")}
+	if _, err := sessions.checkTicket(request); err == nil {
+		t.Fatal("Accepted a ticket in a request nobody sealed")
+	}
+	request.SenderKey = generateIdentity(t, "phone").Public()
+	if _, err := sessions.checkTicket(request); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys nobody vouches for only get in with a ticket
+	request.Ticket = ""
+	request.SenderKeyPresented = true
+	if _, err := sessions.checkTicket(request); err == nil {
+		t.Fatal("Let an unknown key in without a ticket")
+	}
+}
+
+// Ticket holders need not be in the peer keys: the ticket is bound to the
+// key they present with it first
+func TestTicketAdmitsUnknownKeys(t *testing.T) {
+	issuer := makeTestIssuer(t)
+	hub := signaling.MakeMemoryHub()
+	server := generateIdentity(t, "server")
+	signaler := signaling.MakeSealed(hub.Signaler(), server, nil, time.Minute)
+	signaler.AcceptStrangers()
+	sessions := makeSessionManager(signaler, parseServerConfig(t), nil, nil, issuer)
+	sessions.listen = func() (net.PacketConn, error) {
+		return nil, errors.New("admitted")
+	}
+	serve(t, sessions)
+
+	connect := func(name string) signaling.Signaler {
+		client := signaling.MakeSealed(hub.Signaler(), generateIdentity(t, name), []*e2e.PublicKey{server.Public()}, time.Minute)
+		t.Cleanup(func() {
+			client.Close()
+		})
+		return client
+	}
+	guest := connect("guest")
+	other := connect("other")
+	shared := mintTicket(t, issuer, "")
+
+	tests := []struct {
+		name     string
+		client   signaling.Signaler
+		ticket   string
+		admitted bool
+		error    string
+	}{
+		{"first use", guest, shared, true, ""},
+		{"same key", guest, shared, true, ""},
+		{"another key", other, shared, false, "invalid ticket: Ticket is bound to another key"},
+		{"another key with its own ticket", other, mintTicket(t, issuer, ""), true, ""},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := requestSession(t, test.client, uint64(i+1), "", test.ticket)
+			if test.admitted && (msg.Type != session.TypeError || !strings.Contains(msg.Error, "admitted")) {
+				t.Fatalf("Got %s %q, want the request admitted", msg.Type, msg.Error)
+			}
+			if !test.admitted && (msg.Type != session.TypeReject || msg.Error != test.error) {
+				t.Fatalf("Got %s %q, want it rejected with %q", msg.Type, msg.Error, test.error)
+			}
+		})
+	}
+}
+
+func TestParseTicketQuery(t *testing.T) {
+	services, peerKey, validFor, singleUse := parseTicketQuery("ssh 2h key:laptop once web")
+	if strings.Join(services, ",") != "ssh,web" || peerKey != "laptop" || validFor != 2*time.Hour || !singleUse {
+		t.Fatalf("Got %v %q %v %v", services, peerKey, validFor, singleUse)
+	}
+	services, peerKey, validFor, singleUse = parseTicketQuery("")
+	if len(services) != 0 || peerKey != "" || validFor != defaultTicketValidity || singleUse {
+		t.Fatalf("Got %v %q %v %v for an empty query", services, peerKey, validFor, singleUse)
+	}
+}
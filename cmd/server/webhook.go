@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Updates carry at most a few kilobytes of text
+const maxUpdateSize = 1 << 20
+
+func makeSecretToken() string {
+	var buffer [32]byte
+	if _, err := rand.Read(buffer[:]); err != nil {
+		common.Fatal("Cannot generate webhook secret token: " + err.Error())
+	}
+	return hex.EncodeToString(buffer[:])
+}
+
+func makeWebhookHandler(signaler *signaling.Telegram, secretToken string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		receivedToken := r.Header.Get(tgapi.SecretTokenHeader)
+		if subtle.ConstantTimeCompare([]byte(receivedToken), []byte(secretToken)) != 1 {
+			fmt.Printf("Rejecting webhook request from %s: secret token mismatch\n", r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var upd tgapi.Update
+		body := http.MaxBytesReader(w, r.Body, maxUpdateSize)
+		if err := json.NewDecoder(body).Decode(&upd); err != nil {
+			fmt.Println("Cannot parse webhook update: " + err.Error())
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		signaler.HandleUpdate(&upd)
+	})
+}
+
+func registerWebhook(bot *tgapi.Bot, config *common.Config, secretToken string) error {
+	webhook := config.Webhook
+	params := &tgapi.SetWebhook{
+		Url:            webhook.Url,
+		AllowedUpdates: common.HubUpdateTypes,
+		// Same as polling mode: ignore everything posted before we started
+		// unless asked to process the backlog. Telegram keeps track of
+		// delivered updates itself, so there is no state file here.
+		DropPendingUpdates: config.BacklogMaxAge == 0,
+		SecretToken:        secretToken,
+	}
+
+	if !webhook.SelfSigned {
+		return bot.SetWebhook(params, nil)
+	}
+	if bot.LocalMode {
+		path, err := filepath.Abs(webhook.CertFile)
+		if err != nil {
+			return err
+		}
+		params.Certificate = "file://" + path
+		return bot.SetWebhook(params, nil)
+	}
+
+	certificate, err := os.Open(webhook.CertFile)
+	if err != nil {
+		return err
+	}
+	defer certificate.Close()
+	return bot.SetWebhook(params, certificate)
+}
+
+// Serves webhook requests until SIGINT or SIGTERM, then closes the signaler
+func serveWebhook(bot *tgapi.Bot, config *common.Config, signaler *signaling.Telegram) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	stop := make(chan struct{})
+	go func() {
+		sig := <-signals
+		fmt.Printf("Got %v, shutting down\n", sig)
+		close(stop)
+	}()
+
+	if err := runWebhook(bot, config, signaler, stop); err != nil {
+		common.Fatal(err.Error())
+	}
+}
+
+// Serves webhook requests until stop is closed or the listener fails.
+// Either way the webhook is deleted and the signaler closed.
+func runWebhook(bot *tgapi.Bot, config *common.Config, signaler *signaling.Telegram, stop <-chan struct{}) error {
+	webhook := config.Webhook
+
+	secretToken := webhook.SecretToken
+	if secretToken == "" {
+		secretToken = makeSecretToken()
+	}
+
+	server := &http.Server{
+		Addr:    webhook.ListenAddress,
+		Handler: makeWebhookHandler(signaler, secretToken),
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if webhook.CertFile != "" {
+			serverErr <- server.ListenAndServeTLS(webhook.CertFile, webhook.KeyFile)
+		} else {
+			// TLS is terminated by a reverse proxy in front of us
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+	fmt.Printf("Listening for webhook requests on %s\n", webhook.ListenAddress)
+
+	if err := registerWebhook(bot, config, secretToken); err != nil {
+		server.Close()
+		signaler.Close()
+		return errors.New("Cannot set webhook: " + err.Error())
+	}
+	fmt.Printf("Webhook is set to %s\n", webhook.Url)
+
+	var listenErr error
+	select {
+	case <-stop:
+	case listenErr = <-serverErr:
+	}
+
+	if err := bot.DeleteWebhook(&tgapi.DeleteWebhook{}); err != nil {
+		fmt.Println("Cannot delete webhook: " + err.Error())
+	} else {
+		fmt.Println("Webhook deleted")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	signaler.Close()
+
+	if listenErr != nil {
+		return errors.New("Webhook listener failed: " + listenErr.Error())
+	}
+	return nil
+}
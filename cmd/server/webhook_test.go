@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapitest"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testWebhookChannelId = -1001
+
+// Picks a free local address for the webhook listener
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestWebhook(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	t.Cleanup(fake.Close)
+	fake.AddChannel(testWebhookChannelId, "hub")
+
+	address := freeAddress(t)
+	config, err := common.ParseCmdLine([]string{
+		"--api-token", "token", "--chat", fmt.Sprint(testWebhookChannelId),
+		"--api-url", fake.URL,
+		"--webhook-url", "http://" + address + "/hook",
+		"--webhook-listen", address,
+		"--webhook-secret", "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := common.MakeBot(config)
+	signaler := signaling.MakeTelegram(bot, config)
+	sub := signaler.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.Type == "request"
+	})
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- runWebhook(bot, config, signaler, stop)
+	}()
+	// Telegram refuses getUpdates while a webhook is set
+	webhookSet := func() bool {
+		_, err := bot.GetUpdates(&tgapi.GetUpdates{})
+		return common.IsConflict(err)
+	}
+	waitUntil(t, "the webhook is set", webhookSet)
+
+	t.Run("wrong secret", func(t *testing.T) {
+		request, err := http.NewRequest(http.MethodPost, "http://"+address+"/hook", strings.NewReader(`{"update_id":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set(tgapi.SecretTokenHeader, "wrong")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusForbidden {
+			t.Fatalf("Got %s, want the request rejected", response.Status)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		text, err := common.EncodeHubMessage(&common.HubMessage{Type: "request", Serial: 1, From: "client"}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fake.PostMessage(testWebhookChannelId, text); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-sub.C:
+			if msg.Serial != 1 || msg.From != "client" {
+				t.Fatalf("Got %+v, want request 1 from the client", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("The update did not reach the signaler")
+		}
+	})
+
+	close(stop)
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("The webhook is still served")
+	}
+	if webhookSet() {
+		t.Fatal("The webhook is still set after shutdown")
+	}
+	if _, ok := <-sub.C; ok {
+		t.Fatal("The signaler is still open after shutdown")
+	}
+}
+
+func TestWebhookRejectsLargeUpdates(t *testing.T) {
+	handler := makeWebhookHandler(signaling.MakeTelegram(nil, &common.Config{}), "secret")
+	body := `{"update_id":1,"message":{"text":"` + strings.Repeat("a", maxUpdateSize) + `"}}`
+	request := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+	request.Header.Set(tgapi.SecretTokenHeader, "secret")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Got %d, want an oversized update rejected", response.Code)
+	}
+}
+
+func TestLocalModeNeedsApiUrl(t *testing.T) {
+	if _, err := common.ParseCmdLine([]string{"--api-token", "token", "--chat", "-1", "--local-mode"}); err == nil {
+		t.Fatal("Accepted local mode with the public Bot API")
+	}
+	config, err := common.ParseCmdLine([]string{"--api-token", "token", "--chat", "-1", "--local-mode", "--api-url", "http://127.0.0.1:8081"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !common.MakeBot(config).LocalMode {
+		t.Fatal("The bot is not in local mode")
+	}
+}
+
+// A local Bot API server reads the certificate itself, so it is not uploaded
+func TestLocalModePassesCertificatePath(t *testing.T) {
+	var contentType string
+	var params tgapi.SetWebhook
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&params)
+		w.Write([]byte(`{"ok":true,"result":true}`))
+	}))
+	defer api.Close()
+
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(certFile, []byte("certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := common.ParseCmdLine([]string{
+		"--api-token", "token", "--chat", "-1",
+		"--api-url", api.URL, "--local-mode",
+		"--webhook-url", "https://example.com/hook",
+		"--webhook-cert", certFile, "--webhook-key", certFile, "--webhook-self-signed",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = registerWebhook(common.MakeBot(config), config, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(contentType, "application/json") {
+		t.Fatalf("Sent %s, want JSON without an upload", contentType)
+	}
+	if params.Certificate != "file://"+certFile || params.SecretToken != "secret" {
+		t.Fatalf("Got certificate %q and secret %q", params.Certificate, params.SecretToken)
+	}
+}
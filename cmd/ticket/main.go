@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/ticket"
+	"os"
+	"time"
+)
+
+type config struct {
+	keyFile   string
+	server    string
+	services  []string
+	peerKey   string
+	validFor  time.Duration
+	singleUse bool
+}
+
+func parseCmdLine(args []string) (*config, error) {
+	result := config{validFor: 24 * time.Hour}
+	for arg := 0; arg < len(args); arg++ {
+		switch {
+		case args[arg] == "-k" || args[arg] == "--ticket-key":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--ticket-key requires a file argument")
+			}
+			result.keyFile = args[arg]
+		case args[arg] == "-s" || args[arg] == "--server":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--server requires a peer name argument")
+			}
+			result.server = args[arg]
+		case args[arg] == "--service":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--service requires a service name argument")
+			}
+			result.services = append(result.services, args[arg])
+		case args[arg] == "--peer-key":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--peer-key requires a peer name or key ID argument")
+			}
+			result.peerKey = args[arg]
+		case args[arg] == "--valid-for":
+			arg++
+			if arg >= len(args) {
+				return nil, errors.New("--valid-for requires a duration argument")
+			}
+			validFor, err := time.ParseDuration(args[arg])
+			if err != nil || validFor <= 0 {
+				return nil, errors.New("--valid-for requires a positive duration argument")
+			}
+			result.validFor = validFor
+		case args[arg] == "--once":
+			result.singleUse = true
+		default:
+			return nil, errors.New("Unknown argument: " + args[arg])
+		}
+	}
+
+	if result.keyFile == "" {
+		return nil, errors.New("No ticket key file given on the command line")
+	}
+	return &result, nil
+}
+
+// Mints an invite ticket with the key file the server uses for
+// --ticket-key, which the server generates on first start. The server name
+// must match the server's --name.
+func main() {
+	config, err := parseCmdLine(os.Args[1:])
+	if err != nil {
+		common.Fatal("Cannot parse command line: " + err.Error())
+	}
+
+	issuer, err := ticket.LoadIssuer(config.keyFile)
+	if err != nil {
+		common.Fatal("Cannot load ticket key: " + err.Error())
+	}
+	text, invite, err := issuer.Mint(config.server, config.services, config.peerKey, config.validFor, config.singleUse)
+	if err != nil {
+		common.Fatal("Cannot mint ticket: " + err.Error())
+	}
+	// The server saves its hub next to the key on start
+	if invite.Hub == nil {
+		fmt.Println("The server has not been started with this key yet, so the client needs its own hub options and peer keys")
+	}
+	fmt.Printf("Ticket %s is valid until %s. Pass it to the client with --ticket:\n%s\n", invite.Id, invite.Expiry().Format(time.RFC3339), text)
+}
@@ -0,0 +1,424 @@
+// Package cbor encodes Go values as CBOR (RFC 8949). It covers what hub
+// messages are made of: booleans, integers, strings, byte strings, slices,
+// string-keyed maps, pointers and structs. Structs become maps keyed by
+// their JSON field names, honouring omitempty, so that the CBOR form mirrors
+// the JSON one.
+package cbor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Major types
+const (
+	majorUint   = 0
+	majorNegInt = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorSimple = 7
+)
+
+const (
+	simpleFalse = 20
+	simpleTrue  = 21
+	simpleNull  = 22
+)
+
+// Guards against hostile input nesting values without end
+const maxDepth = 32
+
+func Marshal(value interface{}) ([]byte, error) {
+	return appendValue(nil, reflect.ValueOf(value))
+}
+
+func appendHead(buffer []byte, major byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return append(buffer, major<<5|byte(argument))
+	case argument <= math.MaxUint8:
+		return append(buffer, major<<5|24, byte(argument))
+	case argument <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buffer, major<<5|25), uint16(argument))
+	case argument <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buffer, major<<5|26), uint32(argument))
+	}
+	return binary.BigEndian.AppendUint64(append(buffer, major<<5|27), argument)
+}
+
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+func structFields(structType reflect.Type) []field {
+	var fields []field
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(structField.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = structField.Name
+		}
+		fields = append(fields, field{name: name, index: i, omitEmpty: options == "omitempty"})
+	}
+	return fields
+}
+
+func isEmpty(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return value.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return value.IsNil()
+	}
+	return value.IsZero()
+}
+
+func appendValue(buffer []byte, value reflect.Value) ([]byte, error) {
+	if !value.IsValid() {
+		return append(buffer, majorSimple<<5|simpleNull), nil
+	}
+
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			return append(buffer, majorSimple<<5|simpleTrue), nil
+		}
+		return append(buffer, majorSimple<<5|simpleFalse), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := value.Int(); n < 0 {
+			return appendHead(buffer, majorNegInt, uint64(-1-n)), nil
+		} else {
+			return appendHead(buffer, majorUint, uint64(n)), nil
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendHead(buffer, majorUint, value.Uint()), nil
+
+	case reflect.String:
+		buffer = appendHead(buffer, majorText, uint64(value.Len()))
+		return append(buffer, value.String()...), nil
+
+	case reflect.Slice:
+		if value.IsNil() {
+			return append(buffer, majorSimple<<5|simpleNull), nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			buffer = appendHead(buffer, majorBytes, uint64(value.Len()))
+			return append(buffer, value.Bytes()...), nil
+		}
+		buffer = appendHead(buffer, majorArray, uint64(value.Len()))
+		for i := 0; i < value.Len(); i++ {
+			var err error
+			if buffer, err = appendValue(buffer, value.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil
+
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return nil, errors.New("Only maps with string keys are supported")
+		}
+		if value.IsNil() {
+			return append(buffer, majorSimple<<5|simpleNull), nil
+		}
+		buffer = appendHead(buffer, majorMap, uint64(value.Len()))
+		iter := value.MapRange()
+		for iter.Next() {
+			var err error
+			buffer = appendHead(buffer, majorText, uint64(iter.Key().Len()))
+			buffer = append(buffer, iter.Key().String()...)
+			if buffer, err = appendValue(buffer, iter.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil
+
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return append(buffer, majorSimple<<5|simpleNull), nil
+		}
+		return appendValue(buffer, value.Elem())
+
+	case reflect.Struct:
+		var present []field
+		for _, f := range structFields(value.Type()) {
+			if !f.omitEmpty || !isEmpty(value.Field(f.index)) {
+				present = append(present, f)
+			}
+		}
+		buffer = appendHead(buffer, majorMap, uint64(len(present)))
+		for _, f := range present {
+			var err error
+			buffer = appendHead(buffer, majorText, uint64(len(f.name)))
+			buffer = append(buffer, f.name...)
+			if buffer, err = appendValue(buffer, value.Field(f.index)); err != nil {
+				return nil, err
+			}
+		}
+		return buffer, nil
+	}
+	return nil, errors.New("Cannot encode " + value.Type().String())
+}
+
+type decoder struct {
+	data []byte
+}
+
+func Unmarshal(data []byte, value interface{}) error {
+	target := reflect.ValueOf(value)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return errors.New("Unmarshal needs a non-nil pointer")
+	}
+	d := decoder{data: data}
+	if err := d.decode(target.Elem(), 0); err != nil {
+		return err
+	}
+	if len(d.data) != 0 {
+		return errors.New("Trailing data after CBOR value")
+	}
+	return nil
+}
+
+func (d *decoder) head() (byte, byte, uint64, error) {
+	if len(d.data) == 0 {
+		return 0, 0, 0, errors.New("Unexpected end of CBOR data")
+	}
+	major, info := d.data[0]>>5, d.data[0]&0x1f
+	d.data = d.data[1:]
+
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, 0, errors.New(fmt.Sprintf("Unsupported CBOR additional information %d", info))
+	}
+	if len(d.data) < size {
+		return 0, 0, 0, errors.New("Unexpected end of CBOR data")
+	}
+	var argument uint64
+	for _, b := range d.data[:size] {
+		argument = argument<<8 | uint64(b)
+	}
+	d.data = d.data[size:]
+	return major, info, argument, nil
+}
+
+func (d *decoder) take(length uint64) ([]byte, error) {
+	if length > uint64(len(d.data)) {
+		return nil, errors.New("CBOR string is longer than the data")
+	}
+	result := d.data[:length]
+	d.data = d.data[length:]
+	return result, nil
+}
+
+// Every element takes at least a byte, which bounds believable counts
+func (d *decoder) checkCount(count uint64) error {
+	if count > uint64(len(d.data)) {
+		return errors.New("CBOR item count is larger than the data")
+	}
+	return nil
+}
+
+func (d *decoder) decode(target reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return errors.New("CBOR data is nested too deeply")
+	}
+	major, info, argument, err := d.head()
+	if err != nil {
+		return err
+	}
+	return d.decodeItem(target, major, info, argument, depth)
+}
+
+func (d *decoder) decodeItem(target reflect.Value, major byte, info byte, argument uint64, depth int) error {
+	var err error
+	if major == majorSimple && info == simpleNull {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+	if target.Kind() == reflect.Pointer {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		return d.decodeItem(target.Elem(), major, info, argument, depth)
+	}
+
+	mismatch := errors.New(fmt.Sprintf("Cannot decode CBOR major type %d into %v", major, target.Type()))
+	switch major {
+	case majorUint, majorNegInt:
+		switch target.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if argument > math.MaxInt64 {
+				return errors.New("CBOR integer overflows " + target.Type().String())
+			}
+			n := int64(argument)
+			if major == majorNegInt {
+				n = -1 - n
+			}
+			if target.OverflowInt(n) {
+				return errors.New("CBOR integer overflows " + target.Type().String())
+			}
+			target.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if major == majorNegInt || target.OverflowUint(argument) {
+				return errors.New("CBOR integer overflows " + target.Type().String())
+			}
+			target.SetUint(argument)
+		default:
+			return mismatch
+		}
+
+	case majorBytes:
+		bytes, err := d.take(argument)
+		if err != nil {
+			return err
+		}
+		if target.Kind() != reflect.Slice || target.Type().Elem().Kind() != reflect.Uint8 {
+			return mismatch
+		}
+		target.SetBytes(append([]byte{}, bytes...))
+
+	case majorText:
+		text, err := d.take(argument)
+		if err != nil {
+			return err
+		}
+		if target.Kind() != reflect.String {
+			return mismatch
+		}
+		target.SetString(string(text))
+
+	case majorArray:
+		if target.Kind() != reflect.Slice {
+			return mismatch
+		}
+		if err = d.checkCount(argument); err != nil {
+			return err
+		}
+		slice := reflect.MakeSlice(target.Type(), int(argument), int(argument))
+		for i := 0; i < int(argument); i++ {
+			if err = d.decode(slice.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		target.Set(slice)
+
+	case majorMap:
+		if err = d.checkCount(argument); err != nil {
+			return err
+		}
+		return d.decodeMap(target, int(argument), depth, mismatch)
+
+	case majorSimple:
+		if target.Kind() != reflect.Bool || (info != simpleTrue && info != simpleFalse) {
+			return mismatch
+		}
+		target.SetBool(info == simpleTrue)
+
+	default:
+		return mismatch
+	}
+	return nil
+}
+
+func (d *decoder) decodeMap(target reflect.Value, count int, depth int, mismatch error) error {
+	var fields map[string]int
+	switch target.Kind() {
+	case reflect.Struct:
+		fields = make(map[string]int)
+		for _, f := range structFields(target.Type()) {
+			fields[f.name] = f.index
+		}
+	case reflect.Map:
+		if target.Type().Key().Kind() != reflect.String {
+			return mismatch
+		}
+		target.Set(reflect.MakeMapWithSize(target.Type(), count))
+	default:
+		return mismatch
+	}
+
+	for i := 0; i < count; i++ {
+		var key string
+		if err := d.decode(reflect.ValueOf(&key).Elem(), depth+1); err != nil {
+			return err
+		}
+
+		if target.Kind() == reflect.Map {
+			element := reflect.New(target.Type().Elem()).Elem()
+			if err := d.decode(element, depth+1); err != nil {
+				return err
+			}
+			target.SetMapIndex(reflect.ValueOf(key).Convert(target.Type().Key()), element)
+			continue
+		}
+
+		index, ok := fields[key]
+		if !ok {
+			// Unknown fields are skipped, like encoding/json does
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decode(target.Field(index), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) skip(depth int) error {
+	if depth > maxDepth {
+		return errors.New("CBOR data is nested too deeply")
+	}
+	major, _, argument, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case majorBytes, majorText:
+		_, err = d.take(argument)
+		return err
+	case majorArray, majorMap:
+		if err = d.checkCount(argument); err != nil {
+			return err
+		}
+		items := argument
+		if major == majorMap {
+			items *= 2
+		}
+		for i := uint64(0); i < items; i++ {
+			if err = d.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package cbor_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ovandriyanov/tgpunch/pkg/cbor"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"reflect"
+	"testing"
+)
+
+func sampleMessages() []*common.HubMessage {
+	return []*common.HubMessage{
+		{Type: "start_punching_request"},
+		{
+			Version:        2,
+			Capabilities:   []string{"strategy/udp-punch", "transport/udp"},
+			Type:           "start_punching_response",
+			Serial:         18446744073709551615,
+			PublicEndpoint: &common.Endpoint{Address: "203.0.113.7", Port: 65535},
+			From:           "server",
+			To:             "клиент",
+			Error:          "",
+			Service:        "ssh",
+			Ticket:         "eyJ0aWNrZXQiOnRydWV9.c2lnbmF0dXJl",
+		},
+		{
+			Version: 2,
+			Type:    "sealed",
+			Serial:  42,
+			Sealed: &e2e.Envelope{
+				Version:    1,
+				Sender:     bytes.Repeat([]byte{1}, 32),
+				Ephemeral:  bytes.Repeat([]byte{2}, 32),
+				Recipients: []e2e.RecipientKey{{}, {}},
+				Timestamp:  -1,
+				Nonce:      []byte{},
+				Ciphertext: bytes.Repeat([]byte{3}, 300),
+				Signature:  bytes.Repeat([]byte{4}, 64),
+			},
+		},
+	}
+}
+
+// CBOR has to carry exactly what JSON carries
+func TestRoundTrip(t *testing.T) {
+	for _, msg := range sampleMessages() {
+		encoded, err := cbor.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded common.HubMessage
+		if err = cbor.Unmarshal(encoded, &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		want, _ := json.Marshal(msg)
+		got, _ := json.Marshal(&decoded)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestRoundTripValues(t *testing.T) {
+	type inner struct {
+		Flag bool `json:"flag"`
+	}
+	type value struct {
+		Small    int8              `json:"small"`
+		Negative int64             `json:"negative"`
+		Big      uint64            `json:"big"`
+		Text     string            `json:"text"`
+		Bytes    []byte            `json:"bytes"`
+		List     []int             `json:"list"`
+		Map      map[string]string `json:"map"`
+		Nested   *inner            `json:"nested"`
+		Skipped  string            `json:"-"`
+		Empty    string            `json:"empty,omitempty"`
+	}
+	original := value{
+		Small:    -128,
+		Negative: -9223372036854775808,
+		Big:      1 << 40,
+		Text:     "ünïcödé",
+		Bytes:    []byte{0, 255},
+		List:     []int{0, 23, 24, 255, 256, 65535, 65536, -1, -25},
+		Map:      map[string]string{"a": "b", "": ""},
+		Nested:   &inner{Flag: true},
+		Skipped:  "not encoded",
+	}
+	encoded, err := cbor.Marshal(&original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded value
+	if err = cbor.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	original.Skipped = ""
+	if !reflect.DeepEqual(decoded, original) {
+		t.Fatalf("Got %+v, want %+v", decoded, original)
+	}
+}
+
+// Every prefix of a message must fail to decode instead of yielding a
+// partial message
+func TestTruncated(t *testing.T) {
+	for _, msg := range sampleMessages() {
+		encoded, err := cbor.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for length := 0; length < len(encoded); length++ {
+			var decoded common.HubMessage
+			if err = cbor.Unmarshal(encoded[:length], &decoded); err == nil {
+				t.Fatalf("Decoded %d of %d bytes", length, len(encoded))
+			}
+		}
+		var decoded common.HubMessage
+		if err = cbor.Unmarshal(append(encoded, 0), &decoded); err == nil {
+			t.Fatal("Decoded a message with trailing data")
+		}
+	}
+}
+
+func TestRejectsHostileInput(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"huge array", []byte{0xa1, 0x64, 'c', 'a', 'p', 's', 0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"huge map", []byte{0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"huge string", []byte{0xa1, 0x64, 't', 'y', 'p', 'e', 0x7a, 0xff, 0xff, 0xff, 0xff}},
+		{"deep nesting", append(append([]byte{0xa1, 0x61, 'x'}, bytes.Repeat([]byte{0x81}, 100)...), 0x00)},
+		{"indefinite length", []byte{0xbf, 0xff}},
+		{"wrong type", []byte{0xa1, 0x66, 's', 'e', 'r', 'i', 'a', 'l', 0x20}},
+		{"float", []byte{0xa1, 0x66, 's', 'e', 'r', 'i', 'a', 'l', 0xf9, 0x3c, 0x00}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var decoded common.HubMessage
+			if err := cbor.Unmarshal(test.data, &decoded); err == nil {
+				t.Fatalf("Decoded %+v", decoded)
+			}
+		})
+	}
+}
+
+// Whatever decodes must encode again and decode to the same message
+func FuzzUnmarshal(f *testing.F) {
+	for _, msg := range sampleMessages() {
+		encoded, err := cbor.Marshal(msg)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(encoded)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var decoded common.HubMessage
+		if cbor.Unmarshal(data, &decoded) != nil {
+			return
+		}
+		encoded, err := cbor.Marshal(&decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again common.HubMessage
+		if err = cbor.Unmarshal(encoded, &again); err != nil {
+			t.Fatal(err)
+		}
+		want, _ := json.Marshal(&decoded)
+		got, _ := json.Marshal(&again)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("Got %s, want %s", got, want)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+// Package client asks a server for a punching session over the signaling
+// channel and punches a hole towards it.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/session"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Runs a whole session: learns our public endpoint on a socket from listen,
+// sends the request through the signaler and punches a hole towards the
+// endpoint the server responds with. Cancelling ctx cancels the session.
+// A signaler that is a Runner is started once the request is out, so that
+// e.g. manual signaling asks for the answer only after printing the request.
+func Run(ctx context.Context, config *common.Config, signaler signaling.Signaler, listen common.PacketListener) error {
+	conn, err := listen()
+	if err != nil {
+		return errors.New("Cannot create UDP socket: " + err.Error())
+	}
+	defer conn.Close()
+
+	myEndpoint, err := common.GetMyPublicEndpoint(conn, config)
+	if err != nil {
+		return errors.New("Cannot get my public endpoint: " + err.Error())
+	}
+	fmt.Printf("Our public endpoint is %v\n", myEndpoint)
+
+	sess := session.New(session.Client, rand.Uint64(), config.Name, config.Target)
+	sess.Capabilities = session.LocalCapabilities()
+	sub := signaler.Subscribe(func(msg *common.HubMessage) bool {
+		if msg.Serial != sess.Serial {
+			return false
+		}
+		// Our own messages coming back
+		if role, ok := session.Sender(msg.Type); ok && role == session.Client {
+			return false
+		}
+		if msg.From != config.Target {
+			fmt.Printf("Ignoring response from unexpected peer %q\n", msg.From)
+			return false
+		}
+		return true
+	})
+	defer sub.Close()
+
+	request, err := sess.Send(session.TypeRequest, "")
+	if err != nil {
+		return err
+	}
+	request.PublicEndpoint = &myEndpoint
+	request.Service = config.Service
+	request.Ticket = config.Ticket
+	if err = signaler.Publish(request); err != nil {
+		return errors.New("Cannot send chat message: " + err.Error())
+	}
+	if config.Target != "" {
+		fmt.Printf("Sent start_punching_request to %s\n", config.Target)
+	} else {
+		fmt.Println("Sent start_punching_request to the chat")
+	}
+
+	runErr := make(chan error, 1)
+	if runner, ok := signaler.(signaling.Runner); ok {
+		go func() {
+			runErr <- runner.Run()
+		}()
+	}
+
+	response, err := waitForResponse(ctx, signaler, sess, sub, runErr, config.SessionTimeout)
+	if err != nil {
+		signaling.CleanupSession(signaler, sess.Serial, sess.Status())
+		return err
+	}
+	fmt.Printf("Remote public endpoint is %v\n", *response.PublicEndpoint)
+
+	remoteAddr := net.UDPAddr{
+		IP:   net.ParseIP(response.PublicEndpoint.Address),
+		Port: response.PublicEndpoint.Port,
+	}
+
+	punchErr := common.PunchHole(conn, &remoteAddr, []byte("client"), []byte("server"), config.PunchTimeout)
+	report, err := sess.Report(punchErr)
+	if err != nil {
+		return err
+	}
+	if err = signaler.Publish(report); err != nil {
+		fmt.Println("Cannot report the outcome to the server: " + err.Error())
+	}
+	waitForServerReport(sess, sub, config.PunchTimeout)
+	signaling.CleanupSession(signaler, sess.Serial, sess.Status())
+	return punchErr
+}
+
+// Drives the session until the server sends its endpoint. Fails if the
+// server rejects the request, fails, does not answer in time or ctx is
+// cancelled. The server's ack may give it more time than timeout.
+func waitForResponse(ctx context.Context, signaler signaling.Signaler, sess *session.Session, sub *signaling.Subscription, runErr <-chan error, timeout time.Duration) (*common.HubMessage, error) {
+	started := time.Now()
+	deadline := started.Add(timeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				return nil, errors.New("Signaling stopped before the server responded")
+			}
+			if err := session.CheckVersion(msg); err != nil {
+				return nil, errors.New("The server talks an unsupported protocol: " + err.Error())
+			}
+			if err := sess.Receive(msg); err != nil {
+				fmt.Println("Ignoring hub message: " + err.Error())
+				continue
+			}
+
+			switch sess.State() {
+			case session.Acknowledged:
+				fmt.Println("The server is working on our request")
+				extended := time.Now().Add(time.Duration(msg.ResponseTimeout) * time.Second)
+				if extended.After(deadline) {
+					fmt.Printf("The server may take up to %d seconds to respond\n", msg.ResponseTimeout)
+					deadline = extended
+					timer.Reset(time.Until(deadline))
+				}
+			case session.Punching:
+				if msg.PublicEndpoint == nil {
+					return nil, errors.New("The server sent no public endpoint")
+				}
+				features, err := session.Negotiate(sess.Capabilities, msg.Capabilities)
+				if err != nil {
+					if report, reportErr := sess.Report(err); reportErr == nil {
+						signaler.Publish(report)
+					}
+					return nil, err
+				}
+				fmt.Printf("Using %v\n", features)
+				return msg, nil
+			default:
+				return nil, sess.Err()
+			}
+
+		case err := <-runErr:
+			// Without an error the subscription gets closed as well
+			if err != nil {
+				return nil, errors.New("Cannot receive hub messages: " + err.Error())
+			}
+
+		case <-timer.C:
+			if msg := sess.Timeout(); msg != nil {
+				signaler.Publish(msg)
+			}
+			return nil, errors.New(fmt.Sprintf("No response from the server in %v", time.Since(started).Round(time.Second)))
+
+		case <-ctx.Done():
+			msg, err := sess.Send(session.TypeCancel, "interrupted by the user")
+			if err == nil {
+				signaler.Publish(msg)
+			}
+			return nil, errors.New("Interrupted")
+		}
+	}
+}
+
+// Lets the user know how punching went on the other side. The server may
+// keep punching for as long as we do.
+func waitForServerReport(sess *session.Session, sub *signaling.Subscription, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := sess.Receive(msg); err != nil {
+				fmt.Println("Ignoring hub message: " + err.Error())
+			}
+		case <-sess.PeerReported():
+			if err := sess.PeerErr(); err != nil {
+				fmt.Println("The server failed to punch a hole: " + err.Error())
+			} else {
+				fmt.Println("The server has punched a hole too")
+			}
+			return
+		case <-timer.C:
+			fmt.Println("No report from the server")
+			return
+		}
+	}
+}
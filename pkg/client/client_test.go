@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/session"
+	"github.com/ovandriyanov/tgpunch/pkg/signaling"
+	"testing"
+	"time"
+)
+
+// The server acks at once, allowing for the given number of seconds, and
+// responds after a while
+func respondLate(t *testing.T, responseTimeout int) error {
+	hub := signaling.MakeMemoryHub()
+	signaler := hub.Signaler()
+	defer signaler.Close()
+	server := hub.Signaler()
+	defer server.Close()
+
+	sess := session.New(session.Client, 1, "", "server")
+	sess.Capabilities = session.LocalCapabilities()
+	sub := signaler.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.Type != session.TypeRequest
+	})
+	defer sub.Close()
+	if _, err := sess.Send(session.TypeRequest, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		ack := &common.HubMessage{
+			Version:         session.ProtocolVersion,
+			Type:            session.TypeAck,
+			Serial:          1,
+			From:            "server",
+			ResponseTimeout: responseTimeout,
+		}
+		server.Publish(ack)
+		time.Sleep(300 * time.Millisecond)
+		server.Publish(&common.HubMessage{
+			Version:        session.ProtocolVersion,
+			Capabilities:   session.LocalCapabilities(),
+			Type:           session.TypeResponse,
+			Serial:         1,
+			From:           "server",
+			PublicEndpoint: &common.Endpoint{Address: "203.0.113.1", Port: 4000},
+		})
+	}()
+
+	_, err := waitForResponse(context.Background(), signaler, sess, sub, make(chan error), 100*time.Millisecond)
+	return err
+}
+
+func TestAckExtendsTimeout(t *testing.T) {
+	if err := respondLate(t, 5); err != nil {
+		t.Fatalf("Gave up despite the ack: %v", err)
+	}
+}
+
+func TestTimeoutWithoutExtension(t *testing.T) {
+	if err := respondLate(t, 0); err == nil {
+		t.Fatal("Waited past the timeout")
+	}
+}
@@ -1,13 +1,18 @@
 package common
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"github.com/ovandriyanov/tgpunch/pkg/cbor"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
 	"github.com/ovandriyanov/tgpunch/pkg/stun"
 	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"github.com/ovandriyanov/tgpunch/pkg/ticket"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
     "bytes"
     "errors"
@@ -15,18 +20,174 @@ import (
     "os"
 )
 
-const ApiUrlPrefix = "https://api.telegram.org/bot"
-
 type Config struct {
     ApiToken string
     ChatId int64
+    // Forum topic of the chat to use, zero for none
+    TopicId int
+    // Also take hub messages people send to the bot in private chats, and
+    // answer every such session in the chat it came from
+    PrivateChats bool
     ProxyUrl *url.URL
+    // Bot API server, e.g. a self-hosted telegram-bot-api
+    ApiUrl string
+    // The server at ApiUrl runs with --local and reads uploads from its
+    // own file system
+    LocalMode bool
+    StunServer *net.UDPAddr
+    Webhook *WebhookConfig
+    StateFile string
+    BacklogMaxAge time.Duration
+    // Post hub messages to Telegram as base64 CBOR instead of JSON. Only
+    // Telegram posts are short enough to need it, and only the Telegram
+    // signaler splits messages that are still too long. Matrix, MQTT and
+    // rendezvous always carry JSON, which fits their limits many times over.
+    CompactEncoding bool
+    // What to do with our posts once a session is over or they get older
+    // than MessageRetention
+    Cleanup string
+    MessageRetention time.Duration
+
+    Signaling string
+    RendezvousUrl string
+    Room string
+    RoomSecret string
+
+    MatrixHomeserver string
+    MatrixToken string
+    MatrixRoom string
+
+    MqttBroker string
+    MqttUsername string
+    MqttPassword string
+    MqttTopicPrefix string
+    MqttPeer string
+    MqttRemotePeer string
+
+    // How many punching sessions the server runs at once and for how long,
+    // not counting the time an approval may take
+    MaxSessions int
+    SessionTimeout time.Duration
+    // How long each peer keeps punching, and waits for the other one's
+    // report afterwards
+    PunchTimeout time.Duration
+
+    // Where the server may send punching packets and how many. Endpoints
+    // in AllowedEndpoints skip the private and reserved address checks.
+    AllowedEndpoints []*net.IPNet
+    GlobalPacketRate int
+    DestinationPacketRate int
+    MaxUnansweredPackets int
+
+    // Our peer name and the peer the client sends its request to
+    Name string
+    Target string
+    // The service the client asks for
+    Service string
+    // Who may request punching from the server, anyone if empty
+    PolicyFile string
+    // Telegram chat where one of the Approvers has to approve every
+    // request, none if zero. The server tells clients how long it may take.
+    ApprovalChatId int64
+    ApprovalTimeout time.Duration
+    Approvers []int
+    // The server's ticket signing key, no tickets are accepted without it.
+    // The server generates it on first start. The users in TicketIssuers
+    // may mint tickets via inline mode.
+    TicketKeyFile string
+    TicketIssuers []int
+    // Bot and Matrix tokens for ticket holders, who get the rest of our hub
+    // options with the ticket. Ours stay out of tickets.
+    TicketApiToken string
+    TicketMatrixToken string
+    // The invite ticket the client presents, and the key of the server
+    // that it tells
+    Ticket string
+    ServerKey *e2e.PublicKey
+    // Telegram users who may control the server with bot commands, no
+    // commands are handled if empty. Commands are answered in place in
+    // private chats and OperatorChatId, elsewhere the answer goes to the
+    // operator privately.
+    Operators []int
+    OperatorChatId int64
+    // How often the server announces itself in the hub, so that /peers of
+    // other servers lists it while it serves no sessions. Never if zero.
+    PresenceInterval time.Duration
+
+    // Seal hub messages with our key for the peers in the peer keys file
+    KeyFile string
+    PeerKeysFile string
 }
 
+// Defaults for manual signaling. At the slowest punching pace the punch
+// timeout costs fewer packets than MaxUnansweredPackets allows by default.
+const (
+    ManualSessionTimeout = 10 * time.Minute
+    ManualPunchTimeout = 3 * time.Minute
+)
+
+// Signaling backends
+const (
+    SignalingTelegram = "telegram"
+    SignalingRendezvous = "rendezvous"
+    SignalingMatrix = "matrix"
+    SignalingMqtt = "mqtt"
+    SignalingManual = "manual"
+)
+
+// Cleanup modes
+const (
+    CleanupNone = ""
+    CleanupDelete = "delete"
+    CleanupEdit = "edit"
+)
+
+// Receive updates via setWebhook instead of getUpdates long polling
+type WebhookConfig struct {
+    Url string
+    ListenAddress string
+    CertFile string
+    KeyFile string
+    SelfSigned bool
+    SecretToken string
+}
+
+// Environment variable setting the Bot API server, --api-url overrides it
+const ApiUrlEnvironment = "TGPUNCH_API_URL"
+
+var defaultStunServer = net.UDPAddr{IP: net.ParseIP("109.71.104.73"), Port: 3478}
+
 type HubMessage struct {
+	// Protocol version and capabilities of the sender
+	Version int `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
 	Type string `json:"type"`
 	Serial uint64 `json:"serial"`
 	PublicEndpoint *Endpoint `json:"public_endpoint"`
+	// Names of the sending and the addressed peer, empty for unnamed peers
+	From string `json:"from,omitempty"`
+	To string `json:"to,omitempty"`
+	// Why the server could not handle the request
+	Error string `json:"error,omitempty"`
+	// In acks, how many seconds the server may still take to respond, e.g.
+	// because someone has to approve the request
+	ResponseTimeout int `json:"response_timeout,omitempty"`
+	// The actual message, encrypted and signed, when Type is "sealed"
+	Sealed *e2e.Envelope `json:"sealed,omitempty"`
+	// What the client wants to reach on the server side
+	Service string `json:"service,omitempty"`
+	// Invite ticket authorizing the request
+	Ticket string `json:"ticket,omitempty"`
+	// The key of a ticket holder the server does not know yet, presented
+	// inside the sealed message
+	Key *e2e.PublicKey `json:"key,omitempty"`
+	// The Telegram user who posted the message, nil for channel posts and
+	// other backends
+	Sender *tgapi.User `json:"-"`
+	// The peer key that sealed the message, nil for unsealed messages
+	SenderKey *e2e.PublicKey `json:"-"`
+	// Set if nobody vouches for SenderKey, which the sender presented itself
+	SenderKeyPresented bool `json:"-"`
 }
 
 type Endpoint struct {
@@ -39,12 +200,126 @@ func Fatal(message string) {
     os.Exit(1)
 }
 
+func parseUserIds(list string) ([]int, error) {
+    var userIds []int
+    for _, userId := range strings.Split(list, ",") {
+        parsed, err := strconv.Atoi(strings.TrimSpace(userId))
+        if err != nil {
+            return nil, err
+        }
+        userIds = append(userIds, parsed)
+    }
+    return userIds, nil
+}
+
+// Returns the argument of the last --ticket, empty if there is none
+func findTicket(args []string) string {
+    var text string
+    for arg := 0; arg+1 < len(args); arg++ {
+        if args[arg] == "--ticket" {
+            arg++
+            text = args[arg]
+        }
+    }
+    return text
+}
+
+func useHub(config *Config, hub *ticket.Hub) {
+    if hub.Signaling != "" {
+        config.Signaling = hub.Signaling
+    }
+    config.TopicId = hub.TopicId
+    config.RendezvousUrl = hub.RendezvousUrl
+    config.Room = hub.Room
+    config.RoomSecret = hub.RoomSecret
+    config.MatrixHomeserver = hub.MatrixHomeserver
+    config.MatrixToken = hub.MatrixToken
+    config.MatrixRoom = hub.MatrixRoom
+    config.MqttBroker = hub.MqttBroker
+    config.MqttUsername = hub.MqttUsername
+    config.MqttPassword = hub.MqttPassword
+    if hub.MqttTopicPrefix != "" {
+        config.MqttTopicPrefix = hub.MqttTopicPrefix
+    }
+    config.ServerKey = hub.ServerKey
+}
+
+// Tells ticket holders where the server meets its clients. Room secrets
+// and MQTT credentials are shared by all peers anyway, bot and Matrix
+// tokens go in only if given for ticket holders.
+func MakeTicketHub(config *Config, serverKey *e2e.PublicKey) *ticket.Hub {
+    hub := &ticket.Hub{Signaling: config.Signaling, ServerKey: serverKey}
+    switch config.Signaling {
+    case SignalingTelegram:
+        hub.ApiToken = config.TicketApiToken
+        hub.ChatId = config.ChatId
+        hub.TopicId = config.TopicId
+    case SignalingRendezvous:
+        hub.RendezvousUrl = config.RendezvousUrl
+        hub.Room = config.Room
+        hub.RoomSecret = config.RoomSecret
+    case SignalingMatrix:
+        hub.MatrixHomeserver = config.MatrixHomeserver
+        hub.MatrixToken = config.TicketMatrixToken
+        hub.MatrixRoom = config.MatrixRoom
+    case SignalingMqtt:
+        hub.MqttBroker = config.MqttBroker
+        hub.MqttUsername = config.MqttUsername
+        hub.MqttPassword = config.MqttPassword
+        hub.MqttTopicPrefix = config.MqttTopicPrefix
+    }
+    return hub
+}
+
 func ParseCmdLine(args []string) (*Config, error) {
     var apiToken *string
     var chatId *int64
-    var proxyUrl *url.URL
     var err error
 
+    config := Config{
+        ApiUrl: tgapi.DefaultApiUrl,
+        StunServer: &defaultStunServer,
+        Signaling: SignalingTelegram,
+        MqttTopicPrefix: "tgpunch",
+        MessageRetention: 10 * time.Minute,
+        MaxSessions: 16,
+        SessionTimeout: 30 * time.Second,
+        PunchTimeout: 5 * time.Second,
+        GlobalPacketRate: 100,
+        DestinationPacketRate: 4,
+        // Enough for three punching attempts
+        MaxUnansweredPackets: 33,
+        ApprovalTimeout: 2 * time.Minute,
+    }
+    webhook := WebhookConfig{ListenAddress: ":8443"}
+    sessionTimeoutGiven := false
+    punchTimeoutGiven := false
+
+    if apiUrl := os.Getenv(ApiUrlEnvironment); apiUrl != "" {
+        if _, err = url.Parse(apiUrl); err != nil {
+            return nil, errors.New("Cannot parse " + ApiUrlEnvironment + ": " + err.Error())
+        }
+        config.ApiUrl = apiUrl
+    }
+
+    // The ticket tells where to find the server. Hub options given on the
+    // command line win over it.
+    if text := findTicket(args); text != "" {
+        invite, err := ticket.Parse(text)
+        if err != nil {
+            return nil, errors.New("Cannot parse ticket: " + err.Error())
+        }
+        if invite.Hub != nil {
+            useHub(&config, invite.Hub)
+            if invite.Hub.ApiToken != "" {
+                apiToken = &invite.Hub.ApiToken
+            }
+            if invite.Hub.ChatId != 0 {
+                chatId = &invite.Hub.ChatId
+            }
+        }
+    }
+
     for arg := 0; arg < len(args); arg++ {
         switch {
         case args[arg] == "-t" || args[arg] == "--api-token":
@@ -63,32 +338,552 @@ func ParseCmdLine(args []string) (*Config, error) {
 			if err != nil {
 				return nil, errors.New("Cannot parse chat: " + err.Error())
 			}
+        case args[arg] == "--topic":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--topic requires a message thread ID argument")
+            }
+            config.TopicId, err = strconv.Atoi(args[arg])
+            if err != nil {
+                return nil, errors.New("Cannot parse topic ID: " + err.Error())
+            }
+        case args[arg] == "--private-chats":
+            config.PrivateChats = true
         case args[arg] == "-x" || args[arg] == "--proxy":
             arg++
             if arg >= len(args) {
                 return nil, errors.New("--proxy requires a string argument")
             }
-            proxyUrl, err = url.Parse(args[arg])
+            config.ProxyUrl, err = url.Parse(args[arg])
             if err != nil {
                 return nil, errors.New("Cannot parse proxy URL: " + err.Error())
             }
+        case args[arg] == "-u" || args[arg] == "--api-url":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--api-url requires a string argument")
+            }
+            if _, err = url.Parse(args[arg]); err != nil {
+                return nil, errors.New("Cannot parse API URL: " + err.Error())
+            }
+            config.ApiUrl = args[arg]
+        case args[arg] == "-l" || args[arg] == "--local-mode":
+            config.LocalMode = true
+        case args[arg] == "--compact":
+            config.CompactEncoding = true
+        case args[arg] == "--cleanup":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--cleanup requires a mode argument")
+            }
+            if args[arg] != CleanupDelete && args[arg] != CleanupEdit {
+                return nil, errors.New("--cleanup mode must be " + CleanupDelete + " or " + CleanupEdit)
+            }
+            config.Cleanup = args[arg]
+        case args[arg] == "--message-retention":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--message-retention requires a duration argument")
+            }
+            config.MessageRetention, err = time.ParseDuration(args[arg])
+            if err != nil || config.MessageRetention <= 0 {
+                return nil, errors.New("--message-retention requires a positive duration argument")
+            }
+        case args[arg] == "-s" || args[arg] == "--stun":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--stun requires a host:port argument")
+            }
+            config.StunServer, err = net.ResolveUDPAddr("udp", args[arg])
+            if err != nil {
+                return nil, errors.New("Cannot resolve STUN server: " + err.Error())
+            }
+        case args[arg] == "--webhook-url":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--webhook-url requires a string argument")
+            }
+            if _, err = url.Parse(args[arg]); err != nil {
+                return nil, errors.New("Cannot parse webhook URL: " + err.Error())
+            }
+            webhook.Url = args[arg]
+        case args[arg] == "--webhook-listen":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--webhook-listen requires a host:port argument")
+            }
+            webhook.ListenAddress = args[arg]
+        case args[arg] == "--webhook-cert":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--webhook-cert requires a file argument")
+            }
+            webhook.CertFile = args[arg]
+        case args[arg] == "--webhook-key":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--webhook-key requires a file argument")
+            }
+            webhook.KeyFile = args[arg]
+        case args[arg] == "--webhook-self-signed":
+            webhook.SelfSigned = true
+        case args[arg] == "--webhook-secret":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--webhook-secret requires a string argument")
+            }
+            webhook.SecretToken = args[arg]
+        case args[arg] == "--state-file":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--state-file requires a file argument")
+            }
+            config.StateFile = args[arg]
+        case args[arg] == "--backlog-max-age":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--backlog-max-age requires a duration argument")
+            }
+            config.BacklogMaxAge, err = time.ParseDuration(args[arg])
+            if err != nil {
+                return nil, errors.New("Cannot parse backlog max age: " + err.Error())
+            }
+        case args[arg] == "--max-sessions":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--max-sessions requires an integer argument")
+            }
+            config.MaxSessions, err = strconv.Atoi(args[arg])
+            if err != nil || config.MaxSessions < 1 {
+                return nil, errors.New("--max-sessions requires a positive integer argument")
+            }
+        case args[arg] == "--session-timeout":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--session-timeout requires a duration argument")
+            }
+            config.SessionTimeout, err = time.ParseDuration(args[arg])
+            if err != nil {
+                return nil, errors.New("Cannot parse session timeout: " + err.Error())
+            }
+            sessionTimeoutGiven = true
+        case args[arg] == "--punch-timeout":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--punch-timeout requires a duration argument")
+            }
+            config.PunchTimeout, err = time.ParseDuration(args[arg])
+            if err != nil {
+                return nil, errors.New("Cannot parse punch timeout: " + err.Error())
+            }
+            if config.PunchTimeout <= 0 {
+                return nil, errors.New("--punch-timeout must be positive")
+            }
+            punchTimeoutGiven = true
+        case args[arg] == "--allow-endpoints":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--allow-endpoints requires a comma separated CIDR list argument")
+            }
+            for _, cidr := range strings.Split(args[arg], ",") {
+                _, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+                if err != nil {
+                    return nil, errors.New("Cannot parse allowed endpoints: " + err.Error())
+                }
+                config.AllowedEndpoints = append(config.AllowedEndpoints, network)
+            }
+        case args[arg] == "--global-rate":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--global-rate requires an integer argument")
+            }
+            config.GlobalPacketRate, err = strconv.Atoi(args[arg])
+            if err != nil || config.GlobalPacketRate < 1 {
+                return nil, errors.New("--global-rate requires a positive integer argument")
+            }
+        case args[arg] == "--destination-rate":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--destination-rate requires an integer argument")
+            }
+            config.DestinationPacketRate, err = strconv.Atoi(args[arg])
+            if err != nil || config.DestinationPacketRate < 1 {
+                return nil, errors.New("--destination-rate requires a positive integer argument")
+            }
+        case args[arg] == "--max-unanswered":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--max-unanswered requires an integer argument")
+            }
+            config.MaxUnansweredPackets, err = strconv.Atoi(args[arg])
+            if err != nil || config.MaxUnansweredPackets < 1 {
+                return nil, errors.New("--max-unanswered requires a positive integer argument")
+            }
+        case args[arg] == "--signaling":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--signaling requires a backend name argument")
+            }
+            config.Signaling = args[arg]
+        case args[arg] == "--rendezvous-url":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--rendezvous-url requires a string argument")
+            }
+            if _, err = url.Parse(args[arg]); err != nil {
+                return nil, errors.New("Cannot parse rendezvous URL: " + err.Error())
+            }
+            config.RendezvousUrl = args[arg]
+        case args[arg] == "--room":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--room requires a string argument")
+            }
+            config.Room = args[arg]
+        case args[arg] == "--room-secret":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--room-secret requires a string argument")
+            }
+            config.RoomSecret = args[arg]
+        case args[arg] == "--matrix-homeserver":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--matrix-homeserver requires a string argument")
+            }
+            if _, err = url.Parse(args[arg]); err != nil {
+                return nil, errors.New("Cannot parse Matrix homeserver URL: " + err.Error())
+            }
+            config.MatrixHomeserver = args[arg]
+        case args[arg] == "--matrix-token":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--matrix-token requires a string argument")
+            }
+            config.MatrixToken = args[arg]
+        case args[arg] == "--matrix-room":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--matrix-room requires a room ID argument")
+            }
+            config.MatrixRoom = args[arg]
+        case args[arg] == "--mqtt-broker":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--mqtt-broker requires a URL argument")
+            }
+            if _, err = url.Parse(args[arg]); err != nil {
+                return nil, errors.New("Cannot parse MQTT broker URL: " + err.Error())
+            }
+            config.MqttBroker = args[arg]
+        case args[arg] == "--mqtt-username":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--mqtt-username requires a string argument")
+            }
+            config.MqttUsername = args[arg]
+        case args[arg] == "--mqtt-password":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--mqtt-password requires a string argument")
+            }
+            config.MqttPassword = args[arg]
+        case args[arg] == "--mqtt-topic-prefix":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--mqtt-topic-prefix requires a string argument")
+            }
+            config.MqttTopicPrefix = args[arg]
+        case args[arg] == "--mqtt-peer":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--mqtt-peer requires a peer ID argument")
+            }
+            config.MqttPeer = args[arg]
+        case args[arg] == "--mqtt-remote":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--mqtt-remote requires a peer ID argument")
+            }
+            config.MqttRemotePeer = args[arg]
+        case args[arg] == "-n" || args[arg] == "--name":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--name requires a peer name argument")
+            }
+            config.Name = args[arg]
+        case args[arg] == "-p" || args[arg] == "--target":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--target requires a peer name argument")
+            }
+            config.Target = args[arg]
+        case args[arg] == "--service":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--service requires a service name argument")
+            }
+            config.Service = args[arg]
+        case args[arg] == "--policy":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--policy requires a file argument")
+            }
+            config.PolicyFile = args[arg]
+        case args[arg] == "--approval-chat":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--approval-chat requires an integer argument")
+            }
+            config.ApprovalChatId, err = strconv.ParseInt(args[arg], 10, 64)
+            if err != nil {
+                return nil, errors.New("Cannot parse approval chat: " + err.Error())
+            }
+        case args[arg] == "--approval-timeout":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--approval-timeout requires a duration argument")
+            }
+            config.ApprovalTimeout, err = time.ParseDuration(args[arg])
+            if err != nil {
+                return nil, errors.New("Cannot parse approval timeout: " + err.Error())
+            }
+        case args[arg] == "--approvers":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--approvers requires a comma separated user ID list argument")
+            }
+            config.Approvers, err = parseUserIds(args[arg])
+            if err != nil {
+                return nil, errors.New("Cannot parse approvers: " + err.Error())
+            }
+        case args[arg] == "--ticket-key":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--ticket-key requires a file argument")
+            }
+            config.TicketKeyFile = args[arg]
+        case args[arg] == "--ticket-issuers":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--ticket-issuers requires a comma separated user ID list argument")
+            }
+            config.TicketIssuers, err = parseUserIds(args[arg])
+            if err != nil {
+                return nil, errors.New("Cannot parse ticket issuers: " + err.Error())
+            }
+        case args[arg] == "--ticket-api-token":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--ticket-api-token requires a string argument")
+            }
+            config.TicketApiToken = args[arg]
+        case args[arg] == "--ticket-matrix-token":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--ticket-matrix-token requires a string argument")
+            }
+            config.TicketMatrixToken = args[arg]
+        case args[arg] == "--operators":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--operators requires a comma separated user ID list argument")
+            }
+            config.Operators, err = parseUserIds(args[arg])
+            if err != nil {
+                return nil, errors.New("Cannot parse operators: " + err.Error())
+            }
+        case args[arg] == "--operator-chat":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--operator-chat requires an integer argument")
+            }
+            config.OperatorChatId, err = strconv.ParseInt(args[arg], 10, 64)
+            if err != nil {
+                return nil, errors.New("Cannot parse operator chat: " + err.Error())
+            }
+        case args[arg] == "--presence-interval":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--presence-interval requires a duration argument")
+            }
+            config.PresenceInterval, err = time.ParseDuration(args[arg])
+            if err != nil || config.PresenceInterval < 0 {
+                return nil, errors.New("--presence-interval requires a non-negative duration argument")
+            }
+        case args[arg] == "--ticket":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--ticket requires a ticket argument")
+            }
+            config.Ticket = args[arg]
+        case args[arg] == "--key-file":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--key-file requires a file argument")
+            }
+            config.KeyFile = args[arg]
+        case args[arg] == "--peer-keys":
+            arg++
+            if arg >= len(args) {
+                return nil, errors.New("--peer-keys requires a file argument")
+            }
+            config.PeerKeysFile = args[arg]
+        }
+    }
+
+    // The ticket tells which server it is for and, if it allows a single
+    // service, which service to ask for
+    if config.Ticket != "" {
+        invite, err := ticket.Parse(config.Ticket)
+        if err != nil {
+            return nil, errors.New("Cannot parse ticket: " + err.Error())
+        }
+        if config.Target == "" {
+            config.Target = invite.Server
+        }
+        if config.Service == "" && len(invite.Services) == 1 {
+            config.Service = invite.Services[0]
         }
     }
 
     // Check required arguments
-    if apiToken == nil {
-        return nil, errors.New("No API token given on the command line")
+    switch config.Signaling {
+    case SignalingTelegram:
+        if apiToken == nil {
+            return nil, errors.New("No API token given on the command line")
+        }
+        if chatId == nil {
+            return nil, errors.New("No chat given on the command line")
+        }
+        config.ApiToken = *apiToken
+        config.ChatId = *chatId
+
+    case SignalingRendezvous:
+        if config.RendezvousUrl == "" {
+            return nil, errors.New("No rendezvous server URL given on the command line")
+        }
+        if config.Room == "" || config.RoomSecret == "" {
+            return nil, errors.New("Rendezvous signaling requires --room and --room-secret")
+        }
+
+    case SignalingMatrix:
+        if config.MatrixHomeserver == "" || config.MatrixToken == "" || config.MatrixRoom == "" {
+            return nil, errors.New("Matrix signaling requires --matrix-homeserver, --matrix-token and --matrix-room")
+        }
+
+    case SignalingMqtt:
+        // Peer names double as MQTT peer IDs unless told otherwise
+        if config.MqttPeer == "" {
+            config.MqttPeer = config.Name
+        }
+        if config.MqttRemotePeer == "" {
+            config.MqttRemotePeer = config.Target
+        }
+        if config.MqttBroker == "" || config.MqttPeer == "" {
+            return nil, errors.New("MQTT signaling requires --mqtt-broker and --mqtt-peer or --name")
+        }
+
+    case SignalingManual:
+        // Every token is carried by hand, which takes minutes rather than
+        // seconds. The server keeps punching until the client gets its
+        // answer and starts punching too.
+        if !sessionTimeoutGiven {
+            config.SessionTimeout = ManualSessionTimeout
+        }
+        if !punchTimeoutGiven {
+            config.PunchTimeout = ManualPunchTimeout
+        }
+
+    default:
+        return nil, errors.New("Unknown signaling backend: " + config.Signaling)
+    }
+
+    // Without peer keys we can only talk to the server a ticket tells, or
+    // as a ticket server to the keys presented with tickets
+    if config.PeerKeysFile != "" && config.KeyFile == "" {
+        return nil, errors.New("--peer-keys requires --key-file")
+    }
+    if config.KeyFile != "" && config.PeerKeysFile == "" && config.TicketKeyFile == "" && config.ServerKey == nil {
+        return nil, errors.New("--key-file requires --peer-keys unless tickets are used")
+    }
+
+    if config.ApprovalChatId != 0 && config.Signaling != SignalingTelegram {
+        return nil, errors.New("--approval-chat requires Telegram signaling")
+    }
+    // Anyone in the approval chat can see the buttons, so the approvers who
+    // may press them have to be named
+    if (config.ApprovalChatId != 0) != (len(config.Approvers) > 0) {
+        return nil, errors.New("--approval-chat and --approvers must be given together")
+    }
+
+    if len(config.Operators) > 0 && config.Signaling != SignalingTelegram {
+        return nil, errors.New("--operators requires Telegram signaling")
+    }
+    if config.OperatorChatId != 0 && len(config.Operators) == 0 {
+        return nil, errors.New("--operator-chat requires --operators")
+    }
+
+    // Unnamed servers cannot be told apart, and nobody would carry the
+    // announcements of manual signaling
+    if config.PresenceInterval > 0 {
+        if config.Name == "" {
+            return nil, errors.New("--presence-interval requires --name")
+        }
+        if config.Signaling == SignalingManual {
+            return nil, errors.New("--presence-interval does not work with manual signaling")
+        }
     }
 
-    if chatId == nil {
-        return nil, errors.New("No chat given on the command line")
+    // Tickets are only accepted in sealed requests
+    if (config.TicketKeyFile != "" || config.Ticket != "") && config.KeyFile == "" {
+        return nil, errors.New("Tickets require --key-file")
+    }
+    if config.TicketApiToken != "" {
+        if config.TicketKeyFile == "" {
+            return nil, errors.New("--ticket-api-token requires --ticket-key")
+        }
+        if config.Signaling != SignalingTelegram {
+            return nil, errors.New("--ticket-api-token requires Telegram signaling")
+        }
+    }
+    if config.TicketMatrixToken != "" {
+        if config.TicketKeyFile == "" {
+            return nil, errors.New("--ticket-matrix-token requires --ticket-key")
+        }
+        if config.Signaling != SignalingMatrix {
+            return nil, errors.New("--ticket-matrix-token requires Matrix signaling")
+        }
+    }
+
+    if len(config.TicketIssuers) > 0 {
+        if config.TicketKeyFile == "" {
+            return nil, errors.New("--ticket-issuers requires --ticket-key")
+        }
+        if config.Signaling != SignalingTelegram {
+            return nil, errors.New("--ticket-issuers requires Telegram signaling")
+        }
     }
 
-    return &Config{
-        ApiToken: *apiToken,
-        ChatId: *chatId,
-        ProxyUrl: proxyUrl,
-    }, nil
+    if webhook.Url != "" {
+        if config.Signaling != SignalingTelegram {
+            return nil, errors.New("Webhook mode requires Telegram signaling")
+        }
+        if (webhook.CertFile == "") != (webhook.KeyFile == "") {
+            return nil, errors.New("--webhook-cert and --webhook-key must be given together")
+        }
+        if webhook.SelfSigned && webhook.CertFile == "" {
+            return nil, errors.New("--webhook-self-signed requires --webhook-cert")
+        }
+        config.Webhook = &webhook
+    }
+
+    // The public Bot API never reads our files
+    if config.LocalMode && config.ApiUrl == tgapi.DefaultApiUrl {
+        return nil, errors.New("--local-mode requires --api-url or " + ApiUrlEnvironment)
+    }
+
+    return &config, nil
 }
 
 func MakeClient(config Config) *http.Client {
@@ -99,105 +894,102 @@ func MakeClient(config Config) *http.Client {
     }
 }
 
-func ApiErrorDescription(description *string) string {
-	if description != nil {
-		return *description
-	}
-	return "Unknown error"
+func MakeBot(config *Config) *tgapi.Bot {
+	bot := tgapi.MakeBot(MakeClient(*config), config.ApiUrl, config.ApiToken)
+	bot.LocalMode = config.LocalMode
+	return bot
 }
 
-func ToJsonReader(object interface {}) *bytes.Reader {
-	json, err := json.Marshal(object)
+// Compact hub messages are base64 CBOR after this prefix, while plain ones
+// are JSON objects
+const CompactPrefix = "~"
+
+func EncodeHubMessage(msg *HubMessage, compact bool) (string, error) {
+	if !compact {
+		text, err := json.Marshal(msg)
+		return string(text), err
+	}
+
+	encoded, err := cbor.Marshal(msg)
 	if err != nil {
-		panic("Cannot serialize getUpdates request: " + err.Error())
+		return "", err
 	}
-	return bytes.NewReader(json)
+	return CompactPrefix + base64.RawURLEncoding.EncodeToString(encoded), nil
 }
 
-func TestBotWithGetMe(client *http.Client, config *Config) error {
-    response, err := client.Get(ApiUrlPrefix + config.ApiToken + "/getMe")
-    if err != nil {
-        return err
-    }
-
-    var apiResponse tgapi.GetMeResponse
-    err = json.NewDecoder(response.Body).Decode(&apiResponse)
-    if err != nil {
-        return errors.New("Cannot decode JSON response from server: " + err.Error())
-    }
-
-    if !apiResponse.Ok {
-		return errors.New(ApiErrorDescription(apiResponse.Description))
-    }
-
-    return nil
-}
+// Accepts both encodings
+func DecodeHubMessage(text string) (*HubMessage, error) {
+	var msg HubMessage
+	if !strings.HasPrefix(text, CompactPrefix) {
+		if err := json.Unmarshal([]byte(text), &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	}
 
-func GetLastUpdateId(client *http.Client, config *Config) (int, error) {
-	response, err := client.Post(
-        ApiUrlPrefix + config.ApiToken + "/getUpdates",
-        "application/json",
-        ToJsonReader(&tgapi.GetUpdates{
-			Offset: -1,
-			Timeout: 0,
-		}),
-    )
+	encoded, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(text, CompactPrefix))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	var apiResponse tgapi.GetUpdatesResponse
-	err = json.NewDecoder(response.Body).Decode(&apiResponse)
+	if err = cbor.Unmarshal(encoded, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func GetLastUpdateId(bot *tgapi.Bot) (int, error) {
+	updates, err := bot.GetUpdates(&tgapi.GetUpdates{
+		Offset: -1,
+		Timeout: 0,
+	})
 	if err != nil {
 		return 0, err
 	}
-	if !apiResponse.Ok {
-		return 0, errors.New(ApiErrorDescription(apiResponse.Description))
-	}
-	if len(apiResponse.Result) == 0 {
+	if len(updates) == 0 {
 		return 0, nil
 	}
-	return apiResponse.Result[len(apiResponse.Result) - 1].Id, nil
+	return updates[len(updates) - 1].Id, nil
 }
 
-func GetUpdates(client *http.Client, config *Config, offset int) ([]tgapi.Update, error) {
-	response, err := client.Post(
-        ApiUrlPrefix + config.ApiToken + "/getUpdates",
-        "application/json",
-        ToJsonReader(&tgapi.GetUpdates{
-			Offset: offset + 1,
-			Timeout: 30,
-			AllowedUpdates: []string{"channel_post"},
-		}),
-    )
-	if err != nil {
-		return nil, err
-	}
+// Hub messages arrive as channel posts in channels and as messages in
+// groups and private chats. Callback queries come from the approval
+// prompt buttons, inline queries ask for invite tickets.
+var HubUpdateTypes = []string{"channel_post", "message", "callback_query", "inline_query"}
 
-	var apiResponse tgapi.GetUpdatesResponse
-	err = json.NewDecoder(response.Body).Decode(&apiResponse)
+func GetUpdates(bot *tgapi.Bot, offset int) ([]tgapi.Update, error) {
+	return bot.GetUpdates(&tgapi.GetUpdates{
+		Offset: offset + 1,
+		Timeout: 30,
+		AllowedUpdates: HubUpdateTypes,
+	})
+}
+
+// Opens the UDP socket a peer uses for STUN and punching. Tests pass one
+// binding sockets behind emulated NATs.
+type PacketListener func() (net.PacketConn, error)
+
+// Binds a real socket to a random port on all local addresses
+func ListenUDP() (net.PacketConn, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: 0})
 	if err != nil {
 		return nil, err
 	}
-	if !apiResponse.Ok {
-		return nil, errors.New(ApiErrorDescription(apiResponse.Description))
-	}
-
-	return apiResponse.Result, nil
+	return conn, nil
 }
 
-func GetMyPublicEndpoint(conn *net.UDPConn, config *Config) (Endpoint, error) {
-	serverAddress := net.UDPAddr{IP: net.ParseIP("109.71.104.73"), Port: 3478}
-	transactionId, err := stun.SendBindingRequest(conn, &serverAddress)
+func GetMyPublicEndpoint(conn net.PacketConn, config *Config) (Endpoint, error) {
+	serverAddress := config.StunServer
+	transactionId, err := stun.SendBindingRequest(conn, serverAddress)
 	if err != nil {
 		return Endpoint{}, err
 	}
 
-	addrChan := make(chan *net.UDPAddr)
-	errChan := make(chan error)
+	addrChan := make(chan *net.UDPAddr, 1)
+	errChan := make(chan error, 1)
 	retryChan := time.After(1 * time.Second)
 
 	go func() {
-		address, err := stun.ReceiveBindingResponse(conn, &serverAddress, transactionId)
+		address, err := stun.ReceiveBindingResponse(conn, serverAddress, transactionId)
 		if err != nil {
 			errChan <-err
 			return
@@ -224,7 +1016,7 @@ func GetMyPublicEndpoint(conn *net.UDPConn, config *Config) (Endpoint, error) {
 			}
 
 			retries++
-			_, err := stun.SendBindingRequest(conn, &serverAddress)
+			err := stun.ResendBindingRequest(conn, serverAddress, transactionId)
 			if err != nil {
 				return Endpoint{}, err
 			}
@@ -233,25 +1025,9 @@ func GetMyPublicEndpoint(conn *net.UDPConn, config *Config) (Endpoint, error) {
 	}
 }
 
-func sendEchoRequest(conn *net.UDPConn, peerEndpoint *net.UDPAddr, payload []byte) error {
-	var buffer [1024]byte
-	copy(buffer[:], "req")
-	copy(buffer[3:], payload)
-
-	return sendMessage(conn, peerEndpoint, buffer[:3 + len(payload)])
-}
-
-func sendEchoReply(conn *net.UDPConn, peerEndpoint *net.UDPAddr, payload []byte) error {
-	var buffer [1024]byte
-	copy(buffer[:], "rsp")
-	copy(buffer[3:], payload)
-
-	return sendMessage(conn, peerEndpoint, buffer[:3 + len(payload)])
-}
-
-func sendMessage(conn *net.UDPConn, peerEndpoint *net.UDPAddr, message []byte) error {
+func sendMessage(conn net.PacketConn, peerEndpoint *net.UDPAddr, message []byte) error {
 	fmt.Printf("Sending %q to %v\n", message, *peerEndpoint)
-	nwritten, err := conn.WriteToUDP(message, peerEndpoint)
+	nwritten, err := conn.WriteTo(message, peerEndpoint)
 	if err != nil {
 		return err
 	}
@@ -261,27 +1037,43 @@ func sendMessage(conn *net.UDPConn, peerEndpoint *net.UDPAddr, message []byte) e
 	return nil
 }
 
-func PunchHole(conn *net.UDPConn, peerEndpoint *net.UDPAddr, myMagic []byte) error {
-	sendEchoRequest(conn, peerEndpoint, myMagic)
+// Punching packets go out often at first, when the peer is most likely
+// punching too. Later on, e.g. while the tokens of manual signaling are
+// carried around, they are only sent to keep the NAT mappings alive.
+const (
+	punchInterval = 500 * time.Millisecond
+	punchBurst = 5 * time.Second
+	maxPunchInterval = 15 * time.Second
+)
+
+// Sends myMagic to the peer until peerMagic comes back from it or the
+// timeout passes
+func PunchHole(conn net.PacketConn, peerEndpoint *net.UDPAddr, myMagic []byte, peerMagic []byte, timeout time.Duration) error {
+	if err := sendMessage(conn, peerEndpoint, myMagic); err != nil {
+		return err
+	}
 
-	okChan := make(chan int)
-	errChan := make(chan error)
-	retryChan := time.After(500 * time.Millisecond)
+	okChan := make(chan int, 1)
+	errChan := make(chan error, 1)
+	started := time.Now()
+	interval := punchInterval
+	retryChan := time.After(interval)
+	timeoutChan := time.After(timeout)
 
 	go func() {
 		var buffer [1024]byte
 
 		for {
-			nread, addr, err := conn.ReadFromUDP(buffer[:])
+			nread, addr, err := conn.ReadFrom(buffer[:])
 			if err != nil {
 				errChan <-err
 				return
 			}
-			fmt.Printf("Received %q from %v\n", buffer[:nread], *addr)
+			fmt.Printf("Received %q from %v\n", buffer[:nread], addr)
 			if addr.String() != peerEndpoint.String() {
 				continue
 			}
-			if bytes.Compare(buffer[:nread], myMagic) != 0 {
+			if bytes.Compare(buffer[:nread], peerMagic) != 0 {
 				continue
 			}
 
@@ -291,31 +1083,32 @@ func PunchHole(conn *net.UDPConn, peerEndpoint *net.UDPAddr, myMagic []byte) err
 	}()
 
 	retries := 0
-	maxRetries := 10
 
 	for {
 		select {
 		case <-okChan:
-			return nil
+			// Our previous packets might have been dropped by the peer's NAT
+			// before it opened the hole, so let the peer know we hear it
+			return sendMessage(conn, peerEndpoint, myMagic)
 
 		case err := <-errChan:
 			return err
 
+		case <-timeoutChan:
+			return errors.New(fmt.Sprintf("Timeout after %d retries", retries))
+
 		case <-retryChan:
-			if retries == maxRetries {
-				return errors.New(fmt.Sprintf("Timeout after %d retries", retries))
-			}
 			retries++
-
-			fmt.Printf("Sending %q to %v\n", myMagic, *peerEndpoint)
-			nwritten, err := conn.WriteToUDP(myMagic, peerEndpoint)
-			if err != nil {
+			if err := sendMessage(conn, peerEndpoint, myMagic); err != nil {
 				return err
 			}
-			if nwritten != len(myMagic) {
-				return errors.New("Outbound datagram truncated")
+			if time.Since(started) >= punchBurst {
+				interval *= 2
+				if interval > maxPunchInterval {
+					interval = maxPunchInterval
+				}
 			}
-			retryChan = time.After(500 * time.Millisecond)
+			retryChan = time.After(interval)
 		}
 	}
 }
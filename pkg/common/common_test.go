@@ -0,0 +1,165 @@
+package common_test
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"github.com/ovandriyanov/tgpunch/pkg/natemu"
+	"github.com/ovandriyanov/tgpunch/pkg/ticket"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManualSignalingTimeouts(t *testing.T) {
+	tests := []struct {
+		args    []string
+		session time.Duration
+		punch   time.Duration
+	}{
+		{[]string{"--signaling", "manual"}, common.ManualSessionTimeout, common.ManualPunchTimeout},
+		{[]string{"--signaling", "manual", "--session-timeout", "1m", "--punch-timeout", "20s"}, time.Minute, 20 * time.Second},
+		{[]string{"--api-token", "token", "--chat", "-1"}, 30 * time.Second, 5 * time.Second},
+	}
+	for _, test := range tests {
+		config, err := common.ParseCmdLine(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.SessionTimeout != test.session || config.PunchTimeout != test.punch {
+			t.Errorf("%v: got timeouts %v and %v, want %v and %v", test.args, config.SessionTimeout, config.PunchTimeout, test.session, test.punch)
+		}
+	}
+}
+
+func listenBehindNat(t *testing.T, network *natemu.Network, stun *natemu.StunServer, publicIp string) (net.PacketConn, *net.UDPAddr) {
+	t.Helper()
+	nat, err := network.AddNAT(natemu.PortRestrictedCone, publicIp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := nat.Listen("192.168.0.2", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := common.GetMyPublicEndpoint(conn, &common.Config{StunServer: stun.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, &net.UDPAddr{IP: net.ParseIP(endpoint.Address), Port: endpoint.Port}
+}
+
+// Like in manual signaling, where the server starts punching long before
+// the client gets its endpoint
+func TestPunchHoleWaitsForLatePeer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Takes several seconds")
+	}
+
+	network := natemu.NewNetwork(1)
+	stun, err := natemu.StartStunServer(network, "198.51.100.1", 3478)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Close()
+	earlyConn, earlyEndpoint := listenBehindNat(t, network, stun, "203.0.113.1")
+	lateConn, lateEndpoint := listenBehindNat(t, network, stun, "203.0.113.2")
+
+	earlyErr := make(chan error, 1)
+	go func() {
+		earlyErr <- common.PunchHole(earlyConn, lateEndpoint, []byte("server"), []byte("client"), time.Minute)
+	}()
+
+	// Past the initial burst of packets
+	time.Sleep(7 * time.Second)
+	if err = common.PunchHole(lateConn, earlyEndpoint, []byte("client"), []byte("server"), 20*time.Second); err != nil {
+		t.Fatal("Late peer: " + err.Error())
+	}
+	if err = <-earlyErr; err != nil {
+		t.Fatal("Early peer: " + err.Error())
+	}
+}
+
+func TestHubMessageEncodings(t *testing.T) {
+	msg := &common.HubMessage{
+		Version:        2,
+		Type:           "start_punching_request",
+		Serial:         7,
+		PublicEndpoint: &common.Endpoint{Address: "203.0.113.7", Port: 4000},
+		From:           "client",
+	}
+	for _, compact := range []bool{false, true} {
+		text, err := common.EncodeHubMessage(msg, compact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(text, common.CompactPrefix) != compact {
+			t.Fatalf("Encoded %q with compact %v", text, compact)
+		}
+		decoded, err := common.DecodeHubMessage(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Serial != msg.Serial || decoded.From != msg.From || *decoded.PublicEndpoint != *msg.PublicEndpoint {
+			t.Fatalf("Got %+v, want %+v", decoded, msg)
+		}
+		if _, err = common.DecodeHubMessage(text[:len(text)-2]); err == nil {
+			t.Fatalf("Decoded truncated %q", text)
+		}
+	}
+}
+
+// A ticket holder needs nothing but the ticket and a key of its own
+func TestTicketCarriesHub(t *testing.T) {
+	server, err := common.ParseCmdLine([]string{
+		"--api-token", "server-token", "--chat", "-100", "--topic", "5", "--name", "server",
+		"--key-file", "server.key", "--ticket-key", "ticket.key", "--ticket-api-token", "guest-token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := e2e.GenerateIdentity("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "ticket.key")
+	if err = ticket.GenerateKey(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := ticket.LoadIssuer(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = issuer.SetHub(common.MakeTicketHub(server, identity.Public())); err != nil {
+		t.Fatal(err)
+	}
+	text, _, err := issuer.Mint("server", []string{"ssh"}, "", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := common.ParseCmdLine([]string{"--ticket", text, "--key-file", "client.key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Signaling != common.SignalingTelegram || client.ApiToken != "guest-token" || client.ChatId != -100 || client.TopicId != 5 {
+		t.Fatalf("Got %s signaling with token %q in chat %d topic %d", client.Signaling, client.ApiToken, client.ChatId, client.TopicId)
+	}
+	if client.Target != "server" || client.Service != "ssh" || client.ServerKey == nil || client.ServerKey.Id() != identity.Public().Id() {
+		t.Fatalf("Got target %q, service %q and server key %v", client.Target, client.Service, client.ServerKey)
+	}
+
+	// Options on the command line win
+	client, err = common.ParseCmdLine([]string{"--chat", "-200", "--ticket", text, "--key-file", "client.key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.ChatId != -200 || client.ApiToken != "guest-token" {
+		t.Fatalf("Got chat %d and token %q", client.ChatId, client.ApiToken)
+	}
+
+	if _, err = common.ParseCmdLine([]string{"--ticket", text}); err == nil {
+		t.Fatal("Accepted a ticket without a key to present")
+	}
+}
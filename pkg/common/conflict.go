@@ -0,0 +1,72 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	minConflictBackoff = 1 * time.Second
+	maxConflictBackoff = 60 * time.Second
+)
+
+// Telegram answers getUpdates with 409 Conflict when another process polls
+// the same bot token or a webhook is set for it
+func IsConflict(err error) bool {
+	var apiErr *tgapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict
+}
+
+// Spaces out getUpdates retries while another instance holds the bot token.
+// The zero value is ready to use.
+type ConflictBackoff struct {
+	delay     time.Duration
+	conflicts int
+}
+
+// Grows the backoff exponentially and returns it with jitter, so that
+// competing instances do not keep terminating each other
+func (backoff *ConflictBackoff) Next() time.Duration {
+	if backoff.delay == 0 {
+		backoff.delay = minConflictBackoff
+	} else if backoff.delay < maxConflictBackoff {
+		backoff.delay *= 2
+		if backoff.delay > maxConflictBackoff {
+			backoff.delay = maxConflictBackoff
+		}
+	}
+	backoff.conflicts++
+	return backoff.delay/2 + time.Duration(rand.Int63n(int64(backoff.delay/2)+1))
+}
+
+// Reports the conflict and sleeps for the next backoff period. Returns
+// false if stop is closed first.
+func (backoff *ConflictBackoff) Wait(err error, stop <-chan struct{}) bool {
+	delay := backoff.Next()
+	fmt.Printf(
+		"Another instance is receiving updates for this bot (conflict #%d: %v), retrying in %v\n",
+		backoff.conflicts, err, delay.Round(time.Millisecond),
+	)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Called after a successful getUpdates
+func (backoff *ConflictBackoff) Reset() {
+	if backoff.conflicts > 0 {
+		fmt.Printf("Receiving updates again after %d conflicts\n", backoff.conflicts)
+	}
+	backoff.delay = 0
+	backoff.conflicts = 0
+}
@@ -0,0 +1,36 @@
+package common_test
+
+import (
+	"errors"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"testing"
+	"time"
+)
+
+func TestConflictBackoffGrowsWithJitter(t *testing.T) {
+	var backoff common.ConflictBackoff
+	for round := 0; round < 2; round++ {
+		for _, want := range []time.Duration{1, 2, 4, 8, 16, 32, 60, 60} {
+			want *= time.Second
+			delay := backoff.Next()
+			if delay < want/2 || delay > want {
+				t.Fatalf("Round %d: waiting %v, want %v to %v", round, delay, want/2, want)
+			}
+		}
+		backoff.Reset()
+	}
+}
+
+func TestConflictBackoffStops(t *testing.T) {
+	var backoff common.ConflictBackoff
+	stop := make(chan struct{})
+	close(stop)
+
+	started := time.Now()
+	if backoff.Wait(errors.New("conflict"), stop) {
+		t.Fatal("Waited out the backoff after stop was closed")
+	}
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Fatalf("Stopped after %v", elapsed)
+	}
+}
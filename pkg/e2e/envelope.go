@@ -0,0 +1,276 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	envelopeVersion = 1
+	nonceSize       = 16
+	contentKeySize  = 32
+)
+
+// The content key encrypted for one recipient
+type RecipientKey struct {
+	KeyId      string `json:"kid"`
+	WrappedKey []byte `json:"key"`
+}
+
+// A sealed message. The payload is encrypted with a random content key,
+// which is wrapped for every recipient using an ephemeral X25519 key. The
+// sender signs everything, so the envelope cannot be altered or forged.
+type Envelope struct {
+	Version    int            `json:"v"`
+	Sender     []byte         `json:"from"`
+	Ephemeral  []byte         `json:"eph"`
+	Recipients []RecipientKey `json:"to"`
+	// Unix time in milliseconds and a random nonce, for replay protection
+	Timestamp  int64  `json:"ts"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ct"`
+	Signature  []byte `json:"sig"`
+}
+
+// Appends a field with its length so that the signed bytes are unambiguous
+func appendField(buffer []byte, field []byte) []byte {
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(field)))
+	return append(buffer, field...)
+}
+
+func (envelope *Envelope) signedBytes() []byte {
+	buffer := []byte("tgpunch-e2e")
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(envelope.Version))
+	buffer = appendField(buffer, envelope.Sender)
+	buffer = appendField(buffer, envelope.Ephemeral)
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(envelope.Recipients)))
+	for _, recipient := range envelope.Recipients {
+		buffer = appendField(buffer, []byte(recipient.KeyId))
+		buffer = appendField(buffer, recipient.WrappedKey)
+	}
+	buffer = binary.BigEndian.AppendUint64(buffer, uint64(envelope.Timestamp))
+	buffer = appendField(buffer, envelope.Nonce)
+	return appendField(buffer, envelope.Ciphertext)
+}
+
+// Derives the key wrapping the content key for one recipient from the
+// X25519 shared secret and both public keys
+func wrappingKey(shared []byte, ephemeral []byte, recipient []byte) (cipher.AEAD, error) {
+	info := append(append([]byte(nil), ephemeral...), recipient...)
+	key, err := hkdf.Key(sha256.New, shared, []byte("tgpunch-e2e-v1"), string(info), contentKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newGcm(key)
+}
+
+func wrapKey(ephemeral *ecdh.PrivateKey, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	return wrappingKey(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Zero nonces are fine because every key encrypts exactly one message
+func zeroNonce(aead cipher.AEAD) []byte {
+	return make([]byte, aead.NonceSize())
+}
+
+func Seal(identity *Identity, recipients []*PublicKey, plaintext []byte) (*Envelope, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	contentKey := make([]byte, contentKeySize)
+	nonce := make([]byte, nonceSize)
+	if _, err = rand.Read(contentKey); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	envelope := &Envelope{
+		Version:   envelopeVersion,
+		Sender:    identity.Public().SignKey,
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Timestamp: time.Now().UnixMilli(),
+		Nonce:     nonce,
+	}
+
+	for _, recipient := range recipients {
+		boxKey, err := ecdh.X25519().NewPublicKey(recipient.BoxKey)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := wrapKey(ephemeral, boxKey)
+		if err != nil {
+			return nil, err
+		}
+		envelope.Recipients = append(envelope.Recipients, RecipientKey{
+			KeyId:      recipient.Id(),
+			WrappedKey: aead.Seal(nil, zeroNonce(aead), contentKey, nil),
+		})
+	}
+
+	aead, err := newGcm(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	// The nonce and timestamp are bound to the ciphertext as associated data
+	header := binary.BigEndian.AppendUint64(append([]byte(nil), nonce...), uint64(envelope.Timestamp))
+	envelope.Ciphertext = aead.Seal(nil, zeroNonce(aead), plaintext, header)
+	envelope.Signature = ed25519.Sign(identity.signKey, envelope.signedBytes())
+	return envelope, nil
+}
+
+// Open fails with this for envelopes signed by none of the peers
+var ErrUnknownKey = errors.New("Envelope is signed by an unknown key")
+
+// Verifies the signature against the known peers and decrypts the payload.
+// Returns the sender's public key along with the plaintext.
+func Open(identity *Identity, peers []*PublicKey, envelope *Envelope) ([]byte, *PublicKey, error) {
+	if envelope.Version != envelopeVersion {
+		return nil, nil, errors.New(fmt.Sprintf("Unsupported envelope version %d", envelope.Version))
+	}
+
+	var sender *PublicKey
+	for _, peer := range peers {
+		if bytes.Equal(peer.SignKey, envelope.Sender) {
+			sender = peer
+			break
+		}
+	}
+	if sender == nil {
+		return nil, nil, ErrUnknownKey
+	}
+	plaintext, err := open(identity, sender, envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, sender, nil
+}
+
+// Like Open for an envelope signed by a key we do not know. The signature
+// only proves that whoever holds the key sealed it. The returned key has
+// neither a name nor a box key.
+func OpenFromStranger(identity *Identity, envelope *Envelope) ([]byte, *PublicKey, error) {
+	if envelope.Version != envelopeVersion {
+		return nil, nil, errors.New(fmt.Sprintf("Unsupported envelope version %d", envelope.Version))
+	}
+	if len(envelope.Sender) != ed25519.PublicKeySize {
+		return nil, nil, errors.New("Bad sender key size")
+	}
+	sender := &PublicKey{SignKey: envelope.Sender}
+	plaintext, err := open(identity, sender, envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, sender, nil
+}
+
+func open(identity *Identity, sender *PublicKey, envelope *Envelope) ([]byte, error) {
+	if !ed25519.Verify(sender.SignKey, envelope.signedBytes(), envelope.Signature) {
+		return nil, errors.New("Bad envelope signature")
+	}
+
+	myId := identity.Public().Id()
+	var wrapped []byte
+	for _, recipient := range envelope.Recipients {
+		if recipient.KeyId == myId {
+			wrapped = recipient.WrappedKey
+			break
+		}
+	}
+	if wrapped == nil {
+		return nil, errors.New("Envelope is not addressed to us")
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(envelope.Ephemeral)
+	if err != nil {
+		return nil, errors.New("Bad ephemeral key: " + err.Error())
+	}
+	shared, err := identity.boxKey.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	unwrap, err := wrappingKey(shared, envelope.Ephemeral, identity.boxKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := unwrap.Open(nil, zeroNonce(unwrap), wrapped, nil)
+	if err != nil {
+		return nil, errors.New("Cannot unwrap content key")
+	}
+
+	aead, err := newGcm(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	header := binary.BigEndian.AppendUint64(append([]byte(nil), envelope.Nonce...), uint64(envelope.Timestamp))
+	plaintext, err := aead.Open(nil, zeroNonce(aead), envelope.Ciphertext, header)
+	if err != nil {
+		return nil, errors.New("Cannot decrypt envelope")
+	}
+	return plaintext, nil
+}
+
+// Rejects envelopes that are too old, from too far in the future or seen
+// before. Nonces are remembered for as long as their envelopes would be
+// accepted.
+type ReplayGuard struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func MakeReplayGuard(window time.Duration) *ReplayGuard {
+	return &ReplayGuard{window: window, seen: make(map[string]time.Time)}
+}
+
+func (guard *ReplayGuard) Check(envelope *Envelope) error {
+	now := time.Now()
+	sent := time.UnixMilli(envelope.Timestamp)
+	if now.Sub(sent) > guard.window || sent.Sub(now) > guard.window {
+		return errors.New(fmt.Sprintf("Envelope timestamp %v is out of the accepted window", sent))
+	}
+	if len(envelope.Nonce) != nonceSize {
+		return errors.New("Bad envelope nonce")
+	}
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	for nonce, expires := range guard.seen {
+		if now.After(expires) {
+			delete(guard.seen, nonce)
+		}
+	}
+	key := string(envelope.Nonce)
+	if _, ok := guard.seen[key]; ok {
+		return errors.New("Envelope is a replay")
+	}
+	guard.seen[key] = sent.Add(2 * guard.window)
+	return nil
+}
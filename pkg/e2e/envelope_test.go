@@ -0,0 +1,109 @@
+package e2e
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func generate(t *testing.T, name string) *Identity {
+	t.Helper()
+	identity, err := GenerateIdentity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestSealOpen(t *testing.T) {
+	client := generate(t, "client")
+	server := generate(t, "server")
+	backup := generate(t, "backup")
+	plaintext := []byte(`{"type":"start_punching_request"}`)
+
+	envelope, err := Seal(client, []*PublicKey{server.Public(), backup.Public()}, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, recipient := range []*Identity{server, backup} {
+		opened, sender, err := Open(recipient, []*PublicKey{client.Public()}, envelope)
+		if err != nil {
+			t.Fatalf("%s cannot open: %v", recipient.Name, err)
+		}
+		if !bytes.Equal(opened, plaintext) || sender.Name != "client" {
+			t.Fatalf("%s opened %q from %s", recipient.Name, opened, sender.Name)
+		}
+	}
+
+	if _, _, err = Open(client, []*PublicKey{client.Public()}, envelope); err == nil {
+		t.Error("Opened an envelope not addressed to us")
+	}
+	if _, _, err = Open(server, []*PublicKey{backup.Public()}, envelope); err == nil {
+		t.Error("Opened an envelope from an unknown sender")
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	client := generate(t, "client")
+	server := generate(t, "server")
+	evil := generate(t, "evil")
+
+	tests := []struct {
+		name   string
+		tamper func(envelope *Envelope)
+	}{
+		{"ciphertext", func(envelope *Envelope) { envelope.Ciphertext[0] ^= 1 }},
+		{"nonce", func(envelope *Envelope) { envelope.Nonce[0] ^= 1 }},
+		{"timestamp", func(envelope *Envelope) { envelope.Timestamp++ }},
+		{"wrapped key", func(envelope *Envelope) { envelope.Recipients[0].WrappedKey[0] ^= 1 }},
+		{"ephemeral key", func(envelope *Envelope) { envelope.Ephemeral[0] ^= 1 }},
+		{"signature", func(envelope *Envelope) { envelope.Signature[0] ^= 1 }},
+		{"version", func(envelope *Envelope) { envelope.Version++ }},
+		{"sender", func(envelope *Envelope) { envelope.Sender = evil.Public().SignKey }},
+		{"dropped recipient", func(envelope *Envelope) { envelope.Recipients = envelope.Recipients[1:] }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope, err := Seal(client, []*PublicKey{server.Public()}, []byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.tamper(envelope)
+			if _, _, err = Open(server, []*PublicKey{client.Public(), evil.Public()}, envelope); err == nil {
+				t.Fatal("Opened a tampered envelope")
+			}
+		})
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	client := generate(t, "client")
+	server := generate(t, "server")
+	guard := MakeReplayGuard(time.Minute)
+
+	envelope, err := Seal(client, []*PublicKey{server.Public()}, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = guard.Check(envelope); err != nil {
+		t.Fatal(err)
+	}
+	if err = guard.Check(envelope); err == nil {
+		t.Error("Accepted a replayed envelope")
+	}
+
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		nonce     []byte
+	}{
+		{"too old", time.Now().Add(-2 * time.Minute), bytes.Repeat([]byte{1}, nonceSize)},
+		{"from the future", time.Now().Add(2 * time.Minute), bytes.Repeat([]byte{2}, nonceSize)},
+		{"short nonce", time.Now(), []byte{3}},
+	}
+	for _, test := range tests {
+		if err = guard.Check(&Envelope{Timestamp: test.timestamp.UnixMilli(), Nonce: test.nonce}); err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
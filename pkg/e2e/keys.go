@@ -0,0 +1,155 @@
+// Package e2e seals hub messages so that only the intended peers can read
+// them and nobody else can forge them, whatever the rendezvous channel.
+package e2e
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// The public half of an identity, what peers put into each other's peer
+// files
+type PublicKey struct {
+	Name    string `json:"name,omitempty"`
+	SignKey []byte `json:"sign_key"`
+	BoxKey  []byte `json:"box_key"`
+}
+
+// An Ed25519 key signs the envelopes and an X25519 key receives the
+// content keys
+type Identity struct {
+	Name    string
+	signKey ed25519.PrivateKey
+	boxKey  *ecdh.PrivateKey
+}
+
+type identityFile struct {
+	Name    string `json:"name,omitempty"`
+	SignKey []byte `json:"sign_key"`
+	BoxKey  []byte `json:"box_key"`
+}
+
+type peersFile struct {
+	Peers []PublicKey `json:"peers"`
+}
+
+// Short identifier of a signing key, used to address recipients
+func (key *PublicKey) Id() string {
+	sum := sha256.Sum256(key.SignKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Tells whether both keys are well-formed
+func (key *PublicKey) Check() error {
+	if len(key.SignKey) != ed25519.PublicKeySize {
+		return errors.New("Bad signing key size in the key of " + key.Name)
+	}
+	if _, err := ecdh.X25519().NewPublicKey(key.BoxKey); err != nil {
+		return errors.New("Bad box key of " + key.Name + ": " + err.Error())
+	}
+	return nil
+}
+
+func GenerateIdentity(name string) (*Identity, error) {
+	_, signKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	boxKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Name: name, signKey: signKey, boxKey: boxKey}, nil
+}
+
+func (identity *Identity) Public() *PublicKey {
+	return &PublicKey{
+		Name:    identity.Name,
+		SignKey: identity.signKey.Public().(ed25519.PublicKey),
+		BoxKey:  identity.boxKey.PublicKey().Bytes(),
+	}
+}
+
+// Writes the private keys to a new file only the owner can read. Fails if
+// the file exists, so that keys are never overwritten.
+func (identity *Identity) Save(path string) error {
+	contents, err := json.MarshalIndent(&identityFile{
+		Name:    identity.Name,
+		SignKey: identity.signKey.Seed(),
+		BoxKey:  identity.boxKey.Bytes(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(contents, '\n')); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	if err = file.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func LoadIdentity(path string) (*Identity, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file identityFile
+	if err = json.Unmarshal(contents, &file); err != nil {
+		return nil, errors.New("Cannot parse key file: " + err.Error())
+	}
+	if len(file.SignKey) != ed25519.SeedSize {
+		return nil, errors.New("Bad signing key size in key file")
+	}
+	boxKey, err := ecdh.X25519().NewPrivateKey(file.BoxKey)
+	if err != nil {
+		return nil, errors.New("Bad box key in key file: " + err.Error())
+	}
+	return &Identity{
+		Name:    file.Name,
+		signKey: ed25519.NewKeyFromSeed(file.SignKey),
+		boxKey:  boxKey,
+	}, nil
+}
+
+// Reads the public keys of the peers we talk to. Messages signed by
+// anyone else are rejected.
+func LoadPeers(path string) ([]*PublicKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file peersFile
+	if err = json.Unmarshal(contents, &file); err != nil {
+		return nil, errors.New("Cannot parse peer keys file: " + err.Error())
+	}
+	if len(file.Peers) == 0 {
+		return nil, errors.New("No peer keys in " + path)
+	}
+
+	peers := make([]*PublicKey, len(file.Peers))
+	for i := range file.Peers {
+		if err = file.Peers[i].Check(); err != nil {
+			return nil, err
+		}
+		peers[i] = &file.Peers[i]
+	}
+	return peers, nil
+}
@@ -0,0 +1,61 @@
+package e2e
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveLoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.json")
+	identity := generate(t, "server")
+	if err := identity.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Name != "server" || !bytes.Equal(loaded.Public().SignKey, identity.Public().SignKey) || !bytes.Equal(loaded.Public().BoxKey, identity.Public().BoxKey) {
+		t.Fatal("Loaded identity differs from the saved one")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Key file mode is %v", info.Mode().Perm())
+	}
+
+	if err = generate(t, "other").Save(path); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("Saving over an existing key file: %v", err)
+	}
+	if loaded, err = LoadIdentity(path); err != nil || loaded.Name != "server" {
+		t.Fatal("Existing key file was overwritten")
+	}
+}
+
+func TestLoadPeersChecksKeys(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"no peers", `{"peers": []}`},
+		{"short signing key", `{"peers": [{"name": "a", "sign_key": "AAAA", "box_key": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}]}`},
+		{"not json", `peers`},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPeers(path); err == nil {
+			t.Errorf("%s: loaded", test.name)
+		}
+	}
+}
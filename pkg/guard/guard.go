@@ -0,0 +1,255 @@
+// Package guard keeps the server from being turned against third parties.
+// Whoever can post to the hub chooses where the server sends its punching
+// packets, so the destination is checked up front and every packet sent
+// afterwards is rate limited.
+package guard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long we remember that an endpoint never answered
+const unansweredWindow = 10 * time.Minute
+
+// Reserved, documentation and otherwise unroutable networks, and networks
+// that carry IPv4 addresses we cannot check, that net.IP has no method for
+var bogons = parseNetworks(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	// 6to4 relays send to whatever IPv4 address is embedded
+	"2002::/16",
+	// So do Teredo relays and NAT64 gateways
+	"2001::/32",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells why the server must not send packets to the endpoint, if it must
+// not. Networks in allowed are exempt from the address checks.
+func CheckEndpoint(endpoint *common.Endpoint, allowed []*net.IPNet) error {
+	if endpoint == nil {
+		return errors.New("Request has no public endpoint")
+	}
+	if endpoint.Port <= 0 || endpoint.Port > 65535 {
+		return errors.New(fmt.Sprintf("Invalid port %d", endpoint.Port))
+	}
+	ip := net.ParseIP(endpoint.Address)
+	if ip == nil {
+		return errors.New("Invalid address " + endpoint.Address)
+	}
+	// IPv4-mapped IPv6 addresses reach the IPv4 host, so check that
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if contains(allowed, ip) {
+		return nil
+	}
+
+	switch {
+	case ip.IsUnspecified() || ip.IsLoopback():
+		return errors.New(fmt.Sprintf("Endpoint %v is a local address", ip))
+	case ip.IsMulticast() || ip.Equal(net.IPv4bcast):
+		return errors.New(fmt.Sprintf("Endpoint %v is a multicast or broadcast address", ip))
+	case ip.IsPrivate() || ip.IsLinkLocalUnicast():
+		return errors.New(fmt.Sprintf("Endpoint %v is a private address", ip))
+	case contains(bogons, ip):
+		return errors.New(fmt.Sprintf("Endpoint %v is a reserved address", ip))
+	}
+	return nil
+}
+
+// A token bucket refilling rate tokens a second, holding at most a second
+// worth of them
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(now time.Time, rate int) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > float64(rate) {
+			b.tokens = float64(rate)
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type destination struct {
+	bucket
+	lastSent time.Time
+}
+
+type unanswered struct {
+	packets  int
+	lastSent time.Time
+}
+
+// Limits the packets sent to punching destinations, shared by all sessions
+type Guard struct {
+	globalRate      int
+	destinationRate int
+	maxUnanswered   int
+
+	mu     sync.Mutex
+	global bucket
+	// Both by IP address, whatever the port
+	destinations map[string]*destination
+	unanswered   map[string]*unanswered
+	lastPrune    time.Time
+}
+
+func MakeGuard(config *common.Config) *Guard {
+	return &Guard{
+		globalRate:      config.GlobalPacketRate,
+		destinationRate: config.DestinationPacketRate,
+		maxUnanswered:   config.MaxUnansweredPackets,
+		destinations:    make(map[string]*destination),
+		unanswered:      make(map[string]*unanswered),
+	}
+}
+
+// Forgets destinations we have not sent anything to for a while
+func (guard *Guard) prune(now time.Time) {
+	if now.Sub(guard.lastPrune) < time.Minute {
+		return
+	}
+	guard.lastPrune = now
+	for key, dest := range guard.destinations {
+		if now.Sub(dest.lastSent) > time.Second {
+			delete(guard.destinations, key)
+		}
+	}
+	for key, record := range guard.unanswered {
+		if now.Sub(record.lastSent) > unansweredWindow {
+			delete(guard.unanswered, key)
+		}
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// Takes a packet out of every budget sending to addr draws from
+func (guard *Guard) allow(addr net.Addr) error {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	now := time.Now()
+	guard.prune(now)
+
+	host := hostOf(addr)
+	record := guard.unanswered[host]
+	if record == nil {
+		record = &unanswered{}
+		guard.unanswered[host] = record
+	}
+	if now.Sub(record.lastSent) > unansweredWindow {
+		record.packets = 0
+	}
+	if record.packets >= guard.maxUnanswered {
+		return errors.New(fmt.Sprintf("%s has not answered %d packets", host, record.packets))
+	}
+
+	dest := guard.destinations[host]
+	if dest == nil {
+		dest = &destination{}
+		guard.destinations[host] = dest
+	}
+	if !dest.take(now, guard.destinationRate) {
+		return errors.New("Rate limit exceeded for " + host)
+	}
+	if !guard.global.take(now, guard.globalRate) {
+		return errors.New("Global rate limit exceeded")
+	}
+
+	dest.lastSent = now
+	record.packets++
+	record.lastSent = now
+	return nil
+}
+
+// The peer magic coming back means the endpoint is willing to talk to us
+func (guard *Guard) answered(addr net.Addr) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	delete(guard.unanswered, hostOf(addr))
+}
+
+// Makes conn draw every packet it sends from the guard's budgets. Only
+// packets carrying peerMagic count as answers, anyone could send others
+// from a forged address.
+func (guard *Guard) Wrap(conn net.PacketConn, peerMagic []byte) net.PacketConn {
+	return &guardedConn{PacketConn: conn, guard: guard, peerMagic: peerMagic}
+}
+
+type guardedConn struct {
+	net.PacketConn
+	guard     *Guard
+	peerMagic []byte
+}
+
+func (conn *guardedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if err := conn.guard.allow(addr); err != nil {
+		return 0, err
+	}
+	return conn.PacketConn.WriteTo(b, addr)
+}
+
+func (conn *guardedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := conn.PacketConn.ReadFrom(b)
+	if err == nil && bytes.Equal(b[:n], conn.peerMagic) {
+		conn.guard.answered(addr)
+	}
+	return n, addr, err
+}
@@ -0,0 +1,199 @@
+package guard
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/natemu"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckEndpoint(t *testing.T) {
+	_, lab, err := net.ParseCIDR("192.168.7.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := []*net.IPNet{lab}
+
+	tests := []struct {
+		address string
+		port    int
+		ok      bool
+	}{
+		{"8.8.8.8", 4000, true},
+		{"2a00:1450::1", 4000, true},
+		{"::ffff:8.8.8.8", 4000, true},
+		{"192.168.7.1", 4000, true},
+		{"::ffff:192.168.7.1", 4000, true},
+
+		{"8.8.8.8", 0, false},
+		{"8.8.8.8", 65536, false},
+		{"example.com", 4000, false},
+		{"0.0.0.0", 4000, false},
+		{"::", 4000, false},
+		{"127.0.0.1", 4000, false},
+		{"::1", 4000, false},
+		{"224.0.0.1", 4000, false},
+		{"ff02::1", 4000, false},
+		{"255.255.255.255", 4000, false},
+		{"10.1.2.3", 4000, false},
+		{"192.168.8.1", 4000, false},
+		{"169.254.1.1", 4000, false},
+		{"fe80::1", 4000, false},
+		{"100.64.0.1", 4000, false},
+		{"192.0.2.1", 4000, false},
+		{"240.0.0.1", 4000, false},
+		{"2001:db8::1", 4000, false},
+		{"fc00::1", 4000, false},
+		{"fd12:3456::1", 4000, false},
+		{"2002:a00:1::1", 4000, false},
+		{"2001:0:4136:e378::1", 4000, false},
+		{"64:ff9b::a00:1", 4000, false},
+		{"64:ff9b:1::a00:1", 4000, false},
+		// IPv4-mapped addresses are checked as the IPv4 ones
+		{"::ffff:127.0.0.1", 4000, false},
+		{"::ffff:10.1.2.3", 4000, false},
+		{"::ffff:192.0.2.1", 4000, false},
+	}
+	for _, test := range tests {
+		err := CheckEndpoint(&common.Endpoint{Address: test.address, Port: test.port}, allowed)
+		if test.ok && err != nil {
+			t.Errorf("%s:%d refused: %v", test.address, test.port, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s:%d accepted", test.address, test.port)
+		}
+	}
+	if err := CheckEndpoint(nil, allowed); err == nil {
+		t.Error("Accepted a request without an endpoint")
+	}
+}
+
+func TestBucket(t *testing.T) {
+	var b bucket
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if !b.take(start, 4) {
+			t.Fatalf("Packet %d refused from a full bucket", i+1)
+		}
+	}
+	if b.take(start, 4) {
+		t.Fatal("Took more than the bucket holds")
+	}
+	if !b.take(start.Add(250*time.Millisecond), 4) {
+		t.Fatal("Bucket did not refill")
+	}
+	if b.take(start.Add(250*time.Millisecond), 4) {
+		t.Fatal("Bucket refilled too much")
+	}
+	// Never more than a second worth
+	later := start.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		if !b.take(later, 4) {
+			t.Fatalf("Packet %d refused after a pause", i+1)
+		}
+	}
+	if b.take(later, 4) {
+		t.Fatal("Bucket saved up more than a second worth")
+	}
+}
+
+func makeTestGuard(globalRate int, destinationRate int, maxUnanswered int) *Guard {
+	return MakeGuard(&common.Config{
+		GlobalPacketRate:      globalRate,
+		DestinationPacketRate: destinationRate,
+		MaxUnansweredPackets:  maxUnanswered,
+	})
+}
+
+func TestDestinationRate(t *testing.T) {
+	guard := makeTestGuard(100, 2, 100)
+	target := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 4000}
+	otherPort := &net.UDPAddr{IP: target.IP, Port: 4001}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 4000}
+
+	if err := guard.allow(target); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.allow(otherPort); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.allow(target); err == nil {
+		t.Fatal("Exceeded the destination rate by switching ports")
+	}
+	if err := guard.allow(other); err != nil {
+		t.Fatalf("Another destination is limited too: %v", err)
+	}
+}
+
+func TestGlobalRate(t *testing.T) {
+	guard := makeTestGuard(3, 100, 100)
+	for i := 0; i < 3; i++ {
+		if err := guard.allow(&net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i+1)), Port: 4000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := guard.allow(&net.UDPAddr{IP: net.ParseIP("198.51.100.9"), Port: 4000}); err == nil {
+		t.Fatal("Exceeded the global rate")
+	}
+}
+
+func TestUnansweredByAddress(t *testing.T) {
+	guard := makeTestGuard(1000, 1000, 3)
+	target := net.ParseIP("198.51.100.1")
+
+	// Moving to another port does not start over
+	for port := 4000; port < 4003; port++ {
+		if err := guard.allow(&net.UDPAddr{IP: target, Port: port}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := guard.allow(&net.UDPAddr{IP: target, Port: 4003}); err == nil {
+		t.Fatal("Kept sending to an address that never answers")
+	}
+
+	// An answer from any port shows the host is willing to talk
+	guard.answered(&net.UDPAddr{IP: target, Port: 5000})
+	if err := guard.allow(&net.UDPAddr{IP: target, Port: 4003}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Only the peer magic counts as an answer, other packets may be forged
+func TestAnswerNeedsPeerMagic(t *testing.T) {
+	guard := makeTestGuard(1000, 1000, 1)
+	network := natemu.NewNetwork(1)
+	server, err := network.Listen("198.51.100.1", 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := network.Listen("198.51.100.2", 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := guard.Wrap(server, []byte("client"))
+
+	answer := func(payload string) {
+		t.Helper()
+		if _, err := client.WriteTo([]byte(payload), server.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadFrom(make([]byte, 64)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err = conn.WriteTo([]byte("server"), client.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	answer("spoofed")
+	if _, err = conn.WriteTo([]byte("server"), client.LocalAddr()); err == nil {
+		t.Fatal("A packet without the magic counted as an answer")
+	}
+	answer("client")
+	if _, err = conn.WriteTo([]byte("server"), client.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+}
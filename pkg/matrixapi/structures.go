@@ -0,0 +1,66 @@
+package matrixapi
+
+import "encoding/json"
+
+const ClientApiPrefix = "/_matrix/client/v3"
+
+type Event struct {
+	Type           string          `json:"type"`
+	EventId        string          `json:"event_id"`
+	Sender         string          `json:"sender"`
+	OriginServerTs int64           `json:"origin_server_ts"`
+	Content        json.RawMessage `json:"content"`
+}
+
+type Timeline struct {
+	Events    []Event `json:"events"`
+	Limited   bool    `json:"limited"`
+	PrevBatch string  `json:"prev_batch"`
+}
+
+type JoinedRoom struct {
+	Timeline Timeline `json:"timeline"`
+}
+
+type Rooms struct {
+	Join map[string]JoinedRoom `json:"join"`
+}
+
+type SyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     Rooms  `json:"rooms"`
+}
+
+type SendResponse struct {
+	EventId string `json:"event_id"`
+}
+
+type Error struct {
+	ErrCode string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return e.ErrCode + ": " + e.Message
+}
+
+type RoomEventFilter struct {
+	Rooms []string `json:"rooms,omitempty"`
+	Types []string `json:"types,omitempty"`
+	Limit int      `json:"limit,omitempty"`
+}
+
+type RoomFilter struct {
+	Rooms    []string        `json:"rooms,omitempty"`
+	Timeline RoomEventFilter `json:"timeline"`
+}
+
+type EventFilter struct {
+	Types []string `json:"types"`
+}
+
+type Filter struct {
+	Room        RoomFilter   `json:"room"`
+	Presence    *EventFilter `json:"presence,omitempty"`
+	AccountData *EventFilter `json:"account_data,omitempty"`
+}
@@ -0,0 +1,290 @@
+// Package matrixtest runs an in-process fake of a Matrix homeserver that
+// implements just enough of the client-server API for the Matrix signaler.
+package matrixtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/matrixapi"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTimelineLimit = 10
+
+type storedEvent struct {
+	roomId string
+	event  matrixapi.Event
+}
+
+type Homeserver struct {
+	URL string
+
+	httpServer *httptest.Server
+
+	mu      sync.Mutex
+	users   map[string]string // Access token to user ID
+	members map[string]map[string]bool
+	// All events of all rooms in the order they were sent. A sync token is
+	// the number of events the client has already seen.
+	events  []storedEvent
+	txns    map[string]string
+	updated chan struct{}
+}
+
+func NewHomeserver() *Homeserver {
+	homeserver := &Homeserver{
+		users:   make(map[string]string),
+		members: make(map[string]map[string]bool),
+		txns:    make(map[string]string),
+		updated: make(chan struct{}),
+	}
+	homeserver.httpServer = httptest.NewServer(http.HandlerFunc(homeserver.serveHTTP))
+	homeserver.URL = homeserver.httpServer.URL
+	return homeserver
+}
+
+func (homeserver *Homeserver) Close() {
+	homeserver.httpServer.Close()
+}
+
+func (homeserver *Homeserver) AddUser(userId string, accessToken string) {
+	homeserver.mu.Lock()
+	defer homeserver.mu.Unlock()
+	homeserver.users[accessToken] = userId
+}
+
+func (homeserver *Homeserver) CreateRoom(roomId string, members ...string) {
+	homeserver.mu.Lock()
+	defer homeserver.mu.Unlock()
+	homeserver.members[roomId] = make(map[string]bool)
+	for _, member := range members {
+		homeserver.members[roomId][member] = true
+	}
+}
+
+// Sends an event to the room on behalf of the user
+func (homeserver *Homeserver) SendEvent(roomId string, sender string, eventType string, content json.RawMessage) string {
+	homeserver.mu.Lock()
+	defer homeserver.mu.Unlock()
+	return homeserver.sendLocked(roomId, sender, eventType, content)
+}
+
+// Returns all events sent to the room so far
+func (homeserver *Homeserver) Events(roomId string) []matrixapi.Event {
+	homeserver.mu.Lock()
+	defer homeserver.mu.Unlock()
+
+	var events []matrixapi.Event
+	for _, stored := range homeserver.events {
+		if stored.roomId == roomId {
+			events = append(events, stored.event)
+		}
+	}
+	return events
+}
+
+func (homeserver *Homeserver) sendLocked(roomId string, sender string, eventType string, content json.RawMessage) string {
+	eventId := fmt.Sprintf("$event%d", len(homeserver.events)+1)
+	homeserver.events = append(homeserver.events, storedEvent{
+		roomId: roomId,
+		event: matrixapi.Event{
+			Type:           eventType,
+			EventId:        eventId,
+			Sender:         sender,
+			OriginServerTs: time.Now().UnixMilli(),
+			Content:        content,
+		},
+	})
+
+	close(homeserver.updated)
+	homeserver.updated = make(chan struct{})
+	return eventId
+}
+
+func writeJson(w http.ResponseWriter, status int, object interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(object)
+}
+
+func writeError(w http.ResponseWriter, status int, errCode string, message string) {
+	writeJson(w, status, &matrixapi.Error{ErrCode: errCode, Message: message})
+}
+
+func (homeserver *Homeserver) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), matrixapi.ClientApiPrefix)
+	if path == r.URL.EscapedPath() {
+		writeError(w, http.StatusNotFound, "M_UNRECOGNIZED", "Unrecognized request")
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	homeserver.mu.Lock()
+	userId, ok := homeserver.users[token]
+	homeserver.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "Unrecognised access token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := range parts {
+		parts[i], _ = url.PathUnescape(parts[i])
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "sync" && r.Method == http.MethodGet:
+		homeserver.sync(w, r, userId)
+	case len(parts) == 5 && parts[0] == "rooms" && parts[2] == "send" && r.Method == http.MethodPut:
+		homeserver.send(w, r, userId, token, parts[1], parts[3], parts[4])
+	default:
+		writeError(w, http.StatusNotFound, "M_UNRECOGNIZED", "Unrecognized request")
+	}
+}
+
+func (homeserver *Homeserver) send(w http.ResponseWriter, r *http.Request, userId string, token string, roomId string, eventType string, txnId string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil || !json.Valid(body) {
+		writeError(w, http.StatusBadRequest, "M_NOT_JSON", "Content not JSON")
+		return
+	}
+
+	homeserver.mu.Lock()
+	defer homeserver.mu.Unlock()
+
+	if !homeserver.members[roomId][userId] {
+		writeError(w, http.StatusForbidden, "M_FORBIDDEN", userId+" is not in room "+roomId)
+		return
+	}
+
+	// Retried transactions must not produce duplicate events
+	txnKey := token + "/" + txnId
+	eventId, ok := homeserver.txns[txnKey]
+	if !ok {
+		eventId = homeserver.sendLocked(roomId, userId, eventType, body)
+		homeserver.txns[txnKey] = eventId
+	}
+	writeJson(w, http.StatusOK, &matrixapi.SendResponse{EventId: eventId})
+}
+
+func (homeserver *Homeserver) sync(w http.ResponseWriter, r *http.Request, userId string) {
+	query := r.URL.Query()
+
+	var filter matrixapi.Filter
+	if value := query.Get("filter"); value != "" {
+		if err := json.Unmarshal([]byte(value), &filter); err != nil {
+			writeError(w, http.StatusBadRequest, "M_INVALID_PARAM", "Only inline filters are supported")
+			return
+		}
+	}
+
+	since := -1
+	if value := query.Get("since"); value != "" {
+		var err error
+		if since, err = strconv.Atoi(strings.TrimPrefix(value, "s")); err != nil {
+			writeError(w, http.StatusBadRequest, "M_INVALID_PARAM", "Invalid since token")
+			return
+		}
+	}
+
+	timeout := time.Duration(0)
+	if value := query.Get("timeout"); value != "" {
+		milliseconds, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "M_INVALID_PARAM", "Invalid timeout")
+			return
+		}
+		timeout = time.Duration(milliseconds) * time.Millisecond
+	}
+	deadline := time.After(timeout)
+
+	homeserver.mu.Lock()
+	defer homeserver.mu.Unlock()
+
+	for {
+		response := homeserver.collectLocked(userId, &filter, since)
+		if len(response.Rooms.Join) > 0 || since < 0 {
+			writeJson(w, http.StatusOK, response)
+			return
+		}
+
+		updated := homeserver.updated
+		homeserver.mu.Unlock()
+		select {
+		case <-updated:
+			homeserver.mu.Lock()
+		case <-deadline:
+			homeserver.mu.Lock()
+			writeJson(w, http.StatusOK, response)
+			return
+		case <-r.Context().Done():
+			homeserver.mu.Lock()
+			return
+		}
+	}
+}
+
+// Gathers events the user has not seen since the given position. An initial
+// sync (negative since) gets the latest events of every room instead.
+func (homeserver *Homeserver) collectLocked(userId string, filter *matrixapi.Filter, since int) *matrixapi.SyncResponse {
+	response := &matrixapi.SyncResponse{
+		NextBatch: fmt.Sprintf("s%d", len(homeserver.events)),
+		Rooms:     matrixapi.Rooms{Join: make(map[string]matrixapi.JoinedRoom)},
+	}
+
+	first := since
+	if first < 0 {
+		first = 0
+	}
+	for _, stored := range homeserver.events[first:] {
+		if !homeserver.members[stored.roomId][userId] || !matches(filter, &stored) {
+			continue
+		}
+		room := response.Rooms.Join[stored.roomId]
+		room.Timeline.Events = append(room.Timeline.Events, stored.event)
+		response.Rooms.Join[stored.roomId] = room
+	}
+
+	limit := filter.Room.Timeline.Limit
+	if limit <= 0 {
+		limit = defaultTimelineLimit
+	}
+	for roomId, room := range response.Rooms.Join {
+		if len(room.Timeline.Events) > limit {
+			room.Timeline.Events = room.Timeline.Events[len(room.Timeline.Events)-limit:]
+			room.Timeline.Limited = true
+			response.Rooms.Join[roomId] = room
+		}
+	}
+	return response
+}
+
+func matches(filter *matrixapi.Filter, stored *storedEvent) bool {
+	if len(filter.Room.Rooms) > 0 && !contains(filter.Room.Rooms, stored.roomId) {
+		return false
+	}
+	timeline := &filter.Room.Timeline
+	if len(timeline.Rooms) > 0 && !contains(timeline.Rooms, stored.roomId) {
+		return false
+	}
+	if len(timeline.Types) > 0 && !contains(timeline.Types, stored.event.Type) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
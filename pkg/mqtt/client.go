@@ -0,0 +1,285 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeepAlive = 60 * time.Second
+	ackTimeout       = 10 * time.Second
+	maxPublishTries  = 3
+)
+
+type Options struct {
+	ClientId     string
+	Username     string
+	Password     string
+	KeepAlive    time.Duration
+	CleanSession bool
+	// Larger incoming packets break the connection. DefaultMaxPacketSize
+	// if zero.
+	MaxPacketSize int
+
+	// Called from the read loop for every incoming PUBLISH, must not block.
+	// A QoS 1 message is acknowledged only if it returns true, so the
+	// broker delivers a rejected one again when a persistent session
+	// reconnects.
+	OnMessage func(topic string, payload []byte) bool
+}
+
+type Client struct {
+	conn    net.Conn
+	options Options
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	nextId   uint16
+	pending  map[uint16]chan *Packet
+	err      error
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Performs the MQTT handshake over an established connection
+func Connect(conn net.Conn, options *Options) (*Client, error) {
+	client := &Client{
+		conn:    conn,
+		options: *options,
+		pending: make(map[uint16]chan *Packet),
+		done:    make(chan struct{}),
+	}
+	if client.options.KeepAlive == 0 {
+		client.options.KeepAlive = defaultKeepAlive
+	}
+	if client.options.MaxPacketSize == 0 {
+		client.options.MaxPacketSize = DefaultMaxPacketSize
+	}
+
+	connect := ConnectPacket{
+		ClientId:     options.ClientId,
+		Username:     options.Username,
+		Password:     options.Password,
+		KeepAlive:    uint16(client.options.KeepAlive / time.Second),
+		CleanSession: options.CleanSession,
+	}
+	if err := client.write(connect.Encode()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(ackTimeout))
+	connack, err := ReadPacket(reader, client.options.MaxPacketSize)
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("Cannot read CONNACK: " + err.Error())
+	}
+	conn.SetReadDeadline(time.Time{})
+	if connack.Type != TypeConnack || len(connack.Body) != 2 {
+		conn.Close()
+		return nil, errors.New("Broker did not answer with CONNACK")
+	}
+	if connack.Body[1] != ConnectAccepted {
+		conn.Close()
+		return nil, errors.New(fmt.Sprintf("Broker refused connection with code %d", connack.Body[1]))
+	}
+
+	go client.readLoop(reader)
+	go client.pingLoop()
+	return client, nil
+}
+
+func (client *Client) write(packet *Packet) error {
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	return WritePacket(client.conn, packet)
+}
+
+// Closed when the connection is lost or closed
+func (client *Client) Done() <-chan struct{} {
+	return client.done
+}
+
+// The reason the connection was lost, nil after Close
+func (client *Client) Err() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.err
+}
+
+func (client *Client) shutdown(err error) {
+	client.doneOnce.Do(func() {
+		client.mu.Lock()
+		client.err = err
+		client.mu.Unlock()
+		close(client.done)
+		client.conn.Close()
+	})
+}
+
+func (client *Client) Close() error {
+	client.write(&Packet{Type: TypeDisconnect})
+	client.shutdown(nil)
+	return nil
+}
+
+func (client *Client) readLoop(reader *bufio.Reader) {
+	for {
+		packet, err := ReadPacket(reader, client.options.MaxPacketSize)
+		if err != nil {
+			client.shutdown(errors.New("Connection to broker lost: " + err.Error()))
+			return
+		}
+
+		switch packet.Type {
+		case TypePublish:
+			publish, err := DecodePublish(packet)
+			if err != nil {
+				client.shutdown(err)
+				return
+			}
+			accepted := true
+			if client.options.OnMessage != nil {
+				accepted = client.options.OnMessage(publish.Topic, publish.Payload)
+			}
+			if publish.Qos == 1 && accepted {
+				client.write(EncodePacketId(TypePuback, publish.PacketId))
+			}
+
+		case TypePuback, TypeSuback:
+			packetId, err := DecodePacketId(packet)
+			if err != nil {
+				client.shutdown(err)
+				return
+			}
+			client.mu.Lock()
+			ack, ok := client.pending[packetId]
+			delete(client.pending, packetId)
+			client.mu.Unlock()
+			if ok {
+				ack <- packet
+			}
+
+		case TypePingresp:
+
+		default:
+			client.shutdown(errors.New(fmt.Sprintf("Unexpected packet type %d from broker", packet.Type)))
+			return
+		}
+	}
+}
+
+func (client *Client) pingLoop() {
+	ticker := time.NewTicker(client.options.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := client.write(&Packet{Type: TypePingreq}); err != nil {
+				client.shutdown(err)
+				return
+			}
+		case <-client.done:
+			return
+		}
+	}
+}
+
+// Registers a waiter for the acknowledgement of a new packet ID
+func (client *Client) allocateId() (uint16, chan *Packet) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for {
+		client.nextId++
+		if client.nextId == 0 {
+			continue
+		}
+		if _, busy := client.pending[client.nextId]; !busy {
+			break
+		}
+	}
+	ack := make(chan *Packet, 1)
+	client.pending[client.nextId] = ack
+	return client.nextId, ack
+}
+
+func (client *Client) forget(packetId uint16) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	delete(client.pending, packetId)
+}
+
+func (client *Client) waitAck(ack chan *Packet) (*Packet, error) {
+	select {
+	case packet := <-ack:
+		return packet, nil
+	case <-time.After(ackTimeout):
+		return nil, nil
+	case <-client.done:
+		if err := client.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("Connection closed")
+	}
+}
+
+func (client *Client) Subscribe(topic string, qos byte) error {
+	packetId, ack := client.allocateId()
+	defer client.forget(packetId)
+
+	subscribe := SubscribePacket{PacketId: packetId, Topics: []string{topic}, Qos: []byte{qos}}
+	if err := client.write(subscribe.Encode()); err != nil {
+		return err
+	}
+
+	packet, err := client.waitAck(ack)
+	if err != nil {
+		return err
+	}
+	if packet == nil {
+		return errors.New("No SUBACK from broker")
+	}
+	_, granted, err := DecodeSuback(packet)
+	if err != nil {
+		return err
+	}
+	if len(granted) != 1 || granted[0] == 0x80 {
+		return errors.New("Broker refused subscription to " + topic)
+	}
+	return nil
+}
+
+// With QoS 1 waits for PUBACK, repeating the message with the DUP flag if
+// it does not come in time
+func (client *Client) Publish(topic string, payload []byte, qos byte) error {
+	publish := PublishPacket{Topic: topic, Qos: qos, Payload: payload}
+	if qos == 0 {
+		return client.write(publish.Encode())
+	}
+
+	packetId, ack := client.allocateId()
+	defer client.forget(packetId)
+	publish.PacketId = packetId
+
+	for try := 0; try < maxPublishTries; try++ {
+		publish.Dup = try > 0
+		if err := client.write(publish.Encode()); err != nil {
+			return err
+		}
+		packet, err := client.waitAck(ack)
+		if err != nil {
+			return err
+		}
+		if packet != nil {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("No PUBACK from broker after %d tries", maxPublishTries))
+}
@@ -0,0 +1,63 @@
+package mqtt_test
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/mqtt"
+	"github.com/ovandriyanov/tgpunch/pkg/mqtttest"
+	"net"
+	"testing"
+	"time"
+)
+
+func connect(t *testing.T, broker *mqtttest.Broker, clientId string, onMessage func(topic string, payload []byte) bool) *mqtt.Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", broker.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := mqtt.Connect(conn, &mqtt.Options{ClientId: clientId, OnMessage: onMessage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestRejectedMessageIsRedelivered(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	rejected := make(chan string, 1)
+	receiver := connect(t, broker, "receiver", func(topic string, payload []byte) bool {
+		rejected <- string(payload)
+		return false
+	})
+	if err := receiver.Subscribe("inbox/+", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := connect(t, broker, "sender", nil)
+	defer sender.Close()
+	if err := sender.Publish("inbox/sender", []byte("hello"), 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-rejected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message never arrived")
+	}
+	receiver.Close()
+
+	accepted := make(chan string, 1)
+	receiver = connect(t, broker, "receiver", func(topic string, payload []byte) bool {
+		accepted <- string(payload)
+		return true
+	})
+	defer receiver.Close()
+	select {
+	case payload := <-accepted:
+		if payload != "hello" {
+			t.Fatalf("Redelivered %q, want hello", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unacknowledged message was not redelivered")
+	}
+}
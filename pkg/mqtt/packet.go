@@ -0,0 +1,346 @@
+// Package mqtt is a minimal MQTT 3.1.1 client supporting QoS 0 and 1, which
+// is all the signaling needs.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types
+const (
+	TypeConnect     = 1
+	TypeConnack     = 2
+	TypePublish     = 3
+	TypePuback      = 4
+	TypeSubscribe   = 8
+	TypeSuback      = 9
+	TypePingreq     = 12
+	TypePingresp    = 13
+	TypeDisconnect  = 14
+	maxRemainingLen = 268435455
+)
+
+const protocolLevel = 4
+
+// Limit of the remaining length of incoming packets unless configured
+// otherwise. Hub messages take a few kilobytes at most, and the length
+// comes from the network, so it must not decide how much we allocate.
+const DefaultMaxPacketSize = 256 * 1024
+
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// Fails on packets with a remaining length over maxLength, which must be
+// positive
+func ReadPacket(r *bufio.Reader, maxLength int) (*Packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// Remaining length is a variable byte integer, 7 bits per byte
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return nil, errors.New("Malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > maxLength {
+		return nil, errors.New(fmt.Sprintf("Packet of %d bytes exceeds the limit of %d", length, maxLength))
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &Packet{Type: header >> 4, Flags: header & 0x0f, Body: body}, nil
+}
+
+func WritePacket(w io.Writer, packet *Packet) error {
+	length := len(packet.Body)
+	if length > maxRemainingLen {
+		return errors.New("Packet too large")
+	}
+
+	buffer := []byte{packet.Type<<4 | packet.Flags}
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buffer = append(buffer, b)
+		if length == 0 {
+			break
+		}
+	}
+	buffer = append(buffer, packet.Body...)
+
+	_, err := w.Write(buffer)
+	return err
+}
+
+func appendUint16(buffer []byte, value uint16) []byte {
+	return binary.BigEndian.AppendUint16(buffer, value)
+}
+
+func appendString(buffer []byte, value string) []byte {
+	buffer = appendUint16(buffer, uint16(len(value)))
+	return append(buffer, value...)
+}
+
+func readUint16(body []byte) (uint16, []byte, error) {
+	if len(body) < 2 {
+		return 0, nil, errors.New("Packet truncated")
+	}
+	return binary.BigEndian.Uint16(body), body[2:], nil
+}
+
+func readString(body []byte) (string, []byte, error) {
+	length, body, err := readUint16(body)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(body) < int(length) {
+		return "", nil, errors.New("Packet truncated")
+	}
+	return string(body[:length]), body[length:], nil
+}
+
+type ConnectPacket struct {
+	ClientId     string
+	Username     string
+	Password     string
+	KeepAlive    uint16
+	CleanSession bool
+}
+
+func (connect *ConnectPacket) Encode() *Packet {
+	var flags byte
+	if connect.CleanSession {
+		flags |= 0x02
+	}
+	if connect.Username != "" {
+		flags |= 0x80
+	}
+	if connect.Password != "" {
+		flags |= 0x40
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, protocolLevel, flags)
+	body = appendUint16(body, connect.KeepAlive)
+	body = appendString(body, connect.ClientId)
+	if connect.Username != "" {
+		body = appendString(body, connect.Username)
+	}
+	if connect.Password != "" {
+		body = appendString(body, connect.Password)
+	}
+	return &Packet{Type: TypeConnect, Body: body}
+}
+
+func DecodeConnect(packet *Packet) (*ConnectPacket, error) {
+	protocol, body, err := readString(packet.Body)
+	if err != nil {
+		return nil, err
+	}
+	if protocol != "MQTT" || len(body) < 2 || body[0] != protocolLevel {
+		return nil, errors.New("Unsupported protocol")
+	}
+	flags := body[1]
+	if flags&0x04 != 0 {
+		return nil, errors.New("Will messages are not supported")
+	}
+
+	var connect ConnectPacket
+	connect.CleanSession = flags&0x02 != 0
+	if connect.KeepAlive, body, err = readUint16(body[2:]); err != nil {
+		return nil, err
+	}
+	if connect.ClientId, body, err = readString(body); err != nil {
+		return nil, err
+	}
+	if flags&0x80 != 0 {
+		if connect.Username, body, err = readString(body); err != nil {
+			return nil, err
+		}
+	}
+	if flags&0x40 != 0 {
+		if connect.Password, _, err = readString(body); err != nil {
+			return nil, err
+		}
+	}
+	return &connect, nil
+}
+
+// CONNACK return codes
+const (
+	ConnectAccepted       = 0
+	ConnectBadCredentials = 4
+	ConnectNotAuthorized  = 5
+)
+
+func EncodeConnack(sessionPresent bool, returnCode byte) *Packet {
+	var flags byte
+	if sessionPresent {
+		flags = 1
+	}
+	return &Packet{Type: TypeConnack, Body: []byte{flags, returnCode}}
+}
+
+type PublishPacket struct {
+	Topic    string
+	PacketId uint16
+	Qos      byte
+	Dup      bool
+	Retain   bool
+	Payload  []byte
+}
+
+func (publish *PublishPacket) Encode() *Packet {
+	flags := publish.Qos << 1
+	if publish.Dup {
+		flags |= 0x08
+	}
+	if publish.Retain {
+		flags |= 0x01
+	}
+
+	body := appendString(nil, publish.Topic)
+	if publish.Qos > 0 {
+		body = appendUint16(body, publish.PacketId)
+	}
+	body = append(body, publish.Payload...)
+	return &Packet{Type: TypePublish, Flags: flags, Body: body}
+}
+
+func DecodePublish(packet *Packet) (*PublishPacket, error) {
+	publish := PublishPacket{
+		Qos:    (packet.Flags >> 1) & 0x03,
+		Dup:    packet.Flags&0x08 != 0,
+		Retain: packet.Flags&0x01 != 0,
+	}
+	if publish.Qos > 1 {
+		return nil, errors.New(fmt.Sprintf("QoS %d is not supported", publish.Qos))
+	}
+
+	var body []byte
+	var err error
+	if publish.Topic, body, err = readString(packet.Body); err != nil {
+		return nil, err
+	}
+	if publish.Qos > 0 {
+		if publish.PacketId, body, err = readUint16(body); err != nil {
+			return nil, err
+		}
+	}
+	publish.Payload = body
+	return &publish, nil
+}
+
+// PUBACK carries nothing but the packet ID
+func EncodePacketId(packetType byte, packetId uint16) *Packet {
+	return &Packet{Type: packetType, Body: appendUint16(nil, packetId)}
+}
+
+func DecodePacketId(packet *Packet) (uint16, error) {
+	packetId, _, err := readUint16(packet.Body)
+	return packetId, err
+}
+
+type SubscribePacket struct {
+	PacketId uint16
+	Topics   []string
+	Qos      []byte
+}
+
+func (subscribe *SubscribePacket) Encode() *Packet {
+	body := appendUint16(nil, subscribe.PacketId)
+	for i, topic := range subscribe.Topics {
+		body = appendString(body, topic)
+		body = append(body, subscribe.Qos[i])
+	}
+	// SUBSCRIBE has reserved flags 0010
+	return &Packet{Type: TypeSubscribe, Flags: 0x02, Body: body}
+}
+
+func DecodeSubscribe(packet *Packet) (*SubscribePacket, error) {
+	var subscribe SubscribePacket
+	body := packet.Body
+	var err error
+	if subscribe.PacketId, body, err = readUint16(body); err != nil {
+		return nil, err
+	}
+	for len(body) > 0 {
+		var topic string
+		if topic, body, err = readString(body); err != nil {
+			return nil, err
+		}
+		if len(body) == 0 {
+			return nil, errors.New("Packet truncated")
+		}
+		subscribe.Topics = append(subscribe.Topics, topic)
+		subscribe.Qos = append(subscribe.Qos, body[0]&0x03)
+		body = body[1:]
+	}
+	if len(subscribe.Topics) == 0 {
+		return nil, errors.New("SUBSCRIBE without topics")
+	}
+	return &subscribe, nil
+}
+
+// Granted QoS of every topic, 0x80 marks a failure
+func EncodeSuback(packetId uint16, granted []byte) *Packet {
+	return &Packet{Type: TypeSuback, Body: append(appendUint16(nil, packetId), granted...)}
+}
+
+func DecodeSuback(packet *Packet) (uint16, []byte, error) {
+	packetId, body, err := readUint16(packet.Body)
+	return packetId, body, err
+}
+
+// Tells if the topic name matches a subscription filter with + and #
+// wildcards
+func TopicMatches(filter string, topic string) bool {
+	for {
+		filterLevel, filterRest, filterMore := cutLevel(filter)
+		topicLevel, topicRest, topicMore := cutLevel(topic)
+
+		if filterLevel == "#" {
+			return true
+		}
+		if filterLevel != "+" && filterLevel != topicLevel {
+			return false
+		}
+		if !filterMore || !topicMore {
+			return filterMore == topicMore || (filterMore && filterRest == "#")
+		}
+		filter, topic = filterRest, topicRest
+	}
+}
+
+func cutLevel(topic string) (string, string, bool) {
+	for i := 0; i < len(topic); i++ {
+		if topic[i] == '/' {
+			return topic[:i], topic[i+1:], true
+		}
+	}
+	return topic, "", false
+}
@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestPublishRoundTrip(t *testing.T) {
+	publish := PublishPacket{Topic: "tgpunch/server/inbox/client", PacketId: 7, Qos: 1, Dup: true, Payload: []byte(`{"type":"request"}`)}
+
+	var buffer bytes.Buffer
+	if err := WritePacket(&buffer, publish.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := ReadPacket(bufio.NewReader(&buffer), DefaultMaxPacketSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodePublish(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Topic != publish.Topic || decoded.PacketId != 7 || decoded.Qos != 1 || !decoded.Dup || string(decoded.Payload) != string(publish.Payload) {
+		t.Fatalf("Decoded %+v, want %+v", decoded, publish)
+	}
+}
+
+func TestReadPacketLimitsLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		// Claims the maximum remaining length of 256 MB with no body
+		{"huge", []byte{TypePublish << 4, 0xff, 0xff, 0xff, 0x7f}},
+		{"over limit", []byte{TypePublish << 4, 0x81, 0x01}},
+		{"malformed length", []byte{TypePublish << 4, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"truncated body", []byte{TypePublish << 4, 0x10, 0x00}},
+		{"truncated length", []byte{TypePublish << 4, 0x80}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ReadPacket(bufio.NewReader(bytes.NewReader(test.input)), 128); err == nil {
+				t.Fatal("Want an error")
+			}
+		})
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"tgpunch/server/inbox/+", "tgpunch/server/inbox/client", true},
+		{"tgpunch/server/inbox/+", "tgpunch/server/inbox", false},
+		{"tgpunch/#", "tgpunch/server/inbox/client", true},
+		{"tgpunch/other/inbox/+", "tgpunch/server/inbox/client", false},
+	}
+	for _, test := range tests {
+		if got := TopicMatches(test.filter, test.topic); got != test.want {
+			t.Errorf("TopicMatches(%q, %q) = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
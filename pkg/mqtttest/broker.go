@@ -0,0 +1,303 @@
+// Package mqtttest runs an in-process MQTT broker stand-in that supports
+// what the MQTT signaler uses: QoS 0 and 1, wildcard subscriptions and
+// persistent sessions.
+package mqtttest
+
+import (
+	"bufio"
+	"github.com/ovandriyanov/tgpunch/pkg/mqtt"
+	"net"
+	"sync"
+)
+
+type session struct {
+	clientId      string
+	clean         bool
+	subscriptions map[string]byte
+	conn          net.Conn
+	// QoS 1 messages not acknowledged yet, including the ones received while
+	// the client was offline. They are delivered again on reconnect.
+	inflight map[uint16]*mqtt.PublishPacket
+	order    []uint16
+}
+
+// Must be called with the broker lock held
+func (s *session) track(publish *mqtt.PublishPacket) {
+	s.inflight[publish.PacketId] = publish
+	s.order = append(s.order, publish.PacketId)
+}
+
+// Must be called with the broker lock held
+func (s *session) pending() []*mqtt.PublishPacket {
+	var pending []*mqtt.PublishPacket
+	var order []uint16
+	for _, packetId := range s.order {
+		if publish, ok := s.inflight[packetId]; ok {
+			publish.Dup = true
+			pending = append(pending, publish)
+			order = append(order, packetId)
+		}
+	}
+	s.order = order
+	return pending
+}
+
+type Broker struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	// Username to password, empty to accept anyone
+	users    map[string]string
+	sessions map[string]*session
+	conns    map[net.Conn]bool
+	nextId   uint16
+	writeMu  map[net.Conn]*sync.Mutex
+}
+
+// Starts a broker listening on a random loopback port
+func NewBroker() *Broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("mqtttest: cannot listen: " + err.Error())
+	}
+	broker := &Broker{
+		listener: listener,
+		users:    make(map[string]string),
+		sessions: make(map[string]*session),
+		conns:    make(map[net.Conn]bool),
+		writeMu:  make(map[net.Conn]*sync.Mutex),
+	}
+	go broker.accept()
+	return broker
+}
+
+// The address to dial, host:port
+func (broker *Broker) Addr() string {
+	return broker.listener.Addr().String()
+}
+
+// Requires clients to authenticate. Without any users added the broker
+// accepts everyone.
+func (broker *Broker) AddUser(username string, password string) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.users[username] = password
+}
+
+// Drops all client connections, keeping persistent sessions
+func (broker *Broker) Disconnect() {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for conn := range broker.conns {
+		conn.Close()
+	}
+}
+
+func (broker *Broker) Close() {
+	broker.listener.Close()
+	broker.Disconnect()
+}
+
+func (broker *Broker) accept() {
+	for {
+		conn, err := broker.listener.Accept()
+		if err != nil {
+			return
+		}
+		broker.mu.Lock()
+		broker.conns[conn] = true
+		broker.writeMu[conn] = &sync.Mutex{}
+		broker.mu.Unlock()
+		go broker.serve(conn)
+	}
+}
+
+func (broker *Broker) write(conn net.Conn, packet *mqtt.Packet) {
+	broker.mu.Lock()
+	writeMu := broker.writeMu[conn]
+	broker.mu.Unlock()
+	if writeMu == nil {
+		return
+	}
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	mqtt.WritePacket(conn, packet)
+}
+
+func (broker *Broker) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	var current *session
+	defer func() {
+		broker.mu.Lock()
+		if current != nil && current.conn == conn {
+			current.conn = nil
+			if current.clean && broker.sessions[current.clientId] == current {
+				delete(broker.sessions, current.clientId)
+			}
+		}
+		delete(broker.conns, conn)
+		delete(broker.writeMu, conn)
+		broker.mu.Unlock()
+		conn.Close()
+	}()
+
+	packet, err := mqtt.ReadPacket(reader, mqtt.DefaultMaxPacketSize)
+	if err != nil || packet.Type != mqtt.TypeConnect {
+		return
+	}
+	connect, err := mqtt.DecodeConnect(packet)
+	if err != nil {
+		return
+	}
+	current, ok := broker.connect(conn, connect)
+	if !ok {
+		return
+	}
+
+	for {
+		packet, err := mqtt.ReadPacket(reader, mqtt.DefaultMaxPacketSize)
+		if err != nil {
+			return
+		}
+
+		switch packet.Type {
+		case mqtt.TypePublish:
+			publish, err := mqtt.DecodePublish(packet)
+			if err != nil {
+				return
+			}
+			if publish.Qos == 1 {
+				broker.write(conn, mqtt.EncodePacketId(mqtt.TypePuback, publish.PacketId))
+			}
+			broker.route(publish)
+
+		case mqtt.TypeSubscribe:
+			subscribe, err := mqtt.DecodeSubscribe(packet)
+			if err != nil {
+				return
+			}
+			granted := make([]byte, len(subscribe.Topics))
+			broker.mu.Lock()
+			for i, topic := range subscribe.Topics {
+				granted[i] = subscribe.Qos[i]
+				if granted[i] > 1 {
+					granted[i] = 1
+				}
+				current.subscriptions[topic] = granted[i]
+			}
+			broker.mu.Unlock()
+			broker.write(conn, mqtt.EncodeSuback(subscribe.PacketId, granted))
+
+		case mqtt.TypePuback:
+			packetId, err := mqtt.DecodePacketId(packet)
+			if err != nil {
+				return
+			}
+			broker.mu.Lock()
+			delete(current.inflight, packetId)
+			broker.mu.Unlock()
+
+		case mqtt.TypePingreq:
+			broker.write(conn, &mqtt.Packet{Type: mqtt.TypePingresp})
+
+		case mqtt.TypeDisconnect:
+			return
+
+		default:
+			return
+		}
+	}
+}
+
+// Authenticates the client and attaches it to its session
+func (broker *Broker) connect(conn net.Conn, connect *mqtt.ConnectPacket) (*session, bool) {
+	broker.mu.Lock()
+
+	if len(broker.users) > 0 {
+		password, ok := broker.users[connect.Username]
+		if !ok || password != connect.Password {
+			broker.mu.Unlock()
+			broker.write(conn, mqtt.EncodeConnack(false, mqtt.ConnectBadCredentials))
+			return nil, false
+		}
+	}
+
+	s, present := broker.sessions[connect.ClientId]
+	if present && s.conn != nil {
+		// Session takeover, the older connection is dropped
+		s.conn.Close()
+	}
+	if !present || connect.CleanSession {
+		s = &session{
+			clientId:      connect.ClientId,
+			clean:         connect.CleanSession,
+			subscriptions: make(map[string]byte),
+			inflight:      make(map[uint16]*mqtt.PublishPacket),
+		}
+		present = false
+		broker.sessions[connect.ClientId] = s
+	}
+	s.conn = conn
+	var pending []*mqtt.Packet
+	for _, publish := range s.pending() {
+		pending = append(pending, publish.Encode())
+	}
+	broker.mu.Unlock()
+
+	broker.write(conn, mqtt.EncodeConnack(present, mqtt.ConnectAccepted))
+	for _, packet := range pending {
+		broker.write(conn, packet)
+	}
+	return s, true
+}
+
+func (broker *Broker) route(publish *mqtt.PublishPacket) {
+	type delivery struct {
+		conn   net.Conn
+		packet *mqtt.Packet
+	}
+	var deliveries []delivery
+
+	broker.mu.Lock()
+	for _, s := range broker.sessions {
+		qos, ok := matchingQos(s, publish.Topic)
+		if !ok {
+			continue
+		}
+		if qos > publish.Qos {
+			qos = publish.Qos
+		}
+		out := &mqtt.PublishPacket{Topic: publish.Topic, Qos: qos, Payload: publish.Payload}
+		if qos > 0 {
+			broker.nextId++
+			if broker.nextId == 0 {
+				broker.nextId++
+			}
+			out.PacketId = broker.nextId
+			s.track(out)
+		}
+
+		if s.conn == nil {
+			continue
+		}
+		deliveries = append(deliveries, delivery{conn: s.conn, packet: out.Encode()})
+	}
+	broker.mu.Unlock()
+
+	for _, d := range deliveries {
+		broker.write(d.conn, d.packet)
+	}
+}
+
+func matchingQos(s *session, topic string) (byte, bool) {
+	best, found := byte(0), false
+	for filter, qos := range s.subscriptions {
+		if mqtt.TopicMatches(filter, topic) {
+			if !found || qos > best {
+				best = qos
+			}
+			found = true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,117 @@
+package natemu
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn is a virtual UDP socket implementing net.PacketConn
+type Conn struct {
+	network *Network
+	host    *host
+	addr    *net.UDPAddr
+	send    func(*Conn, []byte, *net.UDPAddr)
+	inbox   chan packet
+
+	mu              sync.Mutex
+	closed          chan struct{}
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+}
+
+func (conn *Conn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	for {
+		conn.mu.Lock()
+		deadline := conn.readDeadline
+		deadlineChanged := conn.deadlineChanged
+		conn.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+
+		n, from, done, err := conn.receive(buffer, timeout, deadlineChanged)
+		if timer != nil {
+			timer.Stop()
+		}
+		if done {
+			return n, from, err
+		}
+	}
+}
+
+func (conn *Conn) receive(buffer []byte, timeout <-chan time.Time, deadlineChanged chan struct{}) (int, net.Addr, bool, error) {
+	select {
+	case p := <-conn.inbox:
+		return copy(buffer, p.payload), p.from, true, nil
+	case <-conn.closed:
+		return 0, nil, true, net.ErrClosed
+	case <-timeout:
+		return 0, nil, true, os.ErrDeadlineExceeded
+	case <-deadlineChanged:
+		return 0, nil, false, nil
+	}
+}
+
+func (conn *Conn) WriteTo(payload []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("Not a UDP address: " + addr.String())
+	}
+	if len(payload) > maxPacketSize {
+		return 0, errors.New("Datagram too large")
+	}
+
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	conn.network.mu.Lock()
+	defer conn.network.mu.Unlock()
+	conn.send(conn, append([]byte(nil), payload...), to)
+	return len(payload), nil
+}
+
+func (conn *Conn) Close() error {
+	conn.network.mu.Lock()
+	defer conn.network.mu.Unlock()
+
+	select {
+	case <-conn.closed:
+		return net.ErrClosed
+	default:
+	}
+	close(conn.closed)
+	delete(conn.host.conns, conn.addr.Port)
+	return nil
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.addr
+}
+
+func (conn *Conn) SetDeadline(deadline time.Time) error {
+	return conn.SetReadDeadline(deadline)
+}
+
+func (conn *Conn) SetReadDeadline(deadline time.Time) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.readDeadline = deadline
+	close(conn.deadlineChanged)
+	conn.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// Writes never block, so there is nothing for a write deadline to limit
+func (conn *Conn) SetWriteDeadline(deadline time.Time) error {
+	return nil
+}
@@ -0,0 +1,344 @@
+// Package natemu emulates a UDP network with NAT devices in between, so that
+// hole punching can be exercised inside a single process.
+package natemu
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+type NatType int
+
+const (
+	// Endpoint-independent mapping and filtering
+	FullCone NatType = iota
+	// Endpoint-independent mapping, inbound packets are accepted only from
+	// IP addresses the internal host has sent something to
+	RestrictedCone
+	// Same as RestrictedCone, but the remote port has to match too
+	PortRestrictedCone
+	// A new mapping for every remote endpoint, port-restricted filtering
+	Symmetric
+)
+
+func (natType NatType) String() string {
+	switch natType {
+	case FullCone:
+		return "full cone"
+	case RestrictedCone:
+		return "restricted cone"
+	case PortRestrictedCone:
+		return "port restricted cone"
+	case Symmetric:
+		return "symmetric"
+	}
+	return fmt.Sprintf("NatType(%d)", int(natType))
+}
+
+const (
+	firstPort     = 40000
+	inboxSize     = 64
+	maxPacketSize = 65507
+)
+
+type packet struct {
+	payload []byte
+	from    *net.UDPAddr
+}
+
+type Network struct {
+	mu      sync.Mutex
+	rng     *rand.Rand
+	loss    float64
+	latency time.Duration
+	// Public hosts and NAT devices by IP address
+	hosts map[string]*host
+	nats  map[string]*NAT
+}
+
+// Creates a network. Packet loss decisions are drawn from a random
+// generator seeded with seed, which keeps test runs reproducible.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rng:   rand.New(rand.NewSource(seed)),
+		hosts: make(map[string]*host),
+		nats:  make(map[string]*NAT),
+	}
+}
+
+// Sets the probability of dropping any single packet
+func (network *Network) SetLoss(loss float64) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.loss = loss
+}
+
+// Sets the one-way delay of every packet
+func (network *Network) SetLatency(latency time.Duration) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.latency = latency
+}
+
+// Binds a socket on a host directly connected to the network. A zero
+// port picks a free one.
+func (network *Network) Listen(ip string, port int) (*Conn, error) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	if _, ok := network.nats[ip]; ok {
+		return nil, errors.New("Address " + ip + " belongs to a NAT")
+	}
+	h, ok := network.hosts[ip]
+	if !ok {
+		h = newHost(ip)
+		network.hosts[ip] = h
+	}
+	return h.listen(network, port, func(conn *Conn, payload []byte, to *net.UDPAddr) {
+		network.route(payload, conn.addr, to)
+	})
+}
+
+// Adds a NAT device with the given public IP address
+func (network *Network) AddNAT(natType NatType, publicIp string) (*NAT, error) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	if _, ok := network.hosts[publicIp]; ok {
+		return nil, errors.New("Address " + publicIp + " is already in use")
+	}
+	if _, ok := network.nats[publicIp]; ok {
+		return nil, errors.New("Address " + publicIp + " is already in use")
+	}
+	nat := &NAT{
+		network:  network,
+		natType:  natType,
+		publicIp: net.ParseIP(publicIp),
+		nextPort: firstPort,
+		hosts:    make(map[string]*host),
+		byPublic: make(map[int]*mapping),
+		byKey:    make(map[mappingKey]*mapping),
+	}
+	network.nats[publicIp] = nat
+	return nat, nil
+}
+
+// Delivers a packet leaving a public address. Must be called with the
+// network lock held.
+func (network *Network) route(payload []byte, from *net.UDPAddr, to *net.UDPAddr) {
+	if network.loss > 0 && network.rng.Float64() < network.loss {
+		return
+	}
+
+	var deliver func()
+	if nat, ok := network.nats[to.IP.String()]; ok {
+		deliver = func() {
+			network.mu.Lock()
+			defer network.mu.Unlock()
+			nat.inbound(payload, from, to)
+		}
+	} else if h, ok := network.hosts[to.IP.String()]; ok {
+		deliver = func() {
+			network.mu.Lock()
+			defer network.mu.Unlock()
+			h.deliver(payload, from, to.Port)
+		}
+	} else {
+		return
+	}
+
+	if network.latency > 0 {
+		time.AfterFunc(network.latency, deliver)
+	} else {
+		go deliver()
+	}
+}
+
+type mappingKey struct {
+	internal string
+	// Remote endpoint for symmetric NATs, empty otherwise
+	remote string
+}
+
+type mapping struct {
+	key        mappingKey
+	internal   *net.UDPAddr
+	publicPort int
+	lastUsed   time.Time
+	// Remote IP addresses and endpoints the internal host has sent to
+	sentToIps       map[string]bool
+	sentToEndpoints map[string]bool
+}
+
+type NAT struct {
+	network  *Network
+	natType  NatType
+	publicIp net.IP
+	nextPort int
+	timeout  time.Duration
+	// Internal hosts by private IP address
+	hosts    map[string]*host
+	byPublic map[int]*mapping
+	byKey    map[mappingKey]*mapping
+}
+
+func (nat *NAT) Type() NatType {
+	return nat.natType
+}
+
+func (nat *NAT) PublicIp() net.IP {
+	return nat.publicIp
+}
+
+// Makes mappings expire after staying idle for the given time. Only
+// outbound packets keep a mapping alive. Zero disables expiration.
+func (nat *NAT) SetMappingTimeout(timeout time.Duration) {
+	nat.network.mu.Lock()
+	defer nat.network.mu.Unlock()
+	nat.timeout = timeout
+}
+
+// Binds a socket on a host behind the NAT. A zero port picks a free one.
+func (nat *NAT) Listen(ip string, port int) (*Conn, error) {
+	nat.network.mu.Lock()
+	defer nat.network.mu.Unlock()
+
+	h, ok := nat.hosts[ip]
+	if !ok {
+		h = newHost(ip)
+		nat.hosts[ip] = h
+	}
+	return h.listen(nat.network, port, nat.outbound)
+}
+
+func (nat *NAT) expired(m *mapping, now time.Time) bool {
+	return nat.timeout > 0 && now.Sub(m.lastUsed) > nat.timeout
+}
+
+func (nat *NAT) removeMapping(m *mapping) {
+	delete(nat.byKey, m.key)
+	delete(nat.byPublic, m.publicPort)
+}
+
+func (nat *NAT) outbound(conn *Conn, payload []byte, to *net.UDPAddr) {
+	// Packets between hosts behind the same NAT stay inside
+	if h, ok := nat.hosts[to.IP.String()]; ok {
+		go func() {
+			nat.network.mu.Lock()
+			defer nat.network.mu.Unlock()
+			h.deliver(payload, conn.addr, to.Port)
+		}()
+		return
+	}
+
+	key := mappingKey{internal: conn.addr.String()}
+	if nat.natType == Symmetric {
+		key.remote = to.String()
+	}
+
+	now := time.Now()
+	m, ok := nat.byKey[key]
+	if ok && nat.expired(m, now) {
+		nat.removeMapping(m)
+		ok = false
+	}
+	if !ok {
+		m = &mapping{
+			key:             key,
+			internal:        conn.addr,
+			publicPort:      nat.nextPort,
+			sentToIps:       make(map[string]bool),
+			sentToEndpoints: make(map[string]bool),
+		}
+		nat.nextPort++
+		nat.byKey[key] = m
+		nat.byPublic[m.publicPort] = m
+	}
+
+	m.lastUsed = now
+	m.sentToIps[to.IP.String()] = true
+	m.sentToEndpoints[to.String()] = true
+
+	nat.network.route(payload, &net.UDPAddr{IP: nat.publicIp, Port: m.publicPort}, to)
+}
+
+func (nat *NAT) inbound(payload []byte, from *net.UDPAddr, to *net.UDPAddr) {
+	m, ok := nat.byPublic[to.Port]
+	if !ok {
+		return
+	}
+	if nat.expired(m, time.Now()) {
+		nat.removeMapping(m)
+		return
+	}
+
+	switch nat.natType {
+	case RestrictedCone:
+		if !m.sentToIps[from.IP.String()] {
+			return
+		}
+	case PortRestrictedCone, Symmetric:
+		if !m.sentToEndpoints[from.String()] {
+			return
+		}
+	}
+
+	if h, ok := nat.hosts[m.internal.IP.String()]; ok {
+		h.deliver(payload, from, m.internal.Port)
+	}
+}
+
+type host struct {
+	ip       net.IP
+	nextPort int
+	conns    map[int]*Conn
+}
+
+func newHost(ip string) *host {
+	return &host{
+		ip:       net.ParseIP(ip),
+		nextPort: firstPort,
+		conns:    make(map[int]*Conn),
+	}
+}
+
+func (h *host) listen(network *Network, port int, send func(*Conn, []byte, *net.UDPAddr)) (*Conn, error) {
+	if port == 0 {
+		for h.conns[h.nextPort] != nil {
+			h.nextPort++
+		}
+		port = h.nextPort
+		h.nextPort++
+	}
+	if _, ok := h.conns[port]; ok {
+		return nil, errors.New(fmt.Sprintf("Port %d is already in use on %v", port, h.ip))
+	}
+
+	conn := &Conn{
+		network:         network,
+		host:            h,
+		addr:            &net.UDPAddr{IP: h.ip, Port: port},
+		send:            send,
+		inbox:           make(chan packet, inboxSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+	h.conns[port] = conn
+	return conn, nil
+}
+
+func (h *host) deliver(payload []byte, from *net.UDPAddr, port int) {
+	conn, ok := h.conns[port]
+	if !ok {
+		return
+	}
+	select {
+	case conn.inbox <- packet{payload: payload, from: from}:
+	default:
+		// Receive buffer overflow, the packet is lost just like with UDP
+	}
+}
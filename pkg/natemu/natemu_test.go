@@ -0,0 +1,141 @@
+package natemu_test
+
+import (
+	"errors"
+	"github.com/ovandriyanov/tgpunch/pkg/natemu"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// A Network or a NAT
+type listener interface {
+	Listen(ip string, port int) (*natemu.Conn, error)
+}
+
+func listen(t *testing.T, listener listener, ip string) *natemu.Conn {
+	t.Helper()
+	conn, err := listener.Listen(ip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func send(t *testing.T, conn *natemu.Conn, payload string, to net.Addr) {
+	t.Helper()
+	if _, err := conn.WriteTo([]byte(payload), to); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the payload and the sender of the next packet, or an empty
+// payload if none arrives within the timeout
+func receive(t *testing.T, conn *natemu.Conn, timeout time.Duration) (string, net.Addr) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 1500)
+	n, from, err := conn.ReadFrom(buffer)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return "", nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buffer[:n]), from
+}
+
+func TestPacketLoss(t *testing.T) {
+	tests := []struct {
+		loss     float64
+		min, max int
+	}{
+		{0, 50, 50},
+		{0.5, 10, 40},
+		{1, 0, 0},
+	}
+	for _, test := range tests {
+		network := natemu.NewNetwork(1)
+		network.SetLoss(test.loss)
+		sender := listen(t, network, "203.0.113.1")
+		receiver := listen(t, network, "203.0.113.2")
+
+		for i := 0; i < 50; i++ {
+			send(t, sender, "packet", receiver.LocalAddr())
+		}
+		received := 0
+		for {
+			payload, _ := receive(t, receiver, 100*time.Millisecond)
+			if payload == "" {
+				break
+			}
+			received++
+		}
+		if received < test.min || received > test.max {
+			t.Errorf("Loss %v: %d of 50 packets arrived, want %d to %d", test.loss, received, test.min, test.max)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	network := natemu.NewNetwork(1)
+	network.SetLatency(100 * time.Millisecond)
+	sender := listen(t, network, "203.0.113.1")
+	receiver := listen(t, network, "203.0.113.2")
+
+	sent := time.Now()
+	send(t, sender, "ping", receiver.LocalAddr())
+	if payload, _ := receive(t, receiver, time.Second); payload != "ping" {
+		t.Fatalf("Got %q, want the packet delivered", payload)
+	}
+	if elapsed := time.Since(sent); elapsed < 100*time.Millisecond {
+		t.Fatalf("Delivered after %v, want at least the latency", elapsed)
+	}
+}
+
+func TestMappingExpiry(t *testing.T) {
+	network := natemu.NewNetwork(1)
+	nat, err := network.AddNAT(natemu.PortRestrictedCone, "198.51.100.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nat.SetMappingTimeout(100 * time.Millisecond)
+	inside := listen(t, nat, "192.168.0.2")
+	peer := listen(t, network, "203.0.113.1")
+
+	send(t, inside, "hello", peer.LocalAddr())
+	payload, mapped := receive(t, peer, time.Second)
+	if payload != "hello" {
+		t.Fatalf("Got %q, want the outbound packet delivered", payload)
+	}
+	send(t, peer, "reply", mapped)
+	if payload, _ = receive(t, inside, time.Second); payload != "reply" {
+		t.Fatalf("Got %q, want the reply through the mapping", payload)
+	}
+
+	// Inbound packets do not keep the mapping alive
+	time.Sleep(60 * time.Millisecond)
+	send(t, peer, "reply", mapped)
+	if payload, _ = receive(t, inside, time.Second); payload != "reply" {
+		t.Fatalf("Got %q before the timeout", payload)
+	}
+	time.Sleep(60 * time.Millisecond)
+	send(t, peer, "late", mapped)
+	if payload, _ = receive(t, inside, 100*time.Millisecond); payload != "" {
+		t.Fatalf("Got %q through an expired mapping", payload)
+	}
+
+	// Sending again opens a new mapping on another port
+	send(t, inside, "again", peer.LocalAddr())
+	payload, remapped := receive(t, peer, time.Second)
+	if payload != "again" {
+		t.Fatalf("Got %q, want the outbound packet delivered", payload)
+	}
+	if remapped.String() == mapped.String() {
+		t.Fatalf("Reused the expired mapping %v", mapped)
+	}
+}
@@ -0,0 +1,56 @@
+package natemu
+
+import (
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/stun"
+	"net"
+)
+
+// StunServer answers binding requests on a public address of the network
+type StunServer struct {
+	conn *Conn
+	done chan struct{}
+}
+
+func StartStunServer(network *Network, ip string, port int) (*StunServer, error) {
+	conn, err := network.Listen(ip, port)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &StunServer{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+	go server.serve()
+	return server, nil
+}
+
+func (server *StunServer) Addr() *net.UDPAddr {
+	return server.conn.addr
+}
+
+func (server *StunServer) Close() error {
+	err := server.conn.Close()
+	<-server.done
+	return err
+}
+
+func (server *StunServer) serve() {
+	defer close(server.done)
+
+	var buffer [1500]byte
+	for {
+		nread, from, err := server.conn.ReadFrom(buffer[:])
+		if err != nil {
+			return
+		}
+
+		response, err := stun.MakeBindingResponse(buffer[:nread], from.(*net.UDPAddr))
+		if err != nil {
+			fmt.Printf("STUN server ignores a packet from %v: %v\n", from, err)
+			continue
+		}
+		server.conn.WriteTo(response, from)
+	}
+}
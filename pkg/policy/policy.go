@@ -0,0 +1,219 @@
+// Package policy decides who may ask the server to punch a hole. Rules are
+// checked in order and the first one matching the request decides; if none
+// does, the default action applies.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// A rule matches when every criterion it has matches. Criteria left out
+// match anything, but a rule needs at least one.
+type Rule struct {
+	Action string `json:"action"`
+	// Telegram user IDs of the posters, only known in groups
+	TelegramUsers []int `json:"telegram_users,omitempty"`
+	// Names or key IDs of the peers that sealed the request
+	PeerKeys []string `json:"peer_keys,omitempty"`
+	Services []string `json:"services,omitempty"`
+	// Networks the client's public address may belong to. The address is
+	// the PublicEndpoint the client reports in its request, not where the
+	// request came from, so any client can claim any address: use this to
+	// narrow down who else matches, never as the only criterion of an
+	// allow rule.
+	SourceCidrs []string `json:"source_cidrs,omitempty"`
+
+	networks []*net.IPNet
+}
+
+type Policy struct {
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+type Decision struct {
+	Allowed bool
+	// Index of the deciding rule, -1 for the default action
+	Rule int
+}
+
+func (decision Decision) String() string {
+	action := Deny
+	if decision.Allowed {
+		action = Allow
+	}
+	if decision.Rule < 0 {
+		return action + " by default"
+	}
+	return fmt.Sprintf("%s by rule %d", action, decision.Rule+1)
+}
+
+func checkAction(action string) error {
+	if action != Allow && action != Deny {
+		return errors.New("Policy action must be " + Allow + " or " + Deny + ", not " + action)
+	}
+	return nil
+}
+
+func (rule *Rule) hasCriteria() bool {
+	return len(rule.TelegramUsers) > 0 || len(rule.PeerKeys) > 0 || len(rule.Services) > 0 || len(rule.SourceCidrs) > 0
+}
+
+func Load(path string) (*Policy, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(contents)
+}
+
+// A missing default means deny. Unknown fields are refused, so that a
+// misspelled criterion cannot widen a rule.
+func Parse(contents []byte) (*Policy, error) {
+	var policy Policy
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, errors.New("Cannot parse policy: " + err.Error())
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("Cannot parse policy: trailing data after the policy")
+	}
+	if policy.Default == "" {
+		policy.Default = Deny
+	}
+	if err := checkAction(policy.Default); err != nil {
+		return nil, err
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if err := checkAction(rule.Action); err != nil {
+			return nil, errors.New(fmt.Sprintf("Rule %d: %v", i+1, err))
+		}
+		if !rule.hasCriteria() {
+			return nil, errors.New(fmt.Sprintf("Rule %d has no criteria, use the default action instead", i+1))
+		}
+		for _, cidr := range rule.SourceCidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Rule %d: %v", i+1, err))
+			}
+			rule.networks = append(rule.networks, network)
+		}
+	}
+	return &policy, nil
+}
+
+func containsString(list []string, item string) bool {
+	for _, candidate := range list {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matches(request *common.HubMessage) bool {
+	if len(rule.TelegramUsers) > 0 {
+		if request.Sender == nil {
+			return false
+		}
+		found := false
+		for _, userId := range rule.TelegramUsers {
+			found = found || userId == request.Sender.Id
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(rule.PeerKeys) > 0 {
+		key := request.SenderKey
+		if key == nil || !(containsString(rule.PeerKeys, key.Id()) || (key.Name != "" && containsString(rule.PeerKeys, key.Name))) {
+			return false
+		}
+	}
+
+	if len(rule.Services) > 0 && !containsString(rule.Services, request.Service) {
+		return false
+	}
+
+	if len(rule.networks) > 0 {
+		if request.PublicEndpoint == nil {
+			return false
+		}
+		ip := net.ParseIP(request.PublicEndpoint.Address)
+		found := false
+		for _, network := range rule.networks {
+			found = found || (ip != nil && network.Contains(ip))
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// A nil policy allows everything
+func (policy *Policy) Check(request *common.HubMessage) Decision {
+	if policy == nil {
+		return Decision{Allowed: true, Rule: -1}
+	}
+	for i := range policy.Rules {
+		if policy.Rules[i].matches(request) {
+			return Decision{Allowed: policy.Rules[i].Action == Allow, Rule: i}
+		}
+	}
+	return Decision{Allowed: policy.Default == Allow, Rule: -1}
+}
+
+// For requests that need no allow rule, e.g. because they present a
+// ticket: only a matching deny rule refuses them, wherever it is
+func (policy *Policy) CheckDenyRules(request *common.HubMessage) Decision {
+	if policy != nil {
+		for i := range policy.Rules {
+			if policy.Rules[i].Action == Deny && policy.Rules[i].matches(request) {
+				return Decision{Allowed: false, Rule: i}
+			}
+		}
+	}
+	return Decision{Allowed: true, Rule: -1}
+}
+
+// Describes the request the way the policy sees it, for the log
+func Describe(request *common.HubMessage) string {
+	var parts []string
+	if request.From != "" {
+		parts = append(parts, "peer "+request.From)
+	}
+	if request.Sender != nil {
+		parts = append(parts, fmt.Sprintf("user %d", request.Sender.Id))
+	}
+	if request.SenderKey != nil {
+		parts = append(parts, "key "+request.SenderKey.Id())
+	}
+	if request.Service != "" {
+		parts = append(parts, "service "+request.Service)
+	}
+	if request.PublicEndpoint != nil {
+		parts = append(parts, fmt.Sprintf("endpoint %s:%d", request.PublicEndpoint.Address, request.PublicEndpoint.Port))
+	}
+	if len(parts) == 0 {
+		return "anonymous request"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,150 @@
+package policy
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRefusesBadPolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{"not JSON", `{"rules":`},
+		{"unknown field", `{"default":"deny","rules":[{"action":"allow","service":["ssh"]}]}`},
+		{"unknown top level field", `{"defualt":"allow"}`},
+		{"trailing data", `{"default":"deny"} {"default":"allow"}`},
+		{"bad default", `{"default":"maybe"}`},
+		{"bad action", `{"rules":[{"action":"permit","services":["ssh"]}]}`},
+		{"no criteria", `{"rules":[{"action":"allow"}]}`},
+		{"empty criteria", `{"rules":[{"action":"allow","services":[]}]}`},
+		{"bad network", `{"rules":[{"action":"allow","source_cidrs":["10.0.0.0"]}]}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if policy, err := Parse([]byte(test.policy)); err == nil {
+				t.Fatalf("Parsed into %+v", policy)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	identity, err := e2e.GenerateIdentity("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop := identity.Public()
+	identity, err = e2e.GenerateIdentity("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unnamed := identity.Public()
+
+	policy, err := Parse([]byte(`{
+		"default": "deny",
+		"rules": [
+			{"action": "deny", "telegram_users": [13]},
+			{"action": "allow", "peer_keys": ["laptop", "` + unnamed.Id() + `"]},
+			{"action": "allow", "telegram_users": [7, 8], "services": ["ssh"]},
+			{"action": "allow", "services": ["web"], "source_cidrs": ["198.51.100.0/24", "2001:db8::/32"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := func(address string) *common.Endpoint {
+		return &common.Endpoint{Address: address, Port: 4000}
+	}
+	tests := []struct {
+		name    string
+		request common.HubMessage
+		allowed bool
+		rule    int
+	}{
+		{"nothing known", common.HubMessage{}, false, -1},
+		{"denied user", common.HubMessage{Sender: &tgapi.User{Id: 13}, SenderKey: laptop}, false, 0},
+		{"key by name", common.HubMessage{SenderKey: laptop}, true, 1},
+		{"key by ID", common.HubMessage{SenderKey: unnamed}, true, 1},
+		{"user and service", common.HubMessage{Sender: &tgapi.User{Id: 8}, Service: "ssh"}, true, 2},
+		{"user, other service", common.HubMessage{Sender: &tgapi.User{Id: 8}, Service: "web"}, false, -1},
+		{"service without user", common.HubMessage{Service: "ssh"}, false, -1},
+		{"service and network", common.HubMessage{Service: "web", PublicEndpoint: endpoint("198.51.100.9")}, true, 3},
+		{"service and IPv6 network", common.HubMessage{Service: "web", PublicEndpoint: endpoint("2001:db8::1")}, true, 3},
+		{"service, other network", common.HubMessage{Service: "web", PublicEndpoint: endpoint("203.0.113.9")}, false, -1},
+		{"service, no endpoint", common.HubMessage{Service: "web"}, false, -1},
+		{"service, bad address", common.HubMessage{Service: "web", PublicEndpoint: endpoint("nonsense")}, false, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := policy.Check(&test.request)
+			if decision.Allowed != test.allowed || decision.Rule != test.rule {
+				t.Fatalf("Got %v, want allowed %v by rule index %d", decision, test.allowed, test.rule)
+			}
+		})
+	}
+}
+
+func TestMissingDefaultDenies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(`{"rules":[{"action":"allow","services":["ssh"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision := policy.Check(&common.HubMessage{Service: "web"}); decision.Allowed {
+		t.Fatalf("Got %v, want deny by default", decision)
+	}
+}
+
+func TestNilPolicyAllows(t *testing.T) {
+	var policy *Policy
+	if decision := policy.Check(&common.HubMessage{}); !decision.Allowed {
+		t.Fatalf("Got %v, want allow", decision)
+	}
+}
+
+func TestCheckDenyRules(t *testing.T) {
+	policy, err := Parse([]byte(`{
+		"default": "deny",
+		"rules": [
+			{"action": "allow", "telegram_users": [13]},
+			{"action": "deny", "telegram_users": [13, 14]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		user    int
+		allowed bool
+		rule    int
+	}{
+		// Allow rules decide nothing, even ahead of a deny rule
+		{"allowed and denied", 13, false, 1},
+		{"denied", 14, false, 1},
+		{"unknown", 15, true, -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := policy.CheckDenyRules(&common.HubMessage{Sender: &tgapi.User{Id: test.user}})
+			if decision.Allowed != test.allowed || decision.Rule != test.rule {
+				t.Fatalf("Got %v, want allowed %v by rule index %d", decision, test.allowed, test.rule)
+			}
+		})
+	}
+
+	var none *Policy
+	if decision := none.CheckDenyRules(&common.HubMessage{}); !decision.Allowed {
+		t.Fatalf("Got %v, want allow", decision)
+	}
+}
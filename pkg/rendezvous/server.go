@@ -0,0 +1,376 @@
+// Package rendezvous implements a small HTTP long polling message relay that
+// peers can use to exchange hub messages instead of a Telegram chat.
+//
+// POST /rooms/<room>/messages stores the JSON request body as a message,
+// GET /rooms/<room>/messages?after=<id>&timeout=<seconds> waits for messages
+// with IDs greater than after. Both require "Authorization: Bearer <secret>"
+// with the secret of the room.
+//
+// Rooms come from the server configuration. If the server has an admin
+// token, PUT /rooms/<room> with "Authorization: Bearer <admin token>" and a
+// {"secret": "..."} body creates another one, up to a limit. Created rooms
+// go away after an hour without use.
+package rendezvous
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxMessageSize  = 64 * 1024
+	maxRoomMessages = 100
+	roomIdleTimeout = time.Hour
+	// Shortest secret accepted for created rooms
+	minSecretLength = 16
+
+	// Longest a poll can take, which the HTTP server must allow for
+	MaxPollTimeout = 60 * time.Second
+	// Default limit of the rooms created with the admin token
+	DefaultMaxRooms = 1000
+)
+
+var roomIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type Message struct {
+	Id   uint64          `json:"id"`
+	Time int64           `json:"time"`
+	Body json.RawMessage `json:"body"`
+}
+
+type PostResponse struct {
+	Id uint64 `json:"id"`
+}
+
+type PollResponse struct {
+	Messages []Message `json:"messages"`
+	// Pass as after to the next poll
+	LastId uint64 `json:"last_id"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type CreateRoomRequest struct {
+	Secret string `json:"secret"`
+}
+
+type Options struct {
+	// Messages are kept this long so that a peer polling a bit late still
+	// gets them
+	Retention time.Duration
+	// Secrets of the configured rooms by room ID
+	Rooms map[string]string
+	// Allows creating rooms if not empty
+	AdminToken string
+	// Limits the created rooms, DefaultMaxRooms if zero
+	MaxRooms int
+}
+
+type room struct {
+	secretHash [sha256.Size]byte
+	// Created with the admin token rather than configured
+	created  bool
+	messages []Message
+	lastId   uint64
+	lastUsed time.Time
+	updated  chan struct{}
+}
+
+type Server struct {
+	retention      time.Duration
+	adminTokenHash [sha256.Size]byte
+	hasAdminToken  bool
+	maxRooms       int
+
+	mu      sync.Mutex
+	rooms   map[string]*room
+	created int
+	stop    chan struct{}
+}
+
+func MakeServer(options *Options) (*Server, error) {
+	server := &Server{
+		retention:      options.Retention,
+		adminTokenHash: sha256.Sum256([]byte(options.AdminToken)),
+		hasAdminToken:  options.AdminToken != "",
+		maxRooms:       options.MaxRooms,
+		rooms:          make(map[string]*room),
+		stop:           make(chan struct{}),
+	}
+	if server.maxRooms == 0 {
+		server.maxRooms = DefaultMaxRooms
+	}
+	for id, secret := range options.Rooms {
+		if !roomIdPattern.MatchString(id) {
+			return nil, errors.New(fmt.Sprintf("Invalid room ID %q", id))
+		}
+		if secret == "" {
+			return nil, errors.New(fmt.Sprintf("Room %q has no secret", id))
+		}
+		server.rooms[id] = makeRoom(secret)
+	}
+	go server.sweep()
+	return server, nil
+}
+
+func makeRoom(secret string) *room {
+	return &room{
+		secretHash: sha256.Sum256([]byte(secret)),
+		lastUsed:   time.Now(),
+		updated:    make(chan struct{}),
+	}
+}
+
+func (server *Server) Close() {
+	close(server.stop)
+}
+
+func (server *Server) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-server.stop:
+			return
+		}
+
+		now := time.Now()
+		server.mu.Lock()
+		for id, r := range server.rooms {
+			r.prune(now, server.retention)
+			if r.created && len(r.messages) == 0 && now.Sub(r.lastUsed) > roomIdleTimeout {
+				delete(server.rooms, id)
+				server.created--
+			}
+		}
+		server.mu.Unlock()
+	}
+}
+
+func (r *room) prune(now time.Time, retention time.Duration) {
+	first := 0
+	for first < len(r.messages) && now.Sub(time.Unix(r.messages[first].Time, 0)) > retention {
+		first++
+	}
+	if len(r.messages)-first > maxRoomMessages {
+		first = len(r.messages) - maxRoomMessages
+	}
+	r.messages = r.messages[first:]
+}
+
+func writeJson(w http.ResponseWriter, status int, object interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(object)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, &ErrorResponse{Error: message})
+}
+
+// Finds the room, checking the secret. Unknown rooms look the same as
+// wrong secrets, so that room IDs cannot be probed. Must be called with the
+// server lock held.
+func (server *Server) openRoom(id string, secret string) (*room, bool) {
+	secretHash := sha256.Sum256([]byte(secret))
+
+	r, ok := server.rooms[id]
+	if !ok || subtle.ConstantTimeCompare(r.secretHash[:], secretHash[:]) != 1 {
+		return nil, false
+	}
+	r.lastUsed = time.Now()
+	return r, true
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	isRoom := len(parts) == 2 && parts[0] == "rooms"
+	isMessages := len(parts) == 3 && parts[0] == "rooms" && parts[2] == "messages"
+	if !isRoom && !isMessages {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	roomId := parts[1]
+	if !roomIdPattern.MatchString(roomId) {
+		writeError(w, http.StatusBadRequest, "Invalid room ID")
+		return
+	}
+
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if secret == "" || secret == r.Header.Get("Authorization") {
+		writeError(w, http.StatusUnauthorized, "Room secret required")
+		return
+	}
+
+	if isRoom {
+		if r.Method != http.MethodPut {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		server.createRoom(w, r, roomId, secret)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		server.post(w, r, roomId, secret)
+	case http.MethodGet:
+		server.poll(w, r, roomId, secret)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (server *Server) createRoom(w http.ResponseWriter, r *http.Request, roomId string, adminToken string) {
+	tokenHash := sha256.Sum256([]byte(adminToken))
+	if !server.hasAdminToken || subtle.ConstantTimeCompare(server.adminTokenHash[:], tokenHash[:]) != 1 {
+		writeError(w, http.StatusForbidden, "Wrong admin token")
+		return
+	}
+
+	var request CreateRoomRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxMessageSize)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "Cannot parse request: "+err.Error())
+		return
+	}
+	if len(request.Secret) < minSecretLength {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Room secret must be at least %d characters long", minSecretLength))
+		return
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if _, ok := server.rooms[roomId]; ok {
+		writeError(w, http.StatusConflict, "Room already exists")
+		return
+	}
+	if server.created >= server.maxRooms {
+		writeError(w, http.StatusServiceUnavailable, "Too many rooms")
+		return
+	}
+	room := makeRoom(request.Secret)
+	room.created = true
+	server.rooms[roomId] = room
+	server.created++
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (server *Server) post(w http.ResponseWriter, r *http.Request, roomId string, secret string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Cannot read message: "+err.Error())
+		return
+	}
+	if len(body) > maxMessageSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "Message too large")
+		return
+	}
+	if !json.Valid(body) {
+		writeError(w, http.StatusBadRequest, "Message is not valid JSON")
+		return
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	room, ok := server.openRoom(roomId, secret)
+	if !ok {
+		writeError(w, http.StatusForbidden, "Unknown room or wrong secret")
+		return
+	}
+
+	now := time.Now()
+	room.lastId++
+	room.messages = append(room.messages, Message{
+		Id:   room.lastId,
+		Time: now.Unix(),
+		Body: body,
+	})
+	room.prune(now, server.retention)
+
+	close(room.updated)
+	room.updated = make(chan struct{})
+
+	writeJson(w, http.StatusOK, &PostResponse{Id: room.lastId})
+}
+
+func (server *Server) poll(w http.ResponseWriter, r *http.Request, roomId string, secret string) {
+	query := r.URL.Query()
+
+	timeout := time.Duration(0)
+	if value := query.Get("timeout"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid timeout")
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > MaxPollTimeout {
+			timeout = MaxPollTimeout
+		}
+	}
+	deadline := time.After(timeout)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	room, ok := server.openRoom(roomId, secret)
+	if !ok {
+		writeError(w, http.StatusForbidden, "Unknown room or wrong secret")
+		return
+	}
+
+	// Without after only messages posted from now on are returned
+	after := room.lastId
+	if value := query.Get("after"); value != "" {
+		var err error
+		if after, err = strconv.ParseUint(value, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid after")
+			return
+		}
+	}
+
+	for {
+		response := PollResponse{Messages: []Message{}, LastId: after}
+		for _, message := range room.messages {
+			if message.Id > after {
+				response.Messages = append(response.Messages, message)
+				response.LastId = message.Id
+			}
+		}
+		if len(response.Messages) > 0 {
+			writeJson(w, http.StatusOK, &response)
+			return
+		}
+
+		updated := room.updated
+		server.mu.Unlock()
+		select {
+		case <-updated:
+			server.mu.Lock()
+		case <-deadline:
+			server.mu.Lock()
+			writeJson(w, http.StatusOK, &response)
+			return
+		case <-r.Context().Done():
+			server.mu.Lock()
+			return
+		}
+		room.lastUsed = time.Now()
+	}
+}
@@ -0,0 +1,113 @@
+package rendezvous
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func do(t *testing.T, method string, url string, token string, body string) *http.Response {
+	t.Helper()
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func startServer(t *testing.T, options *Options) *httptest.Server {
+	t.Helper()
+	server, err := MakeServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return httpServer
+}
+
+func TestConfiguredRoom(t *testing.T) {
+	server := startServer(t, &Options{Retention: time.Minute, Rooms: map[string]string{"hub": "hub-secret"}})
+	messages := server.URL + "/rooms/hub/messages"
+
+	response := do(t, http.MethodPost, messages, "hub-secret", `{"type":"request"}`)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Posting to the room: %s", response.Status)
+	}
+	response = do(t, http.MethodGet, messages+"?after=0", "hub-secret", "")
+	var poll PollResponse
+	if err := json.NewDecoder(response.Body).Decode(&poll); err != nil {
+		t.Fatal(err)
+	}
+	if len(poll.Messages) != 1 || string(poll.Messages[0].Body) != `{"type":"request"}` {
+		t.Fatalf("Polled %+v", poll)
+	}
+
+	if response = do(t, http.MethodPost, messages, "wrong", `{}`); response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Posting with a wrong secret: %s", response.Status)
+	}
+}
+
+func TestRoomsCannotBeSquatted(t *testing.T) {
+	server := startServer(t, &Options{Retention: time.Minute, Rooms: map[string]string{"hub": "hub-secret"}})
+
+	// Touching a room no longer makes it ours
+	if response := do(t, http.MethodPost, server.URL+"/rooms/other/messages", "mine", `{}`); response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Posting to an unknown room: %s", response.Status)
+	}
+	// Without an admin token nobody creates rooms
+	if response := do(t, http.MethodPut, server.URL+"/rooms/other", "", `{"secret":"0123456789abcdef"}`); response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Creating a room without a token: %s", response.Status)
+	}
+	if response := do(t, http.MethodPut, server.URL+"/rooms/other", "guess", `{"secret":"0123456789abcdef"}`); response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Creating a room without an admin token configured: %s", response.Status)
+	}
+}
+
+func TestCreateRoom(t *testing.T) {
+	server := startServer(t, &Options{Retention: time.Minute, AdminToken: "admin", MaxRooms: 2})
+	secret := `{"secret":"0123456789abcdef"}`
+
+	tests := []struct {
+		name   string
+		room   string
+		token  string
+		body   string
+		status int
+	}{
+		{"wrong admin token", "a", "nope", secret, http.StatusForbidden},
+		{"short secret", "a", "admin", `{"secret":"short"}`, http.StatusBadRequest},
+		{"created", "a", "admin", secret, http.StatusCreated},
+		{"exists", "a", "admin", secret, http.StatusConflict},
+		{"second", "b", "admin", secret, http.StatusCreated},
+		{"over the limit", "c", "admin", secret, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		response := do(t, http.MethodPut, server.URL+"/rooms/"+test.room, test.token, test.body)
+		if response.StatusCode != test.status {
+			t.Errorf("%s: got %s, want %d", test.name, response.Status, test.status)
+		}
+	}
+
+	if response := do(t, http.MethodPost, server.URL+"/rooms/a/messages", "0123456789abcdef", `{}`); response.StatusCode != http.StatusOK {
+		t.Fatalf("Posting to the created room: %s", response.Status)
+	}
+}
+
+func TestMakeServerChecksRooms(t *testing.T) {
+	if _, err := MakeServer(&Options{Rooms: map[string]string{"bad/id": "secret"}}); err == nil {
+		t.Error("Want an error for an invalid room ID")
+	}
+	if _, err := MakeServer(&Options{Rooms: map[string]string{"hub": ""}}); err == nil {
+		t.Error("Want an error for an empty secret")
+	}
+}
@@ -0,0 +1,113 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"strings"
+)
+
+const (
+	// Messages without a version come from peers predating versioning
+	legacyVersion = 1
+	// Version 2 introduced the session lifecycle and capabilities
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2
+)
+
+// Capabilities are "<kind>/<name>" strings. Only what this build actually
+// implements is advertised. Whether messages are sealed is not negotiated:
+// peers that disagree on it cannot read each other's capabilities anyway.
+const (
+	CapStrategyUdpPunch = "strategy/udp-punch"
+	CapTransportUdp     = "transport/udp"
+)
+
+// Kinds the peers must agree on, at least one of each
+var requiredKinds = []string{"strategy", "transport"}
+
+// What both peers support, picked by Negotiate
+type Features struct {
+	Strategy  string
+	Transport string
+}
+
+func (features *Features) String() string {
+	return fmt.Sprintf("strategy %s, transport %s", features.Strategy, features.Transport)
+}
+
+// The capabilities of this build, most preferred first within every kind
+func LocalCapabilities() []string {
+	return []string{CapStrategyUdpPunch, CapTransportUdp}
+}
+
+func MessageVersion(msg *common.HubMessage) int {
+	if msg.Version == 0 {
+		return legacyVersion
+	}
+	return msg.Version
+}
+
+// Tells the peer what to do about a version we cannot talk to. Newer
+// peers are expected to talk our version.
+func CheckVersion(msg *common.HubMessage) error {
+	if version := MessageVersion(msg); version < MinProtocolVersion {
+		return errors.New(fmt.Sprintf("Protocol version %d is not supported any more, please upgrade to version %d or newer", version, MinProtocolVersion))
+	}
+	return nil
+}
+
+func kind(capability string) string {
+	if kind, _, ok := strings.Cut(capability, "/"); ok {
+		return kind
+	}
+	return ""
+}
+
+func contains(list []string, item string) bool {
+	for _, candidate := range list {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
+
+// Picks the best common features. The client's order of preference wins,
+// so both sides arrive at the same result given the same lists.
+// Capabilities of unknown kinds are ignored.
+func Negotiate(client []string, server []string) (*Features, error) {
+	chosen := make(map[string]string)
+	for _, capability := range client {
+		if !contains(server, capability) {
+			continue
+		}
+		if k := kind(capability); k != "" && chosen[k] == "" {
+			chosen[k] = strings.TrimPrefix(capability, k+"/")
+		}
+	}
+
+	for _, k := range requiredKinds {
+		if chosen[k] == "" {
+			return nil, errors.New(fmt.Sprintf("No common %s: the client supports %s, the server supports %s",
+				k, strings.Join(ofKind(client, k), ", "), strings.Join(ofKind(server, k), ", ")))
+		}
+	}
+	return &Features{
+		Strategy:  chosen["strategy"],
+		Transport: chosen["transport"],
+	}, nil
+}
+
+func ofKind(capabilities []string, k string) []string {
+	result := []string{}
+	for _, capability := range capabilities {
+		if kind(capability) == k {
+			result = append(result, capability)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, "nothing")
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   []string
+		server   []string
+		features *Features
+	}{
+		{
+			"this build",
+			LocalCapabilities(),
+			LocalCapabilities(),
+			&Features{Strategy: "udp-punch", Transport: "udp"},
+		},
+		{
+			"the client's preference wins",
+			[]string{"strategy/relay", "strategy/udp-punch", "transport/udp"},
+			[]string{"strategy/udp-punch", "strategy/relay", "transport/udp"},
+			&Features{Strategy: "relay", Transport: "udp"},
+		},
+		{
+			"unknown capabilities",
+			[]string{"ipv6", "strategy/udp-punch", "transport/udp", "encryption/e2e-v1"},
+			[]string{"strategy/udp-punch", "ipv6", "transport/udp", "encryption/e2e-v1"},
+			&Features{Strategy: "udp-punch", Transport: "udp"},
+		},
+		{
+			"no common strategy",
+			[]string{"strategy/relay", "transport/udp"},
+			[]string{"strategy/udp-punch", "transport/udp"},
+			nil,
+		},
+		{
+			"no transport",
+			[]string{"strategy/udp-punch"},
+			LocalCapabilities(),
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			features, err := Negotiate(test.client, test.server)
+			if test.features == nil {
+				if err == nil {
+					t.Fatalf("Got %v, want an error", features)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *features != *test.features {
+				t.Fatalf("Got %v, want %v", features, test.features)
+			}
+		})
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	if err := CheckVersion(&common.HubMessage{}); err == nil {
+		t.Fatal("Accepted a message without a version")
+	}
+	if err := CheckVersion(&common.HubMessage{Version: ProtocolVersion}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckVersion(&common.HubMessage{Version: ProtocolVersion + 1}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,353 @@
+// Package session implements the punching session lifecycle shared by the
+// client and the server:
+//
+//	client                          server
+//	start_punching_request    ->
+//	                          <-    start_punching_ack
+//	                          <-    start_punching_response
+//	                                (or start_punching_reject/_error)
+//	client_punching_report    <->   server_punching_report
+//
+// The client may send start_punching_cancel at any time before the
+// session is over, and either side gives up when its timeout expires.
+//
+// Only the peer takes part in a session: messages from anyone else are
+// refused, and so are messages signed by another key than the one the
+// peer's first sealed message came with.
+package session
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"sync"
+)
+
+// Hub message types
+const (
+	TypeRequest  = "start_punching_request"
+	TypeAck      = "start_punching_ack"
+	TypeResponse = "start_punching_response"
+	TypeReject   = "start_punching_reject"
+	TypeError    = "start_punching_error"
+	TypeCancel   = "start_punching_cancel"
+	// Outcome of punching, an empty Error field means success
+	TypeClientReport = "client_punching_report"
+	TypeServerReport = "server_punching_report"
+)
+
+type Role int
+
+const (
+	Client Role = iota
+	Server
+)
+
+func (role Role) String() string {
+	switch role {
+	case Client:
+		return "client"
+	case Server:
+		return "server"
+	}
+	return fmt.Sprintf("Role(%d)", int(role))
+}
+
+type State int
+
+const (
+	Idle State = iota
+	Requested
+	Acknowledged
+	Punching
+	Succeeded
+	Failed
+	Rejected
+	Cancelled
+	TimedOut
+)
+
+func (state State) String() string {
+	switch state {
+	case Idle:
+		return "idle"
+	case Requested:
+		return "requested"
+	case Acknowledged:
+		return "acknowledged"
+	case Punching:
+		return "punching"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Rejected:
+		return "rejected"
+	case Cancelled:
+		return "cancelled"
+	case TimedOut:
+		return "timed out"
+	}
+	return fmt.Sprintf("State(%d)", int(state))
+}
+
+func (state State) Terminal() bool {
+	return state >= Succeeded
+}
+
+// Every message type has a single sender, which also tells our own
+// messages echoed back by the signaler from the peer's ones
+var sentBy = map[string]Role{
+	TypeRequest:      Client,
+	TypeAck:          Server,
+	TypeResponse:     Server,
+	TypeReject:       Server,
+	TypeError:        Server,
+	TypeCancel:       Client,
+	TypeClientReport: Client,
+	TypeServerReport: Server,
+}
+
+// Outcome reports are not here: our own report ends the session, while
+// the peer's one is just recorded
+var transitions = map[State]map[string]State{
+	Idle: {
+		TypeRequest: Requested,
+	},
+	Requested: {
+		TypeAck:      Acknowledged,
+		TypeResponse: Punching,
+		TypeReject:   Rejected,
+		TypeError:    Failed,
+		TypeCancel:   Cancelled,
+	},
+	Acknowledged: {
+		TypeResponse: Punching,
+		TypeReject:   Rejected,
+		TypeError:    Failed,
+		TypeCancel:   Cancelled,
+	},
+	Punching: {
+		TypeError:  Failed,
+		TypeCancel: Cancelled,
+	},
+}
+
+// Tells who sends messages of the type, false if the type does not belong
+// to the session protocol
+func Sender(msgType string) (Role, bool) {
+	role, ok := sentBy[msgType]
+	return role, ok
+}
+
+func (role Role) report() string {
+	if role == Client {
+		return TypeClientReport
+	}
+	return TypeServerReport
+}
+
+type Session struct {
+	Role   Role
+	Serial uint64
+	// Our peer name and the other side's one
+	Name string
+	Peer string
+	// Sent along with every message
+	Capabilities []string
+
+	mu    sync.Mutex
+	state State
+	err   error
+	// The key the peer signs with, nil until its first sealed message
+	peerKey *e2e.PublicKey
+	// Closed when the peer reports its outcome
+	peerReported chan struct{}
+	peerErr      error
+}
+
+func New(role Role, serial uint64, name string, peer string) *Session {
+	return &Session{
+		Role:         role,
+		Serial:       serial,
+		Name:         name,
+		Peer:         peer,
+		peerReported: make(chan struct{}),
+	}
+}
+
+func (session *Session) State() State {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.state
+}
+
+// Why the session did not succeed, nil while it is running or if it did
+func (session *Session) Err() error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.err
+}
+
+// Must be called with the lock held
+func (session *Session) transition(msgType string, reason string, remote bool) error {
+	next, ok := transitions[session.state][msgType]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unexpected %s in %s state", msgType, session.state))
+	}
+	session.state = next
+
+	switch {
+	case next == Rejected:
+		session.err = errors.New("Request rejected: " + reason)
+	case next == Cancelled && remote:
+		session.err = errors.New("Cancelled by the " + session.Role.peer().String() + ": " + reason)
+	case next == Cancelled:
+		session.err = errors.New("Cancelled: " + reason)
+	case next == Failed && remote:
+		session.err = errors.New("The " + session.Role.peer().String() + " failed: " + reason)
+	case next == Failed:
+		session.err = errors.New(reason)
+	}
+	return nil
+}
+
+func (role Role) peer() Role {
+	if role == Client {
+		return Server
+	}
+	return Client
+}
+
+// Advances the session by a message we are about to send and returns the
+// message. The reason goes into the Error field.
+func (session *Session) Send(msgType string, reason string) (*common.HubMessage, error) {
+	if role, ok := sentBy[msgType]; !ok || role != session.Role || msgType == session.Role.report() {
+		return nil, errors.New("The " + session.Role.String() + " cannot send " + msgType)
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if err := session.transition(msgType, reason, false); err != nil {
+		return nil, err
+	}
+	return session.message(msgType, reason), nil
+}
+
+// Advances the session by a message from the peer
+func (session *Session) Receive(msg *common.HubMessage) error {
+	if msg.Serial != session.Serial {
+		return errors.New(fmt.Sprintf("Message for session %d delivered to session %d", msg.Serial, session.Serial))
+	}
+	role, ok := sentBy[msg.Type]
+	if !ok || role != session.Role.peer() {
+		return errors.New("The " + session.Role.peer().String() + " cannot send " + msg.Type)
+	}
+	if msg.From != session.Peer {
+		return errors.New(fmt.Sprintf("%s from %q in a session with %q", msg.Type, msg.From, session.Peer))
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.peerKey != nil && (msg.SenderKey == nil || !bytes.Equal(msg.SenderKey.SignKey, session.peerKey.SignKey)) {
+		return errors.New(fmt.Sprintf("%s not signed by the key of %q", msg.Type, session.Peer))
+	}
+	err := session.receive(msg)
+	if err == nil && session.peerKey == nil {
+		session.peerKey = msg.SenderKey
+	}
+	return err
+}
+
+// Must be called with the lock held
+func (session *Session) receive(msg *common.HubMessage) error {
+	if msg.Type == session.Role.peer().report() {
+		if session.state != Punching && !session.state.Terminal() {
+			return errors.New(fmt.Sprintf("Unexpected %s in %s state", msg.Type, session.state))
+		}
+		select {
+		case <-session.peerReported:
+			return errors.New("The " + session.Role.peer().String() + " has reported already")
+		default:
+		}
+		if msg.Error != "" {
+			session.peerErr = errors.New(msg.Error)
+		}
+		close(session.peerReported)
+		return nil
+	}
+
+	return session.transition(msg.Type, msg.Error, true)
+}
+
+// Ends the punching stage with its outcome and returns the report for the
+// peer
+func (session *Session) Report(punchErr error) (*common.HubMessage, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.state != Punching {
+		return nil, errors.New(fmt.Sprintf("Cannot report the outcome in %s state", session.state))
+	}
+	msg := session.message(session.Role.report(), "")
+	if punchErr != nil {
+		session.state = Failed
+		session.err = punchErr
+		msg.Error = punchErr.Error()
+	} else {
+		session.state = Succeeded
+	}
+	return msg, nil
+}
+
+// Ends a running session that took too long. Returns a message telling the
+// peer about it, nil if the session is over already.
+func (session *Session) Timeout() *common.HubMessage {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.state.Terminal() {
+		return nil
+	}
+	msgType := TypeError
+	if session.Role == Client {
+		msgType = TypeCancel
+	}
+	session.state = TimedOut
+	session.err = errors.New("Session timed out")
+	return session.message(msgType, "timed out")
+}
+
+func (session *Session) message(msgType string, reason string) *common.HubMessage {
+	return &common.HubMessage{
+		Version:      ProtocolVersion,
+		Capabilities: session.Capabilities,
+		Type:         msgType,
+		Serial:       session.Serial,
+		From:         session.Name,
+		To:           session.Peer,
+		Error:        reason,
+	}
+}
+
+// A one-line summary suitable for replacing the session's posts
+func (session *Session) Status() string {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return fmt.Sprintf("tgpunch session %d: %s", session.Serial, session.state)
+}
+
+// Closed when the peer reports the outcome of punching
+func (session *Session) PeerReported() <-chan struct{} {
+	return session.peerReported
+}
+
+// The peer's outcome, valid once PeerReported is closed
+func (session *Session) PeerErr() error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.peerErr
+}
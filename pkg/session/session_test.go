@@ -0,0 +1,98 @@
+package session
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"testing"
+)
+
+func generateKey(t *testing.T, name string) *e2e.PublicKey {
+	t.Helper()
+	identity, err := e2e.GenerateIdentity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity.Public()
+}
+
+// Returns a server session that has received a request from the client
+func requested(t *testing.T, key *e2e.PublicKey) *Session {
+	t.Helper()
+	client := New(Client, 1, "client", "server")
+	request, err := client.Send(TypeRequest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.SenderKey = key
+
+	server := New(Server, 1, "server", request.From)
+	if err = server.Receive(request); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestReceiveAcceptsOnlyThePeer(t *testing.T) {
+	clientKey := generateKey(t, "client")
+	otherKey := generateKey(t, "other")
+
+	tests := []struct {
+		name       string
+		requestKey *e2e.PublicKey
+		from       string
+		key        *e2e.PublicKey
+		ok         bool
+	}{
+		{"the peer", nil, "client", nil, true},
+		{"someone else", nil, "other", nil, false},
+		{"nameless", nil, "", nil, false},
+		{"the peer, sealed", clientKey, "client", clientKey, true},
+		{"the peer's name, another key", clientKey, "client", otherKey, false},
+		{"the peer's name, not sealed", clientKey, "client", nil, false},
+		{"someone else, sealed", clientKey, "other", otherKey, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := requested(t, test.requestKey)
+			cancel := &common.HubMessage{
+				Type:      TypeCancel,
+				Serial:    1,
+				From:      test.from,
+				SenderKey: test.key,
+			}
+			err := server.Receive(cancel)
+			if test.ok && (err != nil || server.State() != Cancelled) {
+				t.Fatalf("Got %v in %s state, want the session cancelled", err, server.State())
+			}
+			if !test.ok && (err == nil || server.State() != Requested) {
+				t.Fatalf("Got %v in %s state, want the cancel refused", err, server.State())
+			}
+		})
+	}
+}
+
+func TestReceiveBindsTheFirstKey(t *testing.T) {
+	serverKey := generateKey(t, "server")
+	otherKey := generateKey(t, "other")
+
+	client := New(Client, 1, "client", "server")
+	if _, err := client.Send(TypeRequest, ""); err != nil {
+		t.Fatal(err)
+	}
+	server := New(Server, 1, "server", "client")
+
+	ack := server.message(TypeAck, "")
+	ack.SenderKey = serverKey
+	if err := client.Receive(ack); err != nil {
+		t.Fatal(err)
+	}
+	reject := server.message(TypeReject, "go away")
+	reject.SenderKey = otherKey
+	if err := client.Receive(reject); err == nil {
+		t.Fatal("Accepted a reject signed by another key")
+	}
+	reject.SenderKey = serverKey
+	if err := client.Receive(reject); err != nil || client.State() != Rejected {
+		t.Fatalf("Got %v in %s state, want the request rejected", err, client.State())
+	}
+}
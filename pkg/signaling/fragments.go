@@ -0,0 +1,154 @@
+package signaling
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A hub message too long for one post is split into fragments that look
+// like "#<id>:<index>/<count>:<part>"
+const (
+	FragmentPrefix = "#"
+
+	maxFragments       = 32
+	maxPendingMessages = 64
+	fragmentTimeout    = 5 * time.Minute
+)
+
+// Cuts the text into posts of at most maxLength characters. Text that fits
+// is returned as is.
+func splitText(text string, maxLength int) ([]string, error) {
+	runes := []rune(text)
+	if len(runes) <= maxLength {
+		return []string{text}, nil
+	}
+
+	idBytes := make([]byte, 4)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	// The header never gets longer than with two-digit numbers
+	partLength := maxLength - len(fmt.Sprintf("%s%s:%d/%d:", FragmentPrefix, id, maxFragments, maxFragments))
+	if partLength < 1 {
+		return nil, errors.New(fmt.Sprintf("Posts of %d characters are too short for fragments", maxLength))
+	}
+	count := (len(runes) + partLength - 1) / partLength
+	if count > maxFragments {
+		return nil, errors.New(fmt.Sprintf("Hub message of %d characters is too long even for %d posts", len(runes), maxFragments))
+	}
+
+	fragments := make([]string, count)
+	for i := range fragments {
+		end := (i + 1) * partLength
+		if end > len(runes) {
+			end = len(runes)
+		}
+		fragments[i] = fmt.Sprintf("%s%s:%d/%d:%s", FragmentPrefix, id, i, count, string(runes[i*partLength:end]))
+	}
+	return fragments, nil
+}
+
+type pendingMessage struct {
+	parts    []string
+	received int
+	started  time.Time
+}
+
+// Fragments only make up a message together if they come from the same
+// sender in the same chat, so that nobody can slip parts into the message
+// of somebody else
+type fragmentKey struct {
+	chatId   int64
+	senderId int // zero for channel posts
+	id       string
+}
+
+// Collects fragments until a message is complete. Incomplete messages are
+// forgotten after a while.
+type reassembler struct {
+	mu      sync.Mutex
+	pending map[fragmentKey]*pendingMessage
+}
+
+func parseFragment(text string) (string, int, int, string, error) {
+	header := strings.SplitN(strings.TrimPrefix(text, FragmentPrefix), ":", 3)
+	if len(header) != 3 {
+		return "", 0, 0, "", errors.New("Malformed fragment header")
+	}
+	indexText, countText, ok := strings.Cut(header[1], "/")
+	if !ok {
+		return "", 0, 0, "", errors.New("Malformed fragment header")
+	}
+	index, err := strconv.Atoi(indexText)
+	if err != nil {
+		return "", 0, 0, "", errors.New("Malformed fragment index")
+	}
+	count, err := strconv.Atoi(countText)
+	if err != nil || count < 1 || count > maxFragments || index < 0 || index >= count {
+		return "", 0, 0, "", errors.New("Bad fragment count or index")
+	}
+	return header[0], index, count, header[2], nil
+}
+
+// Returns the whole text once the last missing fragment arrives, an empty
+// string before that
+func (r *reassembler) add(chatId int64, senderId int, fragment string) (string, error) {
+	id, index, count, part, err := parseFragment(fragment)
+	if err != nil {
+		return "", err
+	}
+	key := fragmentKey{chatId: chatId, senderId: senderId, id: id}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.pending == nil {
+		r.pending = make(map[fragmentKey]*pendingMessage)
+	}
+	var oldest fragmentKey
+	var oldestStarted time.Time
+	for pendingKey, message := range r.pending {
+		if now.Sub(message.started) > fragmentTimeout {
+			delete(r.pending, pendingKey)
+			continue
+		}
+		if pendingKey.chatId == chatId && pendingKey.id == id && pendingKey.senderId != senderId {
+			return "", errors.New("Fragment of " + id + " comes from another sender")
+		}
+		if oldestStarted.IsZero() || message.started.Before(oldestStarted) {
+			oldest, oldestStarted = pendingKey, message.started
+		}
+	}
+
+	message, ok := r.pending[key]
+	if !ok {
+		if len(r.pending) >= maxPendingMessages {
+			delete(r.pending, oldest)
+		}
+		message = &pendingMessage{parts: make([]string, count), started: now}
+		r.pending[key] = message
+	}
+	if len(message.parts) != count {
+		return "", errors.New("Fragment count does not match earlier fragments of " + id)
+	}
+	if message.parts[index] != "" {
+		return "", nil
+	}
+	message.parts[index] = part
+	message.received++
+
+	if message.received < count {
+		return "", nil
+	}
+	delete(r.pending, key)
+	return strings.Join(message.parts, ""), nil
+}
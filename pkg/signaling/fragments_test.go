@@ -0,0 +1,189 @@
+package signaling
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Sender of the fragments in tests
+const testSenderId = 7
+
+func reassemble(t *testing.T, r *reassembler, fragments []string) string {
+	t.Helper()
+	var whole string
+	for i, fragment := range fragments {
+		text, err := r.add(testChannelId, testSenderId, fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text != "" && i != len(fragments)-1 {
+			t.Fatalf("Message complete after %d of %d fragments", i+1, len(fragments))
+		}
+		whole = text
+	}
+	return whole
+}
+
+func TestSplitAndReassemble(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		maxLength int
+	}{
+		{"fits", strings.Repeat("a", 100), 100},
+		{"just over", strings.Repeat("a", 101), 100},
+		{"many parts", strings.Repeat("abcdefghij", 200), 100},
+		// Limits count characters, not bytes
+		{"multibyte", strings.Repeat("ж😀", 300), 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fragments, err := splitText(test.text, test.maxLength)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fragments) == 1 {
+				if fragments[0] != test.text {
+					t.Fatal("Text that fits was changed")
+				}
+				return
+			}
+			for _, fragment := range fragments {
+				if length := utf8.RuneCountInString(fragment); length > test.maxLength {
+					t.Fatalf("Fragment of %d characters, the limit is %d", length, test.maxLength)
+				}
+			}
+
+			// Posts may arrive in any order, and some twice
+			rand.Shuffle(len(fragments), func(i, j int) {
+				fragments[i], fragments[j] = fragments[j], fragments[i]
+			})
+			var r reassembler
+			if _, err = r.add(testChannelId, testSenderId, fragments[0]); err != nil {
+				t.Fatal(err)
+			}
+			if whole := reassemble(t, &r, fragments); whole != test.text {
+				t.Fatal("Reassembled text differs from the original")
+			}
+		})
+	}
+}
+
+func TestSplitRefusesImpossibleLimits(t *testing.T) {
+	if _, err := splitText(strings.Repeat("a", 100*maxFragments), 100); err == nil {
+		t.Fatal("Split a text needing more than the maximum of fragments")
+	}
+	if _, err := splitText(strings.Repeat("a", 100), 10); err == nil {
+		t.Fatal("Split into posts too short for the fragment header")
+	}
+}
+
+func TestReassemblerRejectsBadFragments(t *testing.T) {
+	fragments, err := splitText(strings.Repeat("a", 300), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := fragments[0]
+
+	bad := []string{
+		"#",
+		"#id",
+		"#id:0:text",
+		"#id:x/2:text",
+		"#id:0/x:text",
+		"#id:2/2:text",
+		"#id:-1/2:text",
+		"#id:0/0:text",
+		"#id:0/33:text",
+		// Truncated in the header
+		valid[:len(FragmentPrefix)+10],
+	}
+	var r reassembler
+	for _, fragment := range bad {
+		if _, err := r.add(testChannelId, testSenderId, fragment); err == nil {
+			t.Fatalf("Accepted fragment %q", fragment)
+		}
+	}
+
+	if _, err = r.add(testChannelId, testSenderId, "#id:0/2:a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.add(testChannelId, testSenderId, "#id:1/3:b"); err == nil {
+		t.Fatal("Accepted a fragment disagreeing on the count")
+	}
+}
+
+func TestReassemblerKeepsSendersApart(t *testing.T) {
+	fragments, err := splitText(strings.Repeat("a", 300), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r reassembler
+	if _, err = r.add(testChannelId, testSenderId, fragments[0]); err != nil {
+		t.Fatal(err)
+	}
+	forged := fragments[1][:strings.LastIndex(fragments[1], ":")+1] + strings.Repeat("b", 10)
+	if _, err = r.add(testChannelId, testSenderId+1, forged); err == nil {
+		t.Fatal("Accepted a fragment from another sender")
+	}
+	// The same ID in another chat is another message
+	if _, err = r.add(testChannelId-1, testSenderId+1, forged); err != nil {
+		t.Fatal(err)
+	}
+	if whole := reassemble(t, &r, fragments[1:]); whole != strings.Repeat("a", 300) {
+		t.Fatal("Reassembled text differs from the original")
+	}
+}
+
+func TestReassemblerForgetsOldestMessages(t *testing.T) {
+	var r reassembler
+	for i := 0; i < 2*maxPendingMessages; i++ {
+		fragments, err := splitText(strings.Repeat("a", 300), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = r.add(testChannelId, testSenderId, fragments[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(r.pending) > maxPendingMessages {
+		t.Fatalf("%d incomplete messages kept", len(r.pending))
+	}
+}
+
+// Posts come from anyone in the chat, so no fragment may crash the reader
+func FuzzReassembler(f *testing.F) {
+	f.Add("#id:0/2:abc", "#id:1/2:def")
+	f.Add("#id:0/1:", "#:0/1:x")
+	f.Fuzz(func(t *testing.T, first string, second string) {
+		var r reassembler
+		r.add(testChannelId, testSenderId, first)
+		r.add(testChannelId, testSenderId, second)
+	})
+}
+
+func FuzzSplitText(f *testing.F) {
+	f.Add(strings.Repeat("a", 1000), 100)
+	f.Add("ж😀", 1)
+	f.Fuzz(func(t *testing.T, text string, maxLength int) {
+		if !utf8.ValidString(text) {
+			return
+		}
+		fragments, err := splitText(text, maxLength)
+		if err != nil {
+			return
+		}
+		if len(fragments) == 1 {
+			if fragments[0] != text {
+				t.Fatal("Text that fits was changed")
+			}
+			return
+		}
+		var r reassembler
+		if whole := reassemble(t, &r, fragments); whole != text {
+			t.Fatal("Reassembled text differs from the original")
+		}
+	})
+}
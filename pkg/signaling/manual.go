@@ -0,0 +1,127 @@
+package signaling
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Every token starts with this, so that stray input is easy to tell apart
+const ManualTokenPrefix = "TGP1-"
+
+// Lets the operator carry hub messages between the peers by hand. Published
+// messages are printed as tokens, and tokens pasted from the other side are
+// read line by line.
+type Manual struct {
+	broadcaster
+	in       io.Reader
+	out      io.Writer
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func MakeManual(in io.Reader, out io.Writer) *Manual {
+	return &Manual{in: in, out: out, stop: make(chan struct{})}
+}
+
+// Packs the message into base64 with a CRC-32 appended, which catches
+// tokens mangled while being copied
+func EncodeToken(msg *common.HubMessage) (string, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	body = binary.BigEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+	return ManualTokenPrefix + base64.RawURLEncoding.EncodeToString(body), nil
+}
+
+// Whitespace inside the token is ignored since chat apps like to wrap long
+// words
+func DecodeToken(token string) (*common.HubMessage, error) {
+	token = strings.Join(strings.Fields(token), "")
+	if !strings.HasPrefix(token, ManualTokenPrefix) {
+		return nil, errors.New("Not a tgpunch token")
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, ManualTokenPrefix))
+	if err != nil {
+		return nil, errors.New("Token is damaged: " + err.Error())
+	}
+	if len(body) < 4 {
+		return nil, errors.New("Token is too short")
+	}
+	body, checksum := body[:len(body)-4], binary.BigEndian.Uint32(body[len(body)-4:])
+	if crc32.ChecksumIEEE(body) != checksum {
+		return nil, errors.New("Token checksum mismatch, was it copied completely?")
+	}
+
+	var msg common.HubMessage
+	if err = json.Unmarshal(body, &msg); err != nil {
+		return nil, errors.New("Cannot parse token: " + err.Error())
+	}
+	return &msg, nil
+}
+
+func (signaler *Manual) Publish(msg *common.HubMessage) error {
+	token, err := EncodeToken(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(signaler.out, "Pass this token to the other side:\n\n%s\n\n", token)
+	if err != nil {
+		return err
+	}
+	signaler.dispatch(msg)
+	return nil
+}
+
+func (signaler *Manual) Subscribe(filter Filter) *Subscription {
+	return signaler.subscribe(filter)
+}
+
+func (signaler *Manual) Observe(observer Observer) {
+	signaler.observe(observer)
+}
+
+// A pending read of the input cannot be interrupted, so Run only notices
+// after the next line
+func (signaler *Manual) Close() error {
+	signaler.stopOnce.Do(func() { close(signaler.stop) })
+	signaler.close()
+	return nil
+}
+
+// Reads tokens until the input ends, then closes the signaler
+func (signaler *Manual) Run() error {
+	defer signaler.Close()
+
+	fmt.Fprintln(signaler.out, "Paste tokens from the other side here, one per line")
+	scanner := bufio.NewScanner(signaler.in)
+	for scanner.Scan() {
+		select {
+		case <-signaler.stop:
+			return nil
+		default:
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		msg, err := DecodeToken(line)
+		if err != nil {
+			fmt.Fprintln(signaler.out, "Cannot read token: "+err.Error())
+			continue
+		}
+		signaler.dispatch(msg)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,239 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/matrixapi"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Custom event type carrying a HubMessage as its content
+	MatrixEventType = "org.tgpunch.hub_message"
+
+	matrixSyncTimeout    = 30 * time.Second
+	matrixRequestTimeout = 10 * time.Second
+)
+
+var matrixTxnCounter uint64
+
+// Exchanges hub messages as custom events in a Matrix room
+type Matrix struct {
+	broadcaster
+	client        *http.Client
+	homeserverUrl string
+	accessToken   string
+	roomId        string
+	stop          chan struct{}
+	stopOnce      sync.Once
+
+	mu sync.Mutex
+	// Sync token of the last /sync, empty before the first one
+	since string
+	// Our first event, if published before the first sync. The initial
+	// sync delivers it and everything after it instead of skipping the
+	// room history altogether.
+	firstEventId string
+
+	// Called by Run with the since token of every sync once its events are
+	// handed to the subscriptions. Returning an error stops Run.
+	OnSync func(since string) error
+}
+
+func MakeMatrix(client *http.Client, homeserverUrl string, accessToken string, roomId string) *Matrix {
+	return &Matrix{
+		client:        client,
+		homeserverUrl: strings.TrimSuffix(homeserverUrl, "/"),
+		accessToken:   accessToken,
+		roomId:        roomId,
+		stop:          make(chan struct{}),
+	}
+}
+
+func (signaler *Matrix) do(request *http.Request, result interface{}) error {
+	request.Header.Set("Authorization", "Bearer "+signaler.accessToken)
+
+	response, err := signaler.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var apiErr matrixapi.Error
+		if json.NewDecoder(response.Body).Decode(&apiErr) != nil || apiErr.ErrCode == "" {
+			return errors.New("Matrix homeserver error: " + response.Status)
+		}
+		return &apiErr
+	}
+
+	if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+		return errors.New("Cannot decode Matrix homeserver response: " + err.Error())
+	}
+	return nil
+}
+
+// Continues from the since token of an earlier Run, e.g. one saved by
+// OnSync before a restart. Must be called before Run.
+func (signaler *Matrix) Resume(since string) {
+	signaler.mu.Lock()
+	defer signaler.mu.Unlock()
+	signaler.since = since
+}
+
+func (signaler *Matrix) Publish(msg *common.HubMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	txnId := fmt.Sprintf("tgpunch-%d-%d", time.Now().UnixNano(), atomic.AddUint64(&matrixTxnCounter, 1))
+	requestUrl := signaler.homeserverUrl + matrixapi.ClientApiPrefix +
+		"/rooms/" + url.PathEscape(signaler.roomId) +
+		"/send/" + url.PathEscape(MatrixEventType) +
+		"/" + url.PathEscape(txnId)
+
+	ctx, cancel := context.WithTimeout(context.Background(), matrixRequestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, requestUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	var response matrixapi.SendResponse
+	if err = signaler.do(request, &response); err != nil {
+		return err
+	}
+
+	signaler.mu.Lock()
+	if signaler.since == "" && signaler.firstEventId == "" {
+		signaler.firstEventId = response.EventId
+	}
+	signaler.mu.Unlock()
+	return nil
+}
+
+func (signaler *Matrix) Subscribe(filter Filter) *Subscription {
+	return signaler.subscribe(filter)
+}
+
+func (signaler *Matrix) Observe(observer Observer) {
+	signaler.observe(observer)
+}
+
+func (signaler *Matrix) Close() error {
+	signaler.stopOnce.Do(func() { close(signaler.stop) })
+	signaler.close()
+	return nil
+}
+
+func (signaler *Matrix) syncFilter() string {
+	filter, _ := json.Marshal(&matrixapi.Filter{
+		Room: matrixapi.RoomFilter{
+			Rooms: []string{signaler.roomId},
+			Timeline: matrixapi.RoomEventFilter{
+				Types: []string{MatrixEventType},
+				Limit: 50,
+			},
+		},
+		Presence:    &matrixapi.EventFilter{Types: []string{}},
+		AccountData: &matrixapi.EventFilter{Types: []string{}},
+	})
+	return string(filter)
+}
+
+// Long polls /sync until Close is called or the homeserver fails. Like
+// getUpdates with an offset, every sync continues from the since token
+// returned by the previous one.
+func (signaler *Matrix) Run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-signaler.stop
+		cancel()
+	}()
+
+	filter := signaler.syncFilter()
+	for {
+		signaler.mu.Lock()
+		since := signaler.since
+		signaler.mu.Unlock()
+
+		query := url.Values{"filter": {filter}}
+		if since != "" {
+			query.Set("since", since)
+			query.Set("timeout", strconv.FormatInt(matrixSyncTimeout.Milliseconds(), 10))
+		}
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, signaler.homeserverUrl+matrixapi.ClientApiPrefix+"/sync?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+
+		var response matrixapi.SyncResponse
+		err = signaler.do(request, &response)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		signaler.mu.Lock()
+		initial := signaler.since == ""
+		firstEventId := signaler.firstEventId
+		signaler.since = response.NextBatch
+		signaler.mu.Unlock()
+
+		events := response.Rooms.Join[signaler.roomId].Timeline.Events
+		if initial {
+			events = eventsSince(events, firstEventId)
+		}
+		for i := range events {
+			signaler.handleEvent(&events[i])
+		}
+		if signaler.OnSync != nil {
+			if err = signaler.OnSync(response.NextBatch); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Returns the events starting from the one with the given ID, or none
+func eventsSince(events []matrixapi.Event, eventId string) []matrixapi.Event {
+	if eventId == "" {
+		return nil
+	}
+	for i := range events {
+		if events[i].EventId == eventId {
+			return events[i:]
+		}
+	}
+	return nil
+}
+
+func (signaler *Matrix) handleEvent(event *matrixapi.Event) {
+	if event.Type != MatrixEventType {
+		return
+	}
+	fmt.Println("Got Matrix event: " + string(event.Content))
+
+	var msg common.HubMessage
+	if err := json.Unmarshal(event.Content, &msg); err != nil {
+		fmt.Println("Cannot parse hub message: " + err.Error())
+		return
+	}
+	signaler.dispatch(&msg)
+}
@@ -0,0 +1,64 @@
+package signaling
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/matrixtest"
+	"net/http"
+	"testing"
+)
+
+const testRoomId = "!hub:example.org"
+
+func startMatrix(homeserver *matrixtest.Homeserver, since string, synced chan<- string) (*Matrix, *Subscription) {
+	signaler := MakeMatrix(http.DefaultClient, homeserver.URL, "server-token", testRoomId)
+	if since != "" {
+		signaler.Resume(since)
+	}
+	signaler.OnSync = func(since string) error {
+		synced <- since
+		return nil
+	}
+	sub := signaler.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.Type == "request"
+	})
+	go signaler.Run()
+	return signaler, sub
+}
+
+func TestMatrixRoundTripAndResume(t *testing.T) {
+	homeserver := matrixtest.NewHomeserver()
+	defer homeserver.Close()
+	homeserver.AddUser("@server:example.org", "server-token")
+	homeserver.AddUser("@client:example.org", "client-token")
+	homeserver.CreateRoom(testRoomId, "@server:example.org", "@client:example.org")
+
+	// History from before the server started is not replayed
+	homeserver.SendEvent(testRoomId, "@client:example.org", MatrixEventType, []byte(`{"type":"request","serial":100}`))
+
+	synced := make(chan string, 16)
+	receiver, sub := startMatrix(homeserver, "", synced)
+	since := <-synced
+
+	publisher := MakeMatrix(http.DefaultClient, homeserver.URL, "client-token", testRoomId)
+	if err := publisher.Publish(&common.HubMessage{Type: "request", Serial: 1, From: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	msg := receiveHubMessage(t, sub)
+	if msg.Serial != 1 || msg.From != "client" {
+		t.Fatalf("Got %+v, want request 1 from the client", msg)
+	}
+	// The sync that delivered the request
+	since = <-synced
+	receiver.Close()
+
+	// Published while the receiver is down
+	if err := publisher.Publish(&common.HubMessage{Type: "request", Serial: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, sub = startMatrix(homeserver, since, synced)
+	defer receiver.Close()
+	if msg = receiveHubMessage(t, sub); msg.Serial != 2 {
+		t.Fatalf("Resumed with request %d, want 2", msg.Serial)
+	}
+}
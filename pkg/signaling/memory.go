@@ -0,0 +1,71 @@
+package signaling
+
+import (
+	"errors"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"sync"
+)
+
+// An in-process rendezvous channel for tests. Every message published by
+// one of its signalers is delivered to all of them.
+type MemoryHub struct {
+	mu        sync.Mutex
+	signalers map[*Memory]bool
+}
+
+func MakeMemoryHub() *MemoryHub {
+	return &MemoryHub{signalers: make(map[*Memory]bool)}
+}
+
+func (hub *MemoryHub) Signaler() *Memory {
+	signaler := &Memory{hub: hub}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.signalers[signaler] = true
+	return signaler
+}
+
+type Memory struct {
+	broadcaster
+	hub *MemoryHub
+}
+
+func (signaler *Memory) Publish(msg *common.HubMessage) error {
+	hub := signaler.hub
+	hub.mu.Lock()
+	if !hub.signalers[signaler] {
+		hub.mu.Unlock()
+		return errors.New("Signaler is closed")
+	}
+	peers := make([]*Memory, 0, len(hub.signalers))
+	for peer := range hub.signalers {
+		peers = append(peers, peer)
+	}
+	hub.mu.Unlock()
+
+	// Dispatching waits for slow subscribers, which must not keep the
+	// other signalers from closing
+	for _, peer := range peers {
+		peer.dispatch(msg)
+	}
+	return nil
+}
+
+func (signaler *Memory) Subscribe(filter Filter) *Subscription {
+	return signaler.subscribe(filter)
+}
+
+func (signaler *Memory) Observe(observer Observer) {
+	signaler.observe(observer)
+}
+
+func (signaler *Memory) Close() error {
+	hub := signaler.hub
+	hub.mu.Lock()
+	delete(hub.signalers, signaler)
+	hub.mu.Unlock()
+
+	signaler.close()
+	return nil
+}
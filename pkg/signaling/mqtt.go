@@ -0,0 +1,230 @@
+package signaling
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/mqtt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mqttDialTimeout = 10 * time.Second
+	// How many serials to remember the sender of, so that responses go
+	// back to whoever asked
+	mqttMaxPeers = 1024
+)
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// Exchanges hub messages through an MQTT broker. Every peer reads its own
+// inbox topic <prefix>/<peer>/inbox/+ and a message from A to B is
+// published with QoS 1 to <prefix>/B/inbox/A.
+type Mqtt struct {
+	broadcaster
+	client     *mqtt.Client
+	prefix     string
+	peerId     string
+	remotePeer string
+	stop       chan struct{}
+	stopOnce   sync.Once
+	// Received messages wait here for Run, which dispatches them
+	incoming chan mqttMessage
+
+	mu      sync.Mutex
+	senders map[uint64]string
+	serials []uint64
+}
+
+// Connects to the broker and subscribes to the inbox. The session is
+// persistent, so messages sent while the peer is offline are delivered when
+// it comes back.
+func DialMqtt(config *common.Config) (*Mqtt, error) {
+	if err := checkMqttPeerId(config.MqttPeer); err != nil {
+		return nil, err
+	}
+	if config.MqttRemotePeer != "" {
+		if err := checkMqttPeerId(config.MqttRemotePeer); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := dialMqttBroker(config.MqttBroker)
+	if err != nil {
+		return nil, errors.New("Cannot connect to MQTT broker: " + err.Error())
+	}
+
+	signaler := &Mqtt{
+		prefix:     strings.TrimSuffix(config.MqttTopicPrefix, "/"),
+		peerId:     config.MqttPeer,
+		remotePeer: config.MqttRemotePeer,
+		stop:       make(chan struct{}),
+		incoming:   make(chan mqttMessage, subscriptionQueueSize),
+		senders:    make(map[uint64]string),
+	}
+	signaler.client, err = mqtt.Connect(conn, &mqtt.Options{
+		ClientId:  "tgpunch-" + config.MqttPeer,
+		Username:  config.MqttUsername,
+		Password:  config.MqttPassword,
+		OnMessage: signaler.enqueue,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = signaler.client.Subscribe(signaler.inboxTopic(signaler.peerId, "+"), 1); err != nil {
+		signaler.client.Close()
+		return nil, err
+	}
+	return signaler, nil
+}
+
+func dialMqttBroker(brokerUrl string) (net.Conn, error) {
+	parsed, err := url.Parse(brokerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	switch parsed.Scheme {
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", withDefaultPort(parsed.Host, "1883"))
+	case "tls", "ssl", "mqtts":
+		return tls.DialWithDialer(dialer, "tcp", withDefaultPort(parsed.Host, "8883"), &tls.Config{ServerName: parsed.Hostname()})
+	}
+	return nil, errors.New("Unsupported MQTT broker URL scheme: " + parsed.Scheme)
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Peer IDs become topic levels, so they cannot contain separators or
+// wildcards
+func checkMqttPeerId(peerId string) error {
+	if peerId == "" || strings.ContainsAny(peerId, "/+#") {
+		return errors.New(fmt.Sprintf("Invalid MQTT peer ID %q", peerId))
+	}
+	return nil
+}
+
+func (signaler *Mqtt) inboxTopic(recipient string, sender string) string {
+	return signaler.prefix + "/" + recipient + "/inbox/" + sender
+}
+
+// Leaves the message unacknowledged if the queue is full, so that the
+// broker redelivers it once we reconnect
+func (signaler *Mqtt) enqueue(topic string, payload []byte) bool {
+	select {
+	case signaler.incoming <- mqttMessage{topic: topic, payload: payload}:
+		return true
+	default:
+		fmt.Println("MQTT receive queue is full, not acknowledging message from " + topic)
+		return false
+	}
+}
+
+func (signaler *Mqtt) handleMessage(topic string, payload []byte) {
+	sender := topic[strings.LastIndex(topic, "/")+1:]
+
+	var msg common.HubMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		fmt.Printf("Cannot parse hub message from %s: %v\n", sender, err)
+		return
+	}
+
+	signaler.mu.Lock()
+	if _, ok := signaler.senders[msg.Serial]; !ok {
+		signaler.serials = append(signaler.serials, msg.Serial)
+		if len(signaler.serials) > mqttMaxPeers {
+			delete(signaler.senders, signaler.serials[0])
+			signaler.serials = signaler.serials[1:]
+		}
+	}
+	signaler.senders[msg.Serial] = sender
+	signaler.mu.Unlock()
+
+	signaler.dispatch(&msg)
+}
+
+// Sends the message to the addressed peer, to the peer the same serial
+// came from or to the configured remote peer, whichever is known first
+func (signaler *Mqtt) Publish(msg *common.HubMessage) error {
+	signaler.mu.Lock()
+	recipient, ok := signaler.senders[msg.Serial]
+	signaler.mu.Unlock()
+	if msg.To != "" {
+		recipient = msg.To
+	} else if !ok {
+		recipient = signaler.remotePeer
+	}
+	if err := checkMqttPeerId(recipient); recipient != "" && err != nil {
+		return err
+	}
+	if recipient == "" {
+		return errors.New(fmt.Sprintf("Do not know whom to send the message with serial %d", msg.Serial))
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err = signaler.client.Publish(signaler.inboxTopic(recipient, signaler.peerId), payload, 1); err != nil {
+		return err
+	}
+
+	// Our own messages never show up in our inbox
+	signaler.dispatch(msg)
+	return nil
+}
+
+func (signaler *Mqtt) Subscribe(filter Filter) *Subscription {
+	return signaler.subscribe(filter)
+}
+
+func (signaler *Mqtt) Observe(observer Observer) {
+	signaler.observe(observer)
+}
+
+func (signaler *Mqtt) Close() error {
+	signaler.stopOnce.Do(func() {
+		close(signaler.stop)
+		signaler.client.Close()
+	})
+	signaler.close()
+	return nil
+}
+
+// Delivers received messages until Close is called or the connection to
+// the broker is lost
+func (signaler *Mqtt) Run() error {
+	for done := false; !done; {
+		select {
+		case msg := <-signaler.incoming:
+			signaler.handleMessage(msg.topic, msg.payload)
+		case <-signaler.stop:
+			return nil
+		case <-signaler.client.Done():
+			done = true
+		}
+	}
+
+	select {
+	case <-signaler.stop:
+		return nil
+	default:
+	}
+	return signaler.client.Err()
+}
@@ -0,0 +1,60 @@
+package signaling
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/mqtttest"
+	"testing"
+)
+
+// Subscribes before running so that redelivered messages are not missed
+func dialTestMqtt(t *testing.T, broker *mqtttest.Broker, peer string, remotePeer string, msgType string) (*Mqtt, *Subscription) {
+	t.Helper()
+	signaler, err := DialMqtt(&common.Config{
+		MqttBroker:      "tcp://" + broker.Addr(),
+		MqttTopicPrefix: "tgpunch",
+		MqttPeer:        peer,
+		MqttRemotePeer:  remotePeer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := signaler.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.Type == msgType
+	})
+	go signaler.Run()
+	return signaler, sub
+}
+
+func TestMqttRoundTripAndReconnect(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	server, serverSub := dialTestMqtt(t, broker, "server", "", "request")
+	client, clientSub := dialTestMqtt(t, broker, "client", "server", "response")
+	defer client.Close()
+
+	if err := client.Publish(&common.HubMessage{Type: "request", Serial: 1, From: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveHubMessage(t, serverSub); msg.Serial != 1 {
+		t.Fatalf("Got request %d, want 1", msg.Serial)
+	}
+	// Goes back to the peer the serial came from
+	if err := server.Publish(&common.HubMessage{Type: "response", Serial: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveHubMessage(t, clientSub); msg.Serial != 1 {
+		t.Fatalf("Got response %d, want 1", msg.Serial)
+	}
+	server.Close()
+
+	// The persistent session keeps it until the server is back
+	if err := client.Publish(&common.HubMessage{Type: "request", Serial: 2}); err != nil {
+		t.Fatal(err)
+	}
+	server, serverSub = dialTestMqtt(t, broker, "server", "", "request")
+	defer server.Close()
+	if msg := receiveHubMessage(t, serverSub); msg.Serial != 2 {
+		t.Fatalf("Got request %d after reconnecting, want 2", msg.Serial)
+	}
+}
@@ -0,0 +1,163 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/rendezvous"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rendezvousPollTimeout    = 30
+	rendezvousRequestTimeout = 10 * time.Second
+)
+
+// Exchanges hub messages through a room of a tgpunch rendezvous server
+type Rendezvous struct {
+	broadcaster
+	client   *http.Client
+	roomUrl  string
+	secret   string
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu sync.Mutex
+	// ID of the last message seen. Until the first poll or publish there
+	// is none and the server returns messages posted from now on.
+	cursor    uint64
+	hasCursor bool
+}
+
+func MakeRendezvous(client *http.Client, serverUrl string, room string, secret string) *Rendezvous {
+	return &Rendezvous{
+		client:  client,
+		roomUrl: strings.TrimSuffix(serverUrl, "/") + "/rooms/" + url.PathEscape(room) + "/messages",
+		secret:  secret,
+		stop:    make(chan struct{}),
+	}
+}
+
+func (signaler *Rendezvous) do(request *http.Request, result interface{}) error {
+	request.Header.Set("Authorization", "Bearer "+signaler.secret)
+
+	response, err := signaler.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var errorResponse rendezvous.ErrorResponse
+		if json.NewDecoder(response.Body).Decode(&errorResponse) != nil || errorResponse.Error == "" {
+			errorResponse.Error = response.Status
+		}
+		return errors.New("Rendezvous server error: " + errorResponse.Error)
+	}
+
+	if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+		return errors.New("Cannot decode rendezvous server response: " + err.Error())
+	}
+	return nil
+}
+
+func (signaler *Rendezvous) Publish(msg *common.HubMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rendezvousRequestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, signaler.roomUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	var response rendezvous.PostResponse
+	if err = signaler.do(request, &response); err != nil {
+		return err
+	}
+
+	// If we publish before polling, start polling right before our own
+	// message so that nothing answering it can slip through
+	signaler.mu.Lock()
+	if !signaler.hasCursor {
+		signaler.cursor = response.Id - 1
+		signaler.hasCursor = true
+	}
+	signaler.mu.Unlock()
+	return nil
+}
+
+func (signaler *Rendezvous) Subscribe(filter Filter) *Subscription {
+	return signaler.subscribe(filter)
+}
+
+func (signaler *Rendezvous) Observe(observer Observer) {
+	signaler.observe(observer)
+}
+
+func (signaler *Rendezvous) Close() error {
+	signaler.stopOnce.Do(func() { close(signaler.stop) })
+	signaler.close()
+	return nil
+}
+
+// Polls the room until Close is called or the server fails
+func (signaler *Rendezvous) Run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-signaler.stop
+		cancel()
+	}()
+
+	for {
+		signaler.mu.Lock()
+		query := url.Values{"timeout": {strconv.Itoa(rendezvousPollTimeout)}}
+		if signaler.hasCursor {
+			query.Set("after", strconv.FormatUint(signaler.cursor, 10))
+		}
+		signaler.mu.Unlock()
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, signaler.roomUrl+"?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+
+		var response rendezvous.PollResponse
+		err = signaler.do(request, &response)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		signaler.mu.Lock()
+		signaler.cursor = response.LastId
+		signaler.hasCursor = true
+		signaler.mu.Unlock()
+
+		for _, message := range response.Messages {
+			fmt.Println("Got rendezvous message: " + string(message.Body))
+
+			var msg common.HubMessage
+			if err = json.Unmarshal(message.Body, &msg); err != nil {
+				fmt.Println("Cannot parse hub message: " + err.Error())
+				continue
+			}
+			signaler.dispatch(&msg)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package signaling
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/rendezvous"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRendezvousRoundTrip(t *testing.T) {
+	relay, err := rendezvous.MakeServer(&rendezvous.Options{Retention: time.Minute, Rooms: map[string]string{"hub": "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	httpServer := httptest.NewServer(relay)
+	defer httpServer.Close()
+
+	server := MakeRendezvous(http.DefaultClient, httpServer.URL, "hub", "secret")
+	defer server.Close()
+	serverSub := server.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.Type == "request"
+	})
+	// Publishing sets the cursor, so the first poll cannot miss the request
+	if err = server.Publish(&common.HubMessage{Type: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+
+	client := MakeRendezvous(http.DefaultClient, httpServer.URL, "hub", "secret")
+	defer client.Close()
+	if err = client.Publish(&common.HubMessage{Type: "request", Serial: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveHubMessage(t, serverSub); msg.Serial != 1 {
+		t.Fatalf("Got request %d, want 1", msg.Serial)
+	}
+
+	intruder := MakeRendezvous(http.DefaultClient, httpServer.URL, "hub", "guess")
+	if err = intruder.Publish(&common.HubMessage{Type: "request"}); err == nil {
+		t.Fatal("Published with a wrong room secret")
+	}
+}
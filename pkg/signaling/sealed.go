@@ -0,0 +1,279 @@
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"sync"
+	"time"
+)
+
+const (
+	SealedMessageType = "sealed"
+
+	// Envelopes older than this are rejected as possible replays
+	defaultReplayWindow = 5 * time.Minute
+	maxSealedSerials    = 1024
+)
+
+// Wraps another signaler so that every hub message travels encrypted for
+// the known peers and signed by us. Plaintext and unverifiable messages
+// are dropped.
+type Sealed struct {
+	broadcaster
+	inner    Signaler
+	innerSub *Subscription
+	identity *e2e.Identity
+	peers    []*e2e.PublicKey
+	guard    *e2e.ReplayGuard
+
+	mu sync.Mutex
+	// Who sent each serial, so that responses are sealed just for them
+	senders map[uint64]*e2e.PublicKey
+	serials []uint64
+	// Whether keys we do not know may present themselves with a ticket
+	strangers bool
+}
+
+// Returns the signaler itself when no keys are configured
+func Secure(signaler Signaler, config *common.Config) (Signaler, error) {
+	if config.KeyFile == "" {
+		return signaler, nil
+	}
+
+	identity, err := e2e.LoadIdentity(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var peers []*e2e.PublicKey
+	if config.PeerKeysFile != "" {
+		if peers, err = e2e.LoadPeers(config.PeerKeysFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.ServerKey != nil {
+		peers = append(peers, config.ServerKey)
+	}
+
+	window := defaultReplayWindow
+	if config.BacklogMaxAge > window {
+		window = config.BacklogMaxAge
+	}
+	sealed := MakeSealed(signaler, identity, peers, window)
+	if config.TicketKeyFile != "" {
+		sealed.AcceptStrangers()
+	}
+	return sealed, nil
+}
+
+func MakeSealed(inner Signaler, identity *e2e.Identity, peers []*e2e.PublicKey, replayWindow time.Duration) *Sealed {
+	signaler := &Sealed{
+		inner:    inner,
+		identity: identity,
+		peers:    peers,
+		guard:    e2e.MakeReplayGuard(replayWindow),
+		senders:  make(map[uint64]*e2e.PublicKey),
+	}
+	// Our own messages are dispatched by Publish. Leaving them out also
+	// keeps Publish from waiting for receive, which may be waiting for us.
+	mySignKey := identity.Public().SignKey
+	signaler.innerSub = inner.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.Sealed == nil || !bytes.Equal(msg.Sealed.Sender, mySignKey)
+	})
+	go signaler.receive()
+	return signaler
+}
+
+// Makes the signaler open envelopes from keys it does not know, as long as
+// they come with a ticket and the key itself. Only servers accepting
+// tickets want that: a stranger's messages are marked so that they can
+// insist on the ticket.
+func (signaler *Sealed) AcceptStrangers() {
+	signaler.mu.Lock()
+	defer signaler.mu.Unlock()
+	signaler.strangers = true
+}
+
+func (signaler *Sealed) acceptsStrangers() bool {
+	signaler.mu.Lock()
+	defer signaler.mu.Unlock()
+	return signaler.strangers
+}
+
+// Our key as peers know it
+func (signaler *Sealed) PublicKey() *e2e.PublicKey {
+	return signaler.identity.Public()
+}
+
+func (signaler *Sealed) receive() {
+	defer signaler.close()
+
+	for msg := range signaler.innerSub.C {
+		if msg.Type != SealedMessageType || msg.Sealed == nil {
+			fmt.Printf("Dropping unsealed %s message\n", msg.Type)
+			continue
+		}
+		plaintext, sender, err := e2e.Open(signaler.identity, signaler.peers, msg.Sealed)
+		stranger := err == e2e.ErrUnknownKey && signaler.acceptsStrangers()
+		if stranger {
+			plaintext, sender, err = e2e.OpenFromStranger(signaler.identity, msg.Sealed)
+		}
+		if err != nil {
+			fmt.Println("Dropping sealed message: " + err.Error())
+			continue
+		}
+		if err = signaler.guard.Check(msg.Sealed); err != nil {
+			fmt.Println("Dropping sealed message: " + err.Error())
+			continue
+		}
+
+		var opened common.HubMessage
+		if err = json.Unmarshal(plaintext, &opened); err != nil {
+			fmt.Println("Cannot parse sealed hub message: " + err.Error())
+			continue
+		}
+		if stranger {
+			presented := signaler.strangerKey(&opened, sender)
+			if presented == nil {
+				fmt.Printf("Dropping sealed %s message from unknown key %s\n", opened.Type, sender.Id())
+				continue
+			}
+			sender = presented
+			opened.SenderKeyPresented = true
+		} else if opened.From != sender.Name {
+			// Any peer can put any name into the message, but only the
+			// key says who sent it
+			fmt.Printf("Dropping sealed message from %q claiming to be from %q\n", sender.Name, opened.From)
+			continue
+		}
+		signaler.remember(opened.Serial, sender)
+		opened.Key = nil
+		opened.Sender = msg.Sender
+		opened.SenderKey = sender
+		signaler.dispatch(&opened)
+	}
+}
+
+// Returns the full key of a stranger: the one its session started with, or
+// the one presented in a message with a ticket that starts a session. Nil
+// if there is neither, so that strangers cannot take over the sessions of
+// others. Presented keys carry no name, since nobody vouches for them.
+func (signaler *Sealed) strangerKey(opened *common.HubMessage, sender *e2e.PublicKey) *e2e.PublicKey {
+	signaler.mu.Lock()
+	known, ok := signaler.senders[opened.Serial]
+	signaler.mu.Unlock()
+	if ok {
+		if bytes.Equal(known.SignKey, sender.SignKey) {
+			return known
+		}
+		return nil
+	}
+	if opened.Serial == 0 || opened.Ticket == "" || opened.Key == nil || !bytes.Equal(opened.Key.SignKey, sender.SignKey) || opened.Key.Check() != nil {
+		return nil
+	}
+	return &e2e.PublicKey{SignKey: opened.Key.SignKey, BoxKey: opened.Key.BoxKey}
+}
+
+// Falls back to all peers if none has the name
+func (signaler *Sealed) peersNamed(name string) []*e2e.PublicKey {
+	var named []*e2e.PublicKey
+	for _, peer := range signaler.peers {
+		if name != "" && peer.Name == name {
+			named = append(named, peer)
+		}
+	}
+	if len(named) == 0 {
+		return signaler.peers
+	}
+	return named
+}
+
+// Serial 0 belongs to no session, e.g. servers announce themselves with it
+func (signaler *Sealed) remember(serial uint64, sender *e2e.PublicKey) {
+	if serial == 0 {
+		return
+	}
+	signaler.mu.Lock()
+	defer signaler.mu.Unlock()
+
+	if _, ok := signaler.senders[serial]; !ok {
+		signaler.serials = append(signaler.serials, serial)
+		if len(signaler.serials) > maxSealedSerials {
+			delete(signaler.senders, signaler.serials[0])
+			signaler.serials = signaler.serials[1:]
+		}
+	}
+	signaler.senders[serial] = sender
+}
+
+// Seals the message for the peer the serial came from, or for the
+// addressed peer, or for all known peers. The serial and the peer names
+// stay in the clear so that backends can still route by them. Messages
+// with a ticket present our key to servers that do not know it yet.
+func (signaler *Sealed) Publish(msg *common.HubMessage) error {
+	sealed := msg
+	if msg.Ticket != "" {
+		presenting := *msg
+		presenting.Key = signaler.identity.Public()
+		sealed = &presenting
+	}
+	plaintext, err := json.Marshal(sealed)
+	if err != nil {
+		return err
+	}
+
+	recipients := signaler.peersNamed(msg.To)
+	signaler.mu.Lock()
+	if sender, ok := signaler.senders[msg.Serial]; ok {
+		recipients = []*e2e.PublicKey{sender}
+	}
+	signaler.mu.Unlock()
+
+	envelope, err := e2e.Seal(signaler.identity, recipients, plaintext)
+	if err != nil {
+		return err
+	}
+	err = signaler.inner.Publish(&common.HubMessage{
+		Type:   SealedMessageType,
+		Serial: msg.Serial,
+		From:   msg.From,
+		To:     msg.To,
+		Sealed: envelope,
+	})
+	if err != nil {
+		return err
+	}
+	signaler.dispatch(msg)
+	return nil
+}
+
+func (signaler *Sealed) Subscribe(filter Filter) *Subscription {
+	return signaler.subscribe(filter)
+}
+
+func (signaler *Sealed) Observe(observer Observer) {
+	signaler.observe(observer)
+}
+
+func (signaler *Sealed) Close() error {
+	err := signaler.inner.Close()
+	signaler.close()
+	return err
+}
+
+func (signaler *Sealed) Cleanup(serial uint64, status string) error {
+	if cleaner, ok := signaler.inner.(Cleaner); ok {
+		return cleaner.Cleanup(serial, status)
+	}
+	return nil
+}
+
+// Runs the wrapped signaler if it needs that
+func (signaler *Sealed) Run() error {
+	if runner, ok := signaler.inner.(Runner); ok {
+		return runner.Run()
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package signaling
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"testing"
+	"time"
+)
+
+func generateIdentity(t *testing.T, name string) *e2e.Identity {
+	t.Helper()
+	identity, err := e2e.GenerateIdentity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestSealedDeliversOnlyAuthenticMessages(t *testing.T) {
+	serverIdentity := generateIdentity(t, "server")
+	clientIdentity := generateIdentity(t, "client")
+	otherIdentity := generateIdentity(t, "other")
+	strangerIdentity := generateIdentity(t, "stranger")
+	peers := []*e2e.PublicKey{clientIdentity.Public(), otherIdentity.Public()}
+
+	hub := MakeMemoryHub()
+	raw := hub.Signaler()
+	rawSub := raw.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.Type == SealedMessageType
+	})
+	server := MakeSealed(hub.Signaler(), serverIdentity, peers, time.Minute)
+	defer server.Close()
+	sub := server.Subscribe(nil)
+
+	client := MakeSealed(hub.Signaler(), clientIdentity, []*e2e.PublicKey{serverIdentity.Public()}, time.Minute)
+	other := MakeSealed(hub.Signaler(), otherIdentity, []*e2e.PublicKey{serverIdentity.Public()}, time.Minute)
+	stranger := MakeSealed(hub.Signaler(), strangerIdentity, []*e2e.PublicKey{serverIdentity.Public()}, time.Minute)
+
+	// A known peer posing as another one
+	other.Publish(&common.HubMessage{Type: "request", Serial: 1, From: "client"})
+	// An unknown key
+	stranger.Publish(&common.HubMessage{Type: "request", Serial: 2, From: "stranger"})
+	// Not sealed at all
+	raw.Publish(&common.HubMessage{Type: "request", Serial: 3, From: "client"})
+
+	if err := client.Publish(&common.HubMessage{Type: "request", Serial: 4, From: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	msg := receiveHubMessage(t, sub)
+	if msg.Serial != 4 || msg.From != "client" || msg.SenderKey == nil || msg.SenderKey.Name != "client" {
+		t.Fatalf("Got %+v, want request 4 from the client", msg)
+	}
+
+	// The same envelope once more
+	var envelope *common.HubMessage
+	for envelope == nil {
+		if candidate := receiveHubMessage(t, rawSub); candidate.Serial == 4 {
+			envelope = candidate
+		}
+	}
+	raw.Publish(envelope)
+	if err := client.Publish(&common.HubMessage{Type: "request", Serial: 5, From: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg = receiveHubMessage(t, sub); msg.Serial != 5 {
+		t.Fatalf("Got request %d, want the replay dropped and request 5", msg.Serial)
+	}
+}
+
+// Messages of serial 0 belong to no session, so answering one is no reason
+// to seal the next ones for its sender only
+func TestSealedSerialZeroGoesToAllPeers(t *testing.T) {
+	serverIdentity := generateIdentity(t, "server")
+	aIdentity := generateIdentity(t, "a")
+	bIdentity := generateIdentity(t, "b")
+
+	hub := MakeMemoryHub()
+	server := MakeSealed(hub.Signaler(), serverIdentity, []*e2e.PublicKey{aIdentity.Public(), bIdentity.Public()}, time.Minute)
+	defer server.Close()
+	serverSub := server.Subscribe(nil)
+	a := MakeSealed(hub.Signaler(), aIdentity, []*e2e.PublicKey{serverIdentity.Public()}, time.Minute)
+	defer a.Close()
+	b := MakeSealed(hub.Signaler(), bIdentity, []*e2e.PublicKey{serverIdentity.Public()}, time.Minute)
+	defer b.Close()
+	bSub := b.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.From == "server"
+	})
+
+	if err := a.Publish(&common.HubMessage{Type: "server_presence", From: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	receiveHubMessage(t, serverSub)
+	if err := server.Publish(&common.HubMessage{Type: "server_presence", From: "server"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveHubMessage(t, bSub); msg.Type != "server_presence" {
+		t.Fatalf("Got %s, want the presence", msg.Type)
+	}
+}
+
+// Ticket servers take keys they do not know, as long as they come with a
+// ticket, and then stick to them for the session
+func TestSealedAcceptsStrangersWithTickets(t *testing.T) {
+	serverIdentity := generateIdentity(t, "server")
+	clientIdentity := generateIdentity(t, "client")
+	guestIdentity := generateIdentity(t, "guest")
+	intruderIdentity := generateIdentity(t, "intruder")
+	serverKey := []*e2e.PublicKey{serverIdentity.Public()}
+
+	hub := MakeMemoryHub()
+	server := MakeSealed(hub.Signaler(), serverIdentity, []*e2e.PublicKey{clientIdentity.Public()}, time.Minute)
+	defer server.Close()
+	server.AcceptStrangers()
+	sub := server.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.From != "server"
+	})
+
+	client := MakeSealed(hub.Signaler(), clientIdentity, serverKey, time.Minute)
+	defer client.Close()
+	guest := MakeSealed(hub.Signaler(), guestIdentity, serverKey, time.Minute)
+	defer guest.Close()
+	guestSub := guest.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.From == "server"
+	})
+	intruder := MakeSealed(hub.Signaler(), intruderIdentity, serverKey, time.Minute)
+	defer intruder.Close()
+
+	// No ticket, no key
+	guest.Publish(&common.HubMessage{Type: "request", Serial: 1, From: "guest"})
+	if err := guest.Publish(&common.HubMessage{Type: "request", Serial: 2, From: "guest", Ticket: "ticket"}); err != nil {
+		t.Fatal(err)
+	}
+	msg := receiveHubMessage(t, sub)
+	if msg.Serial != 2 || !msg.SenderKeyPresented || msg.Key != nil || msg.SenderKey.Id() != guestIdentity.Public().Id() || msg.SenderKey.Name != "" {
+		t.Fatalf("Got %+v with key %+v, want request 2 from the guest's presented key", msg, msg.SenderKey)
+	}
+
+	// Another stranger cannot take over the session, even with a ticket
+	intruder.Publish(&common.HubMessage{Type: "report", Serial: 2, From: "guest", Ticket: "ticket"})
+	if err := guest.Publish(&common.HubMessage{Type: "report", Serial: 2, From: "guest"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg = receiveHubMessage(t, sub); msg.Type != "report" || msg.SenderKey.Id() != guestIdentity.Public().Id() {
+		t.Fatalf("Got %s from %+v, want the guest's report", msg.Type, msg.SenderKey)
+	}
+
+	// Responses are sealed for the presented key
+	if err := server.Publish(&common.HubMessage{Type: "ack", Serial: 2, From: "server"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg = receiveHubMessage(t, guestSub); msg.Type != "ack" || msg.Serial != 2 {
+		t.Fatalf("Got %s %d, want the ack", msg.Type, msg.Serial)
+	}
+
+	if err := client.Publish(&common.HubMessage{Type: "request", Serial: 3, From: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg = receiveHubMessage(t, sub); msg.Serial != 3 || msg.SenderKeyPresented {
+		t.Fatalf("Got %+v, want request 3 from a known peer", msg)
+	}
+}
@@ -0,0 +1,225 @@
+// Package signaling carries hub messages between the client and the server
+// over some rendezvous channel. Hub messages travel as JSON, except that the
+// Telegram signaler honours --compact and splits posts over Telegram's
+// length limit.
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"os"
+	"sync"
+)
+
+const subscriptionQueueSize = 64
+
+// Selects the hub messages a subscription is interested in. A nil filter
+// accepts everything.
+type Filter func(msg *common.HubMessage) bool
+
+// Accepts messages addressed to the named peer. An empty name stands for
+// an unnamed peer, which only gets messages without an addressee.
+func AddressedTo(name string) Filter {
+	return func(msg *common.HubMessage) bool {
+		return msg.To == name
+	}
+}
+
+// Sees every incoming message before the subscriptions do. Called on the
+// receiving goroutine, so it must not block.
+type Observer func(msg *common.HubMessage)
+
+type Signaler interface {
+	// Posts the message to the rendezvous channel
+	Publish(msg *common.HubMessage) error
+
+	// Starts delivering messages that pass the filter, including the ones
+	// published by this signaler. Delivery waits while the subscription
+	// queue is full, so a consumer that publishes must filter out its own
+	// messages or it can end up waiting for itself.
+	Subscribe(filter Filter) *Subscription
+
+	// Calls the observer with every message delivered from now on, e.g. to
+	// keep track of the peers, until the signaler is closed
+	Observe(observer Observer)
+
+	// Stops receiving messages and closes all subscriptions
+	Close() error
+}
+
+// Implemented by signalers that can remove what they have posted, so that
+// peer addresses do not linger in the channel history
+type Cleaner interface {
+	// Deletes our messages of the session or collapses them into a
+	// status message, depending on the configuration
+	Cleanup(serial uint64, status string) error
+}
+
+// Cleans up after the session if the signaler supports it
+func CleanupSession(signaler Signaler, serial uint64, status string) {
+	cleaner, ok := signaler.(Cleaner)
+	if !ok {
+		return
+	}
+	if err := cleaner.Cleanup(serial, status); err != nil {
+		fmt.Printf("Cannot clean up messages of session %d: %v\n", serial, err)
+	}
+}
+
+// Implemented by signalers that need a goroutine receiving messages
+type Runner interface {
+	// Blocks until the signaler is closed or fails
+	Run() error
+}
+
+func Make(config *common.Config) (Signaler, error) {
+	switch config.Signaling {
+	case common.SignalingTelegram:
+		return MakeTelegram(common.MakeBot(config), config), nil
+	case common.SignalingRendezvous:
+		return MakeRendezvous(common.MakeClient(*config), config.RendezvousUrl, config.Room, config.RoomSecret), nil
+	case common.SignalingMatrix:
+		return MakeMatrix(common.MakeClient(*config), config.MatrixHomeserver, config.MatrixToken, config.MatrixRoom), nil
+	case common.SignalingMqtt:
+		signaler, err := DialMqtt(config)
+		if err != nil {
+			return nil, err
+		}
+		return signaler, nil
+	case common.SignalingManual:
+		return MakeManual(os.Stdin, os.Stdout), nil
+	}
+	return nil, errors.New("Unknown signaling backend: " + config.Signaling)
+}
+
+type Subscription struct {
+	C <-chan *common.HubMessage
+
+	c      chan *common.HubMessage
+	filter Filter
+	owner  *broadcaster
+	// Closed first on shutdown to release the dispatches waiting for room
+	// in the queue
+	done     chan struct{}
+	doneOnce sync.Once
+	// Read-locked while sending to c, so that c is only closed when no
+	// dispatch is in flight
+	sending sync.RWMutex
+}
+
+func (sub *Subscription) Close() {
+	sub.owner.unsubscribe(sub)
+}
+
+// Waits for room in the queue unless the subscription gets closed
+func (sub *Subscription) send(msg *common.HubMessage) {
+	sub.sending.RLock()
+	defer sub.sending.RUnlock()
+	select {
+	case <-sub.done:
+		return
+	default:
+	}
+	select {
+	case sub.c <- msg:
+	case <-sub.done:
+	}
+}
+
+func (sub *Subscription) shut() {
+	sub.doneOnce.Do(func() {
+		close(sub.done)
+		sub.sending.Lock()
+		close(sub.c)
+		sub.sending.Unlock()
+	})
+}
+
+// Fans incoming messages out to subscriptions, shared by all Signaler
+// implementations
+type broadcaster struct {
+	mu        sync.Mutex
+	subs      map[*Subscription]bool
+	observers []Observer
+	closed    bool
+}
+
+func (b *broadcaster) subscribe(filter Filter) *Subscription {
+	c := make(chan *common.HubMessage, subscriptionQueueSize)
+	sub := &Subscription{
+		C:      c,
+		c:      c,
+		filter: filter,
+		owner:  b,
+		done:   make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		sub.shut()
+		return sub
+	}
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]bool)
+	}
+	b.subs[sub] = true
+	return sub
+}
+
+func (b *broadcaster) observe(observer Observer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.observers = append(b.observers, observer)
+	}
+}
+
+func (b *broadcaster) unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	delete(b.subs, sub)
+	b.mu.Unlock()
+	sub.shut()
+}
+
+// Hands the message to every interested subscription, waiting for slow
+// consumers instead of dropping the message. The lock is not held while
+// waiting, so consumers can still subscribe and unsubscribe.
+func (b *broadcaster) dispatch(msg *common.HubMessage) {
+	var targets []*Subscription
+	b.mu.Lock()
+	observers := b.observers
+	for sub := range b.subs {
+		if sub.filter == nil || sub.filter(msg) {
+			targets = append(targets, sub)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, observer := range observers {
+		copied := *msg
+		observer(&copied)
+	}
+	for _, sub := range targets {
+		copied := *msg
+		sub.send(&copied)
+	}
+}
+
+func (b *broadcaster) close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	subs := b.subs
+	b.subs = nil
+	b.observers = nil
+	b.mu.Unlock()
+
+	for sub := range subs {
+		sub.shut()
+	}
+}
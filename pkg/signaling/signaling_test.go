@@ -0,0 +1,118 @@
+package signaling
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatchWaitsForSlowSubscriber(t *testing.T) {
+	hub := MakeMemoryHub()
+	publisher := hub.Signaler()
+	defer publisher.Close()
+	subscriber := hub.Signaler()
+	defer subscriber.Close()
+	sub := subscriber.Subscribe(nil)
+
+	const count = 3 * subscriptionQueueSize
+	published := make(chan error, 1)
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := publisher.Publish(&common.HubMessage{Type: "test", Serial: uint64(i)}); err != nil {
+				published <- err
+				return
+			}
+		}
+		published <- nil
+	}()
+
+	for i := 0; i < count; i++ {
+		select {
+		case msg := <-sub.C:
+			if msg.Serial != uint64(i) {
+				t.Fatalf("Got message %d, want %d", msg.Serial, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %d never arrived", i)
+		}
+	}
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseReleasesBlockedDispatch(t *testing.T) {
+	hub := MakeMemoryHub()
+	publisher := hub.Signaler()
+	defer publisher.Close()
+	subscriber := hub.Signaler()
+	sub := subscriber.Subscribe(nil)
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i <= subscriptionQueueSize; i++ {
+			publisher.Publish(&common.HubMessage{Type: "test"})
+		}
+	}()
+
+	// Wait for the queue to fill up so that the last dispatch blocks
+	for len(sub.C) < subscriptionQueueSize {
+		time.Sleep(time.Millisecond)
+	}
+	subscriber.Close()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish is still blocked after the subscriber was closed")
+	}
+	for range sub.C {
+	}
+}
+
+func TestFilterSkipsMessages(t *testing.T) {
+	hub := MakeMemoryHub()
+	signaler := hub.Signaler()
+	defer signaler.Close()
+	sub := signaler.Subscribe(AddressedTo("server"))
+
+	signaler.Publish(&common.HubMessage{Type: "test", To: "other"})
+	signaler.Publish(&common.HubMessage{Type: "test", To: "server", Serial: 7})
+
+	msg := <-sub.C
+	if msg.To != "server" || msg.Serial != 7 {
+		t.Fatalf("Got message %+v, want the one addressed to the server", msg)
+	}
+}
+
+func TestObserverSeesEveryMessage(t *testing.T) {
+	hub := MakeMemoryHub()
+	publisher := hub.Signaler()
+	defer publisher.Close()
+	signaler := hub.Signaler()
+	sub := signaler.Subscribe(AddressedTo("server"))
+
+	var mu sync.Mutex
+	var observed []uint64
+	signaler.Observe(func(msg *common.HubMessage) {
+		mu.Lock()
+		observed = append(observed, msg.Serial)
+		mu.Unlock()
+	})
+
+	publisher.Publish(&common.HubMessage{Type: "test", To: "other", Serial: 1})
+	publisher.Publish(&common.HubMessage{Type: "test", To: "server", Serial: 2})
+	if msg := <-sub.C; msg.Serial != 2 {
+		t.Fatalf("Got message %d, want 2", msg.Serial)
+	}
+	signaler.Close()
+	publisher.Publish(&common.HubMessage{Type: "test", To: "server", Serial: 3})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(observed) != 2 || observed[0] != 1 || observed[1] != 2 {
+		t.Fatalf("Observed %v, want the filtered message too and nothing after close", observed)
+	}
+}
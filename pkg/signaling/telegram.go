@@ -0,0 +1,406 @@
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telegram refuses longer text messages
+const telegramMaxMessageLength = 4096
+
+// With private chats enabled, sessions are answered in the chat they
+// started in. Routes are forgotten a while after the last message.
+const (
+	routeRetention = time.Hour
+	maxRoutes      = 4096
+)
+
+type route struct {
+	chatId int64 // zero for the configured chat
+	seen   time.Time
+}
+
+// Our posts of one session
+type sentPosts struct {
+	chatId     int64
+	messageIds []int
+	sentAt     time.Time
+}
+
+// Exchanges hub messages as posts in a Telegram channel, group, forum topic
+// or private chat with the bot. Updates come either from Run polling
+// getUpdates or from a webhook feeding HandleUpdate.
+//
+// Only channels let two bots talk. In groups and private chats Telegram
+// does not show bots the messages of other bots, so there the hub only
+// works with hub messages posted by people, e.g. a user pasting the output
+// of a client with manual signaling. With --private-chats the bot also
+// takes hub messages people send it directly, from any private chat.
+type Telegram struct {
+	broadcaster
+	bot       *tgapi.Bot
+	config    *common.Config
+	stop      chan struct{}
+	fragments reassembler
+
+	mu     sync.Mutex
+	chatId int64
+	// Our posts by session serial, while cleanup is enabled
+	sent         map[uint64]*sentPosts
+	sweeperStart sync.Once
+	// Where each session started, while private chats are enabled
+	routes map[uint64]*route
+
+	// ID of the last update seen by Run
+	UpdateOffset int
+
+	// Called by Run with the ID of every update once it is handed to the
+	// subscriptions, so a saved offset never skips an undelivered update.
+	// Returning an error stops Run.
+	OnUpdate func(updateId int) error
+
+	// Receives the callback queries of inline keyboard buttons, which are
+	// dropped if it is nil
+	OnCallbackQuery func(query *tgapi.CallbackQuery)
+	// Same for inline queries
+	OnInlineQuery func(query *tgapi.InlineQuery)
+	// Receives messages starting with a slash, from any chat, instead of
+	// parsing them as hub messages
+	OnCommand func(message *tgapi.Message)
+}
+
+func MakeTelegram(bot *tgapi.Bot, config *common.Config) *Telegram {
+	return &Telegram{
+		bot:    bot,
+		config: config,
+		stop:   make(chan struct{}),
+		chatId: config.ChatId,
+		sent:   make(map[uint64]*sentPosts),
+		routes: make(map[uint64]*route),
+	}
+}
+
+// Follows the chat to a supergroup even if the upgrade showed up in a call
+// other than Publish
+func (signaler *Telegram) getChatId() int64 {
+	signaler.mu.Lock()
+	defer signaler.mu.Unlock()
+	return signaler.bot.CurrentChatId(signaler.chatId)
+}
+
+// Remembers that the session started in the chat, zero standing for the
+// configured one. The first chat a serial shows up in keeps it, so that
+// nobody can divert a running session into another chat.
+func (signaler *Telegram) route(serial uint64, chatId int64) error {
+	// Serial 0 belongs to no session, e.g. servers announce themselves
+	// with it, and stays in the configured chat
+	if serial == 0 {
+		if chatId != 0 {
+			return errors.New("Serial 0 belongs to no session")
+		}
+		return nil
+	}
+	signaler.mu.Lock()
+	defer signaler.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := signaler.routes[serial]; ok {
+		existing.seen = now
+		if existing.chatId != chatId {
+			return errors.New("The session belongs to another chat")
+		}
+		return nil
+	}
+	if len(signaler.routes) >= maxRoutes {
+		for routed, existing := range signaler.routes {
+			if now.Sub(existing.seen) > routeRetention {
+				delete(signaler.routes, routed)
+			}
+		}
+	}
+	if len(signaler.routes) >= maxRoutes {
+		return errors.New("Too many sessions")
+	}
+	signaler.routes[serial] = &route{chatId: chatId, seen: now}
+	return nil
+}
+
+// Where the messages of the session go: the private chat it started in,
+// or the configured chat and topic
+func (signaler *Telegram) destination(serial uint64) (int64, int, bool) {
+	signaler.mu.Lock()
+	defer signaler.mu.Unlock()
+	if existing, ok := signaler.routes[serial]; ok && existing.chatId != 0 {
+		return existing.chatId, 0, true
+	}
+	return signaler.chatId, signaler.config.TopicId, false
+}
+
+// Messages too long for a single post go out in several
+func (signaler *Telegram) Publish(msg *common.HubMessage) error {
+	text, err := common.EncodeHubMessage(msg, signaler.config.CompactEncoding)
+	if err != nil {
+		return err
+	}
+	posts, err := splitText(text, telegramMaxMessageLength)
+	if err != nil {
+		return err
+	}
+
+	chatId, threadId, private := signaler.destination(msg.Serial)
+	for _, post := range posts {
+		sent, err := signaler.bot.SendMessage(&tgapi.SendMessage{
+			ChatId:          chatId,
+			Text:            post,
+			MessageThreadId: threadId,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Follow the chat if it has been migrated to a supergroup
+		if !private {
+			chatId = sent.Chat.Id
+			signaler.mu.Lock()
+			signaler.chatId = sent.Chat.Id
+			signaler.mu.Unlock()
+		}
+		signaler.track(msg.Serial, sent)
+	}
+	return nil
+}
+
+func (signaler *Telegram) track(serial uint64, sent *tgapi.Message) {
+	if signaler.config.Cleanup == common.CleanupNone {
+		return
+	}
+	signaler.sweeperStart.Do(func() { go signaler.sweep() })
+
+	signaler.mu.Lock()
+	defer signaler.mu.Unlock()
+	posts, ok := signaler.sent[serial]
+	if !ok || posts.chatId != sent.Chat.Id {
+		posts = &sentPosts{chatId: sent.Chat.Id, sentAt: time.Now()}
+		signaler.sent[serial] = posts
+	}
+	posts.messageIds = append(posts.messageIds, sent.Id)
+}
+
+func (signaler *Telegram) Cleanup(serial uint64, status string) error {
+	signaler.mu.Lock()
+	posts, ok := signaler.sent[serial]
+	delete(signaler.sent, serial)
+	delete(signaler.routes, serial)
+	signaler.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return signaler.cleanupPosts(posts, status)
+}
+
+// In edit mode the first post becomes the status and the rest go away
+func (signaler *Telegram) cleanupPosts(posts *sentPosts, status string) error {
+	messageIds := posts.messageIds
+	var firstErr error
+	if signaler.config.Cleanup == common.CleanupEdit && len(messageIds) > 0 {
+		_, err := signaler.bot.EditMessageText(&tgapi.EditMessageText{
+			ChatId:    posts.chatId,
+			MessageId: messageIds[0],
+			Text:      status,
+		})
+		firstErr = err
+		messageIds = messageIds[1:]
+	}
+
+	for _, messageId := range messageIds {
+		err := signaler.bot.DeleteMessage(&tgapi.DeleteMessage{
+			ChatId:    posts.chatId,
+			MessageId: messageId,
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Cleans up posts of sessions that have been around for longer than the
+// retention period, e.g. because the peer never answered
+func (signaler *Telegram) sweep() {
+	interval := signaler.config.MessageRetention / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-signaler.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*sentPosts
+		signaler.mu.Lock()
+		for serial, posts := range signaler.sent {
+			if time.Since(posts.sentAt) > signaler.config.MessageRetention {
+				expired = append(expired, posts)
+				delete(signaler.sent, serial)
+			}
+		}
+		signaler.mu.Unlock()
+
+		for _, posts := range expired {
+			if err := signaler.cleanupPosts(posts, "Expired tgpunch session"); err != nil {
+				fmt.Println("Cannot clean up expired messages: " + err.Error())
+			}
+		}
+	}
+}
+
+func (signaler *Telegram) Subscribe(filter Filter) *Subscription {
+	return signaler.subscribe(filter)
+}
+
+func (signaler *Telegram) Observe(observer Observer) {
+	signaler.observe(observer)
+}
+
+// Run returns after the getUpdates call in progress completes
+func (signaler *Telegram) Close() error {
+	select {
+	case <-signaler.stop:
+	default:
+		close(signaler.stop)
+	}
+	signaler.close()
+	return nil
+}
+
+// Polls getUpdates until Close is called or the Bot API fails
+func (signaler *Telegram) Run() error {
+	var backoff common.ConflictBackoff
+	for {
+		select {
+		case <-signaler.stop:
+			return nil
+		default:
+		}
+
+		updates, err := common.GetUpdates(signaler.bot, signaler.UpdateOffset)
+		if common.IsConflict(err) {
+			if !backoff.Wait(err, signaler.stop) {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		backoff.Reset()
+
+		for i := range updates {
+			signaler.HandleUpdate(&updates[i])
+			signaler.UpdateOffset = updates[i].Id
+			if signaler.OnUpdate != nil {
+				if err = signaler.OnUpdate(signaler.UpdateOffset); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (signaler *Telegram) isStale(message *tgapi.Message) bool {
+	if signaler.config.BacklogMaxAge == 0 {
+		return false
+	}
+	return time.Since(time.Unix(message.Date, 0)) > signaler.config.BacklogMaxAge
+}
+
+// Picks a hub message out of the update and delivers it to subscriptions
+func (signaler *Telegram) HandleUpdate(upd *tgapi.Update) {
+	if upd.CallbackQuery != nil {
+		if signaler.OnCallbackQuery != nil {
+			signaler.OnCallbackQuery(upd.CallbackQuery)
+		}
+		return
+	}
+	if upd.InlineQuery != nil {
+		if signaler.OnInlineQuery != nil {
+			signaler.OnInlineQuery(upd.InlineQuery)
+		}
+		return
+	}
+
+	message := upd.ChannelPost
+	if message == nil {
+		message = upd.Message
+	}
+	if message == nil {
+		return
+	}
+	if signaler.OnCommand != nil && message.Text != nil && strings.HasPrefix(*message.Text, "/") {
+		if !signaler.isStale(message) {
+			signaler.OnCommand(message)
+		}
+		return
+	}
+	private := signaler.config.PrivateChats && message.Chat.ChatType == "private" && message.Chat.Id != signaler.getChatId()
+	if message.Chat.Id != signaler.getChatId() && !private {
+		return
+	}
+	if !private && signaler.config.TopicId != 0 && message.MessageThreadId != signaler.config.TopicId {
+		return
+	}
+	if message.Text == nil {
+		return
+	}
+	if signaler.isStale(message) {
+		fmt.Printf("Skipping stale message %d\n", message.Id)
+		return
+	}
+	fmt.Println("Got hub message: " + *message.Text)
+
+	text := *message.Text
+	if strings.HasPrefix(text, FragmentPrefix) {
+		var senderId int
+		if message.From != nil {
+			senderId = message.From.Id
+		}
+		var err error
+		if text, err = signaler.fragments.add(message.Chat.Id, senderId, text); err != nil {
+			fmt.Println("Cannot reassemble hub message: " + err.Error())
+			return
+		}
+		if text == "" {
+			return
+		}
+	}
+
+	msg, err := common.DecodeHubMessage(text)
+	if err != nil {
+		fmt.Println("Cannot parse hub message: " + err.Error())
+		return
+	}
+
+	if signaler.config.PrivateChats {
+		var chatId int64
+		if private {
+			chatId = message.Chat.Id
+		}
+		if err = signaler.route(msg.Serial, chatId); err != nil {
+			fmt.Printf("Ignoring hub message of session %d: %v\n", msg.Serial, err)
+			return
+		}
+	}
+
+	msg.Sender = message.From
+	signaler.dispatch(msg)
+}
@@ -0,0 +1,320 @@
+package signaling
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/common"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapitest"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testChannelId = -1001
+
+func receiveHubMessage(t *testing.T, sub *Subscription) *common.HubMessage {
+	t.Helper()
+	select {
+	case msg, ok := <-sub.C:
+		if !ok {
+			t.Fatal("Subscription closed")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("No hub message received")
+	}
+	return nil
+}
+
+func startTelegram(fake *tgapitest.Server, offset int, saved chan<- int) (*Telegram, *Subscription) {
+	bot := tgapi.MakeBot(http.DefaultClient, fake.URL, "token")
+	signaler := MakeTelegram(bot, &common.Config{ChatId: testChannelId})
+	signaler.UpdateOffset = offset
+	signaler.OnUpdate = func(updateId int) error {
+		saved <- updateId
+		return nil
+	}
+	sub := signaler.Subscribe(func(msg *common.HubMessage) bool {
+		return msg.Type == "request"
+	})
+	go signaler.Run()
+	return signaler, sub
+}
+
+func TestTelegramRoundTripAndResume(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	defer fake.Close()
+	fake.AddChannel(testChannelId, "hub")
+
+	publisher := MakeTelegram(tgapi.MakeBot(http.DefaultClient, fake.URL, "token"), &common.Config{ChatId: testChannelId})
+	saved := make(chan int, 16)
+
+	receiver, sub := startTelegram(fake, 0, saved)
+	if err := publisher.Publish(&common.HubMessage{Type: "request", Serial: 1, From: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	msg := receiveHubMessage(t, sub)
+	if msg.Serial != 1 || msg.From != "client" {
+		t.Fatalf("Got %+v, want request 1 from the client", msg)
+	}
+	offset := <-saved
+	receiver.Close()
+
+	// Published while the receiver is down
+	if err := publisher.Publish(&common.HubMessage{Type: "request", Serial: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, sub = startTelegram(fake, offset, saved)
+	defer receiver.Close()
+	if msg = receiveHubMessage(t, sub); msg.Serial != 2 {
+		t.Fatalf("Resumed with request %d, want 2", msg.Serial)
+	}
+	if resumed := <-saved; resumed <= offset {
+		t.Fatalf("Saved offset went from %d to %d", offset, resumed)
+	}
+}
+
+func TestTelegramSplitsLongMessages(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	defer fake.Close()
+	fake.AddChannel(testChannelId, "hub")
+
+	saved := make(chan int, 16)
+	receiver, sub := startTelegram(fake, 0, saved)
+	defer receiver.Close()
+
+	publisher := MakeTelegram(tgapi.MakeBot(http.DefaultClient, fake.URL, "token"), &common.Config{ChatId: testChannelId})
+	long := make([]byte, 3*telegramMaxMessageLength)
+	for i := range long {
+		long[i] = 'a' + byte(i%26)
+	}
+	if err := publisher.Publish(&common.HubMessage{Type: "request", Serial: 3, Ticket: string(long)}); err != nil {
+		t.Fatal(err)
+	}
+	if posts := len(fake.Messages(testChannelId)); posts < 2 {
+		t.Fatalf("Long message went out in %d posts", posts)
+	}
+	if msg := receiveHubMessage(t, sub); msg.Ticket != string(long) {
+		t.Fatal("Reassembled message differs from the published one")
+	}
+}
+
+func TestTelegramGroupsShowOnlyPeople(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	defer fake.Close()
+	fake.AddChat(tgapi.Chat{Id: testChannelId, ChatType: "supergroup"})
+
+	saved := make(chan int, 16)
+	receiver, sub := startTelegram(fake, 0, saved)
+	defer receiver.Close()
+
+	// Telegram does not show bots what bots post in groups
+	publisher := MakeTelegram(tgapi.MakeBot(http.DefaultClient, fake.URL, "token"), &common.Config{ChatId: testChannelId})
+	if err := publisher.Publish(&common.HubMessage{Type: "request", Serial: 1}); err != nil {
+		t.Fatal(err)
+	}
+	user := tgapi.User{Id: 5, FirstName: "Alice"}
+	if _, err := fake.PostUserMessage(testChannelId, 0, user, `{"type":"request","serial":2}`); err != nil {
+		t.Fatal(err)
+	}
+	msg := receiveHubMessage(t, sub)
+	if msg.Serial != 2 || msg.Sender == nil || msg.Sender.Id != user.Id {
+		t.Fatalf("Got %+v, want request 2 posted by the user", msg)
+	}
+}
+
+// Someone else in the group cannot finish a message with their fragments
+func TestTelegramFragmentsStayWithTheirSender(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	defer fake.Close()
+	fake.AddChat(tgapi.Chat{Id: testChannelId, ChatType: "supergroup"})
+
+	saved := make(chan int, 16)
+	receiver, sub := startTelegram(fake, 0, saved)
+	defer receiver.Close()
+
+	text, err := common.EncodeHubMessage(&common.HubMessage{Type: "request", Serial: 1, Ticket: strings.Repeat("a", 300)}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragments, err := splitText(text, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := tgapi.User{Id: 5, FirstName: "Alice"}
+	mallory := tgapi.User{Id: 6, FirstName: "Mallory"}
+	posts := []struct {
+		from tgapi.User
+		text string
+	}{
+		{alice, fragments[0]},
+		{mallory, fragments[1]},
+		{alice, fragments[1]},
+	}
+	for _, post := range posts {
+		if _, err = fake.PostUserMessage(testChannelId, 0, post.from, post.text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := receiveHubMessage(t, sub)
+	if msg.Serial != 1 || msg.Sender == nil || msg.Sender.Id != alice.Id {
+		t.Fatalf("Got %+v, want the request posted by Alice", msg)
+	}
+}
+
+func TestTelegramAnswersInPrivateChats(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	defer fake.Close()
+	fake.AddChannel(testChannelId, "hub")
+	alice := tgapi.User{Id: 5, FirstName: "Alice"}
+	mallory := tgapi.User{Id: 6, FirstName: "Mallory"}
+	for _, user := range []tgapi.User{alice, mallory} {
+		fake.AddChat(tgapi.Chat{Id: int64(user.Id), ChatType: "private", FirstName: &user.FirstName})
+	}
+
+	bot := tgapi.MakeBot(http.DefaultClient, fake.URL, "token")
+	signaler := MakeTelegram(bot, &common.Config{ChatId: testChannelId, PrivateChats: true})
+	sub := signaler.Subscribe(nil)
+	go signaler.Run()
+	defer signaler.Close()
+
+	if _, err := fake.PostUserMessage(int64(alice.Id), 0, alice, `{"type":"request","serial":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveHubMessage(t, sub); msg.Serial != 1 || msg.Sender == nil || msg.Sender.Id != alice.Id {
+		t.Fatalf("Got %+v, want request 1 from Alice", msg)
+	}
+	// Nobody else may join the session
+	if _, err := fake.PostUserMessage(int64(mallory.Id), 0, mallory, `{"type":"cancel","serial":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.PostMessage(testChannelId, `{"type":"cancel","serial":1}`); err != nil {
+		t.Fatal(err)
+	}
+	// Nor take over serial 0, which belongs to no session
+	if _, err := fake.PostUserMessage(int64(mallory.Id), 0, mallory, `{"type":"request","serial":0}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.PostUserMessage(int64(alice.Id), 0, alice, `{"type":"report","serial":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveHubMessage(t, sub); msg.Type != "report" {
+		t.Fatalf("Got %s, want the others ignored", msg.Type)
+	}
+
+	// The answer goes where the request came from
+	if err := signaler.Publish(&common.HubMessage{Type: "response", Serial: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := signaler.Publish(&common.HubMessage{Type: "request", Serial: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := signaler.Publish(&common.HubMessage{Type: "server_presence", Serial: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if posts := fake.Messages(int64(alice.Id)); len(posts) != 3 {
+		t.Fatalf("%d posts in the private chat, want 2 of Alice and the answer", len(posts))
+	}
+	if posts := fake.Messages(testChannelId); len(posts) != 3 {
+		t.Fatalf("%d posts in the channel, want the ignored cancel, request 2 and the presence", len(posts))
+	}
+	if posts := fake.Messages(int64(mallory.Id)); len(posts) != 2 {
+		t.Fatalf("%d posts in Mallory's chat, want only the 2 of Mallory", len(posts))
+	}
+}
+
+func TestTelegramIgnoresPrivateChatsByDefault(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	defer fake.Close()
+	fake.AddChannel(testChannelId, "hub")
+	alice := tgapi.User{Id: 5, FirstName: "Alice"}
+	fake.AddChat(tgapi.Chat{Id: int64(alice.Id), ChatType: "private"})
+
+	saved := make(chan int, 16)
+	receiver, sub := startTelegram(fake, 0, saved)
+	defer receiver.Close()
+
+	if _, err := fake.PostUserMessage(int64(alice.Id), 0, alice, `{"type":"request","serial":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.PostMessage(testChannelId, `{"type":"request","serial":2}`); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveHubMessage(t, sub); msg.Serial != 2 {
+		t.Fatalf("Got request %d, want the private one ignored", msg.Serial)
+	}
+}
+
+func TestTelegramForumTopic(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	defer fake.Close()
+	fake.AddChat(tgapi.Chat{Id: testChannelId, ChatType: "supergroup", IsForum: true})
+
+	signaler := MakeTelegram(tgapi.MakeBot(http.DefaultClient, fake.URL, "token"), &common.Config{ChatId: testChannelId, TopicId: 7})
+	sub := signaler.Subscribe(nil)
+	go signaler.Run()
+	defer signaler.Close()
+
+	user := tgapi.User{Id: 5, FirstName: "Alice"}
+	if _, err := fake.PostUserMessage(testChannelId, 8, user, `{"type":"request","serial":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fake.PostUserMessage(testChannelId, 7, user, `{"type":"request","serial":2}`); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveHubMessage(t, sub); msg.Serial != 2 {
+		t.Fatalf("Got request %d, want the one from the other topic ignored", msg.Serial)
+	}
+
+	if err := signaler.Publish(&common.HubMessage{Type: "response", Serial: 2}); err != nil {
+		t.Fatal(err)
+	}
+	posts := fake.Messages(testChannelId)
+	if topic := posts[len(posts)-1].MessageThreadId; topic != 7 {
+		t.Fatalf("Posted to topic %d, want 7", topic)
+	}
+}
+
+// A newer getUpdates terminates the older one with 409 Conflict, just like
+// the Bot API does when two instances poll with the same token
+func TestTelegramBacksOffOnConflict(t *testing.T) {
+	fake := tgapitest.NewServer("token")
+	defer fake.Close()
+	fake.AddChannel(testChannelId, "hub")
+
+	signaler := MakeTelegram(tgapi.MakeBot(http.DefaultClient, fake.URL, "token"), &common.Config{ChatId: testChannelId})
+	done := make(chan error, 1)
+	go func() {
+		done <- signaler.Run()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	other := tgapi.MakeBot(http.DefaultClient, fake.URL, "token")
+	started := time.Now()
+	_, err := other.GetUpdates(&tgapi.GetUpdates{Timeout: 10})
+	if !common.IsConflict(err) {
+		t.Fatalf("Got %v, want the signaler to take polling back", err)
+	}
+	if elapsed := time.Since(started); elapsed < 500*time.Millisecond {
+		t.Fatalf("Took polling back after %v, want a backoff first", elapsed)
+	}
+
+	// Closing does not wait the next backoff out
+	go other.GetUpdates(&tgapi.GetUpdates{Timeout: 10})
+	time.Sleep(100 * time.Millisecond)
+	closed := time.Now()
+	signaler.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	if elapsed := time.Since(closed); elapsed > 500*time.Millisecond {
+		t.Fatalf("Run returned %v after Close", elapsed)
+	}
+}
@@ -186,31 +186,84 @@ func extractAddressFromBindingResponse(response []byte, expectedTransactionId []
 	return address, nil
 }
 
+// Builds a binding success response telling the client its reflexive address
+func MakeBindingResponse(request []byte, reflexiveAddress *net.UDPAddr) ([]byte, error) {
+	if len(request) < stunHeaderLen {
+		return nil, errors.New("STUN message header truncated")
+	}
+	if binary.BigEndian.Uint16(request[0:]) != 0x0001 {
+		return nil, errors.New("Not a binding request")
+	}
+	if binary.BigEndian.Uint32(request[4:]) != magicCookie {
+		return nil, errors.New("STUN message header malformed: magic cookie mismatch")
+	}
+
+	family := byte(familyIpv4)
+	address := reflexiveAddress.IP.To4()
+	if address == nil {
+		family = familyIpv6
+		address = reflexiveAddress.IP.To16()
+	}
+
+	attrLen := 4 + len(address)
+	response := make([]byte, stunHeaderLen + 4 + attrLen)
+
+	// Binding success response
+	binary.BigEndian.PutUint16(response[0:], 0x0101)
+	binary.BigEndian.PutUint16(response[2:], uint16(4 + attrLen))
+	copy(response[4:20], request[4:20])
+
+	// XOR-MAPPED-ADDRESS
+	attr := response[stunHeaderLen:]
+	binary.BigEndian.PutUint16(attr[0:], 0x0020)
+	binary.BigEndian.PutUint16(attr[2:], uint16(attrLen))
+	attr[5] = family
+	binary.BigEndian.PutUint16(attr[6:], uint16(reflexiveAddress.Port) ^ uint16(magicCookie >> 16))
+	copy(attr[8:], xorSlice(address, response[4:20]))
+
+	return response, nil
+}
+
 // Returns transaction ID + error
-func SendBindingRequest(conn *net.UDPConn, serverAddress *net.UDPAddr) ([]byte, error) {
+func SendBindingRequest(conn net.PacketConn, serverAddress *net.UDPAddr) ([]byte, error) {
 	request := makeBindingRequest()
-	nwritten, err := conn.WriteToUDP(request, serverAddress)
-	if err != nil {
+	if err := sendRequest(conn, serverAddress, request); err != nil {
 		return []byte{}, err
 	}
+	return request[8:], nil
+}
+
+// Sends the binding request with the same transaction ID once again
+func ResendBindingRequest(conn net.PacketConn, serverAddress *net.UDPAddr, transactionId []byte) error {
+	request := makeBindingRequest()
+	copy(request[8:], transactionId)
+	return sendRequest(conn, serverAddress, request)
+}
+
+func sendRequest(conn net.PacketConn, serverAddress *net.UDPAddr, request []byte) error {
+	nwritten, err := conn.WriteTo(request, serverAddress)
+	if err != nil {
+		return err
+	}
 	if nwritten != len(request) {
-		return []byte{}, errors.New("Outbound datagram truncated")
+		return errors.New("Outbound datagram truncated")
 	}
-	return request[8:], nil
+	return nil
 }
 
-func ReceiveBindingResponse(conn *net.UDPConn, serverAddress *net.UDPAddr, transactionId []byte) (*net.UDPAddr, error) {
+func ReceiveBindingResponse(conn net.PacketConn, serverAddress *net.UDPAddr, transactionId []byte) (*net.UDPAddr, error) {
 	var buffer [4096]byte
 	var nread int
 	for {
-		var addr *net.UDPAddr
+		var addr net.Addr
 		var err error
 
-		nread, addr, err = conn.ReadFromUDP(buffer[:])
+		nread, addr, err = conn.ReadFrom(buffer[:])
 		if err != nil {
 			return nil, err
 		}
-		if bytes.Compare(addr.IP, serverAddress.IP) == 0 && addr.Port == serverAddress.Port {
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if ok && udpAddr.IP.Equal(serverAddress.IP) && udpAddr.Port == serverAddress.Port {
 			break
 		}
 	}
@@ -221,7 +274,7 @@ func ReceiveBindingResponse(conn *net.UDPConn, serverAddress *net.UDPAddr, trans
 	return extractAddressFromBindingResponse(buffer[:nread], transactionId)
 }
 
-func GetReflexiveAddress(conn *net.UDPConn, serverAddress *net.UDPAddr) (*net.UDPAddr, error) {
+func GetReflexiveAddress(conn net.PacketConn, serverAddress *net.UDPAddr) (*net.UDPAddr, error) {
 	transactionId, err := SendBindingRequest(conn, serverAddress)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,332 @@
+package tgapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultApiUrl = "https://api.telegram.org"
+
+	// Header carrying SetWebhook.SecretToken in every webhook request
+	SecretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+	defaultRequestTimeout = 10 * time.Second
+	defaultMaxRetries     = 3
+)
+
+// Error is returned by Bot methods when the Bot API responds with ok=false
+type Error struct {
+	Method      string
+	Code        int
+	Description string
+	Parameters  *ResponseParameters
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s failed with code %d: %s", e.Method, e.Code, e.Description)
+}
+
+func (e *Error) RetryAfter() time.Duration {
+	if e.Parameters == nil || e.Parameters.RetryAfter == nil {
+		return 0
+	}
+	return time.Duration(*e.Parameters.RetryAfter) * time.Second
+}
+
+func (e *Error) MigrateToChatId() (int64, bool) {
+	if e.Parameters == nil || e.Parameters.MigrateToChatId == nil {
+		return 0, false
+	}
+	return *e.Parameters.MigrateToChatId, true
+}
+
+// A file sent along with the request parameters
+type Upload struct {
+	Field    string
+	FileName string
+	Contents io.Reader
+}
+
+type Bot struct {
+	client *http.Client
+	apiUrl string
+	token  string
+
+	// Set when talking to a telegram-bot-api server started with --local.
+	// Such a server takes files by their path on its own file system
+	// instead of as uploads.
+	LocalMode bool
+
+	// Timeout for a single request. Long polling getUpdates calls get
+	// their poll timeout added on top of it.
+	RequestTimeout time.Duration
+
+	// How many times a request is repeated after a 429 with retry_after
+	MaxRetries int
+
+	mu sync.Mutex
+	// New IDs of the groups upgraded to supergroups, by the old ID
+	migrated map[int64]int64
+}
+
+func MakeBot(client *http.Client, apiUrl string, token string) *Bot {
+	return &Bot{
+		client:         client,
+		apiUrl:         strings.TrimSuffix(apiUrl, "/"),
+		token:          token,
+		RequestTimeout: defaultRequestTimeout,
+		MaxRetries:     defaultMaxRetries,
+		migrated:       make(map[int64]int64),
+	}
+}
+
+// Returns the ID the chat has now, following the upgrades to supergroups
+// the bot has run into. Chat methods do so by themselves, callers need it
+// to recognize the chat in updates.
+func (bot *Bot) CurrentChatId(chatId int64) int64 {
+	bot.mu.Lock()
+	defer bot.mu.Unlock()
+	// A supergroup is never upgraded again, but stay safe from loops
+	for i := 0; i < 8; i++ {
+		newChatId, ok := bot.migrated[chatId]
+		if !ok {
+			break
+		}
+		chatId = newChatId
+	}
+	return chatId
+}
+
+func (bot *Bot) doRequest(method string, params interface{}, timeout time.Duration) (*Response, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, errors.New("Cannot serialize " + method + " request: " + err.Error())
+	}
+	return bot.post(method, "application/json", body, timeout)
+}
+
+// Same as doRequest, but sends params as multipart/form-data together with
+// the contents of a file. Top-level params become form fields, non-string
+// values are JSON-encoded as the Bot API expects.
+func (bot *Bot) doUploadRequest(method string, params interface{}, upload *Upload, timeout time.Duration) (*Response, error) {
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return nil, errors.New("Cannot serialize " + method + " request: " + err.Error())
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(encoded, &fields); err != nil {
+		return nil, errors.New("Cannot serialize " + method + " request: " + err.Error())
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		var text string
+		if json.Unmarshal(value, &text) != nil {
+			text = string(value)
+		}
+		if err = writer.WriteField(name, text); err != nil {
+			return nil, err
+		}
+	}
+
+	part, err := writer.CreateFormFile(upload.Field, upload.FileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(part, upload.Contents); err != nil {
+		return nil, errors.New("Cannot read " + upload.FileName + ": " + err.Error())
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return bot.post(method, writer.FormDataContentType(), body.Bytes(), timeout)
+}
+
+func (bot *Bot) post(method string, contentType string, body []byte, timeout time.Duration) (*Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, bot.apiUrl+"/bot"+bot.token+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", contentType)
+
+	response, err := bot.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var apiResponse Response
+	if err = json.NewDecoder(response.Body).Decode(&apiResponse); err != nil {
+		return nil, errors.New("Cannot decode JSON response from server: " + err.Error())
+	}
+	return &apiResponse, nil
+}
+
+func (bot *Bot) call(method string, params interface{}, timeout time.Duration, result interface{}) error {
+	return bot.callWithUpload(method, params, nil, timeout, result)
+}
+
+func (bot *Bot) callWithUpload(method string, params interface{}, upload *Upload, timeout time.Duration, result interface{}) error {
+	// The upload can only be read once, so requests carrying it are not retried
+	maxRetries := bot.MaxRetries
+	if upload != nil {
+		maxRetries = 0
+	}
+
+	for retries := 0; ; retries++ {
+		var apiResponse *Response
+		var err error
+		if upload != nil {
+			apiResponse, err = bot.doUploadRequest(method, params, upload, timeout)
+		} else {
+			apiResponse, err = bot.doRequest(method, params, timeout)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !apiResponse.Ok {
+			apiErr := &Error{
+				Method:      method,
+				Description: "Unknown error",
+				Parameters:  apiResponse.Parameters,
+			}
+			if apiResponse.ErrorCode != nil {
+				apiErr.Code = *apiResponse.ErrorCode
+			}
+			if apiResponse.Description != nil {
+				apiErr.Description = *apiResponse.Description
+			}
+
+			if delay := apiErr.RetryAfter(); delay > 0 && retries < maxRetries {
+				fmt.Printf("%s is rate limited, retrying after %v\n", method, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return apiErr
+		}
+
+		if result == nil {
+			return nil
+		}
+		if err = json.Unmarshal(apiResponse.Result, result); err != nil {
+			return errors.New("Cannot decode " + method + " result: " + err.Error())
+		}
+		return nil
+	}
+}
+
+// Same as call, but repeats the request once against the new chat if the
+// group has been upgraded to a supergroup, and sends later requests for
+// the old chat to the new one. chatId must point into params.
+func (bot *Bot) callChat(method string, chatId *int64, params interface{}, result interface{}) error {
+	*chatId = bot.CurrentChatId(*chatId)
+	err := bot.call(method, params, bot.RequestTimeout, result)
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	newChatId, migrated := apiErr.MigrateToChatId()
+	if !migrated {
+		return err
+	}
+
+	fmt.Printf("Chat %d migrated to %d\n", *chatId, newChatId)
+	bot.mu.Lock()
+	bot.migrated[*chatId] = newChatId
+	bot.mu.Unlock()
+	*chatId = newChatId
+	return bot.call(method, params, bot.RequestTimeout, result)
+}
+
+func (bot *Bot) GetMe() (*User, error) {
+	var user User
+	if err := bot.call("getMe", struct{}{}, bot.RequestTimeout, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (bot *Bot) GetUpdates(params *GetUpdates) ([]Update, error) {
+	timeout := bot.RequestTimeout + time.Duration(params.Timeout)*time.Second
+
+	var updates []Update
+	if err := bot.call("getUpdates", params, timeout, &updates); err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+func (bot *Bot) SendMessage(params *SendMessage) (*Message, error) {
+	var message Message
+	if err := bot.callChat("sendMessage", &params.ChatId, params, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (bot *Bot) EditMessageText(params *EditMessageText) (*Message, error) {
+	var message Message
+	if err := bot.callChat("editMessageText", &params.ChatId, params, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Stops the spinner on the pressed button, optionally showing the text
+func (bot *Bot) AnswerCallbackQuery(params *AnswerCallbackQuery) error {
+	return bot.call("answerCallbackQuery", params, bot.RequestTimeout, nil)
+}
+
+func (bot *Bot) AnswerInlineQuery(params *AnswerInlineQuery) error {
+	return bot.call("answerInlineQuery", params, bot.RequestTimeout, nil)
+}
+
+// Sets the command list Telegram clients suggest after typing a slash
+func (bot *Bot) SetMyCommands(params *SetMyCommands) error {
+	return bot.call("setMyCommands", params, bot.RequestTimeout, nil)
+}
+
+func (bot *Bot) DeleteMessage(params *DeleteMessage) error {
+	return bot.callChat("deleteMessage", &params.ChatId, params, nil)
+}
+
+func (bot *Bot) GetChat(params *GetChat) (*Chat, error) {
+	var chat Chat
+	if err := bot.callChat("getChat", &params.ChatId, params, &chat); err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+// Registers the webhook. A self-signed certificate has to be uploaded with
+// it, pass nil otherwise.
+// In local mode the certificate is passed as a file:// URI in params
+// instead of being uploaded
+func (bot *Bot) SetWebhook(params *SetWebhook, certificate io.Reader) error {
+	if certificate == nil {
+		return bot.call("setWebhook", params, bot.RequestTimeout, nil)
+	}
+	upload := &Upload{Field: "certificate", FileName: "certificate.pem", Contents: certificate}
+	return bot.callWithUpload("setWebhook", params, upload, bot.RequestTimeout, nil)
+}
+
+func (bot *Bot) DeleteWebhook(params *DeleteWebhook) error {
+	return bot.call("deleteWebhook", params, bot.RequestTimeout, nil)
+}
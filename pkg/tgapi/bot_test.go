@@ -0,0 +1,130 @@
+package tgapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Answers every call of a method with the reply the handler picks, and
+// counts the calls per method
+type fakeApi struct {
+	mu    sync.Mutex
+	calls map[string]int
+	reply func(method string, params map[string]interface{}, call int) string
+}
+
+func startFakeApi(t *testing.T, reply func(method string, params map[string]interface{}, call int) string) (*Bot, *fakeApi) {
+	t.Helper()
+	api := &fakeApi{calls: make(map[string]int), reply: reply}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		var params map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&params)
+
+		api.mu.Lock()
+		api.calls[method]++
+		call := api.calls[method]
+		api.mu.Unlock()
+		w.Write([]byte(api.reply(method, params, call)))
+	}))
+	t.Cleanup(server.Close)
+	return MakeBot(server.Client(), server.URL, "token"), api
+}
+
+func (api *fakeApi) count(method string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.calls[method]
+}
+
+func TestErrorDecoding(t *testing.T) {
+	bot, _ := startFakeApi(t, func(string, map[string]interface{}, int) string {
+		return `{"ok":false,"error_code":403,"description":"Forbidden: bot was kicked from the group chat"}`
+	})
+	_, err := bot.SendMessage(&SendMessage{ChatId: -5, Text: "hello"})
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Got %v, want an API error", err)
+	}
+	if apiErr.Method != "sendMessage" || apiErr.Code != 403 || apiErr.Description != "Forbidden: bot was kicked from the group chat" {
+		t.Fatalf("Got %+v", apiErr)
+	}
+	if apiErr.RetryAfter() != 0 {
+		t.Fatalf("Got retry after %v without the parameter", apiErr.RetryAfter())
+	}
+	if _, migrated := apiErr.MigrateToChatId(); migrated {
+		t.Fatal("Got a migration without the parameter")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	bot, api := startFakeApi(t, func(method string, params map[string]interface{}, call int) string {
+		if call == 1 {
+			return `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`
+		}
+		return `{"ok":true,"result":true}`
+	})
+
+	started := time.Now()
+	if err := bot.AnswerCallbackQuery(&AnswerCallbackQuery{CallbackQueryId: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if api.count("answerCallbackQuery") != 2 {
+		t.Fatalf("%d calls, want the rate limited one repeated", api.count("answerCallbackQuery"))
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Fatalf("Repeated after %v, want retry_after honoured", elapsed)
+	}
+}
+
+func TestRetryAfterGivesUp(t *testing.T) {
+	bot, api := startFakeApi(t, func(string, map[string]interface{}, int) string {
+		return `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 5","parameters":{"retry_after":5}}`
+	})
+	bot.MaxRetries = 0
+
+	err := bot.AnswerCallbackQuery(&AnswerCallbackQuery{CallbackQueryId: "1"})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != 429 || apiErr.RetryAfter() != 5*time.Second {
+		t.Fatalf("Got %v, want a 429 with retry after 5s", err)
+	}
+	if api.count("answerCallbackQuery") != 1 {
+		t.Fatalf("%d calls, want no retries", api.count("answerCallbackQuery"))
+	}
+}
+
+func TestMigrateToChatId(t *testing.T) {
+	bot, api := startFakeApi(t, func(method string, params map[string]interface{}, call int) string {
+		if params["chat_id"] == float64(-5) {
+			return `{"ok":false,"error_code":400,"description":"Bad Request: group chat was upgraded to a supergroup chat","parameters":{"migrate_to_chat_id":-1005}}`
+		}
+		return `{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":-1005,"type":"supergroup"}}}`
+	})
+
+	params := &SendMessage{ChatId: -5, Text: "hello"}
+	message, err := bot.SendMessage(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Chat.Id != -1005 || params.ChatId != -1005 {
+		t.Fatalf("Sent to %d with chat ID %d, want the supergroup", message.Chat.Id, params.ChatId)
+	}
+	if bot.CurrentChatId(-5) != -1005 || bot.CurrentChatId(-6) != -6 {
+		t.Fatalf("Chat -5 is now %d and -6 is %d", bot.CurrentChatId(-5), bot.CurrentChatId(-6))
+	}
+
+	// Callers holding the old ID do not run into the migration again
+	if _, err = bot.EditMessageText(&EditMessageText{ChatId: -5, MessageId: 1, Text: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if api.count("sendMessage") != 2 || api.count("editMessageText") != 1 {
+		t.Fatalf("%d sendMessage and %d editMessageText calls, want 2 and 1", api.count("sendMessage"), api.count("editMessageText"))
+	}
+}
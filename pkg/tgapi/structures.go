@@ -1,5 +1,7 @@
 package tgapi
 
+import "encoding/json"
+
 type GetUpdates struct {
 	Offset          int                   `json:"offset"`
 	Limit           int                   `json:"limit"`
@@ -7,22 +9,75 @@ type GetUpdates struct {
 	AllowedUpdates  []string              `json:"allowed_updates"`
 }
 
-type GetMeResponse struct {
-	Ok              bool                  `json:"ok"`
-	Result          *User                 `json:"result"`
-    Description     *string               `json:"description"`
+type SendMessage struct {
+	ChatId              int64              `json:"chat_id"`
+	Text                string             `json:"text"`
+	ParseMode           string             `json:"parse_mode,omitempty"`
+	DisableNotification bool               `json:"disable_notification,omitempty"`
+	ReplyToMessageId    int                `json:"reply_to_message_id,omitempty"`
+	MessageThreadId     int                `json:"message_thread_id,omitempty"`
+	ReplyMarkup         *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
 }
 
-type GetUpdatesResponse struct {
-	Ok              bool                  `json:"ok"`
-	Result          []Update              `json:"result"`
-    Description     *string               `json:"description"`
+type EditMessageText struct {
+	ChatId              int64              `json:"chat_id"`
+	MessageId           int                `json:"message_id"`
+	Text                string             `json:"text"`
+	ParseMode           string             `json:"parse_mode,omitempty"`
+	// Leaving it out removes the keyboard
+	ReplyMarkup         *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+type AnswerCallbackQuery struct {
+	CallbackQueryId     string             `json:"callback_query_id"`
+	Text                string             `json:"text,omitempty"`
+	ShowAlert           bool               `json:"show_alert,omitempty"`
+}
+
+type BotCommand struct {
+	// 1-32 lowercase letters, digits and underscores, without the slash
+	Command         string                `json:"command"`
+	Description     string                `json:"description"`
+}
+
+type SetMyCommands struct {
+	Commands        []BotCommand          `json:"commands"`
+}
+
+type DeleteMessage struct {
+	ChatId          int64                 `json:"chat_id"`
+	MessageId       int                   `json:"message_id"`
+}
+
+type GetChat struct {
+	ChatId          int64                 `json:"chat_id"`
+}
+
+type SetWebhook struct {
+	Url                 string             `json:"url"`
+	MaxConnections      int                `json:"max_connections,omitempty"`
+	AllowedUpdates      []string           `json:"allowed_updates,omitempty"`
+	DropPendingUpdates  bool               `json:"drop_pending_updates,omitempty"`
+	SecretToken         string             `json:"secret_token,omitempty"`
+	// file:// URI of the certificate, for servers in local mode
+	Certificate         string             `json:"certificate,omitempty"`
+}
+
+type DeleteWebhook struct {
+	DropPendingUpdates  bool               `json:"drop_pending_updates,omitempty"`
 }
 
-type SendMessageResponse struct {
+type Response struct {
 	Ok              bool                  `json:"ok"`
-	Result          *Message              `json:"result"`
-    Description     *string               `json:"description"`
+	Result          json.RawMessage       `json:"result"`
+	Description     *string               `json:"description"`
+	ErrorCode       *int                  `json:"error_code"`
+	Parameters      *ResponseParameters   `json:"parameters"`
+}
+
+type ResponseParameters struct {
+	MigrateToChatId *int64                `json:"migrate_to_chat_id"`
+	RetryAfter      *int                  `json:"retry_after"`
 }
 
 type Update struct {
@@ -30,11 +85,12 @@ type Update struct {
 	Message         *Message              `json:"message"`
 	ChannelPost     *Message              `json:"channel_post"`
 	InlineQuery     *InlineQuery          `json:"inline_query"`
+	CallbackQuery   *CallbackQuery        `json:"callback_query"`
 }
 
 type Chat struct {
 	Id                  int64              `json:"id"`
-	ChatType            string             `json:"chat_type"`
+	ChatType            string             `json:"type"`
 	Title               *string            `json:"title"`
 	Username            *string            `json:"username"`
 	FirstName           *string            `json:"first_name"`
@@ -44,13 +100,38 @@ type Chat struct {
 	PinnedMessage       *Message           `json:"pinned_message"`
 	StickerSetName      *string            `json:"sticker_set_name"`
 	CanSetStickerSet    *bool              `json:"can_set_sticker_set"`
+	IsForum             bool               `json:"is_forum"`
 }
 
 type Message struct {
 	Id              int                   `json:"message_id"`
+	MessageThreadId int                   `json:"message_thread_id"`
+	From            *User                 `json:"from"`
+	Date            int64                 `json:"date"`
 	Chat            Chat                  `json:"chat"`
+	IsTopicMessage  bool                  `json:"is_topic_message"`
 	Text            *string               `json:"text"`
 	Sticker         *Sticker              `json:"sticker"`
+	ReplyMarkup     *InlineKeyboardMarkup `json:"reply_markup"`
+}
+
+type InlineKeyboardMarkup struct {
+	InlineKeyboard  [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type InlineKeyboardButton struct {
+	Text            string                `json:"text"`
+	CallbackData    string                `json:"callback_data,omitempty"`
+	Url             string                `json:"url,omitempty"`
+}
+
+// Sent when someone presses an inline keyboard button with callback data.
+// Message is nil if the message is too old.
+type CallbackQuery struct {
+	Id              string                `json:"id"`
+	From            User                  `json:"from"`
+	Message         *Message              `json:"message"`
+	Data            string                `json:"data"`
 }
 
 type Sticker struct {
@@ -79,7 +160,24 @@ type InlineQueryResultCachedSticker struct {
 	StickerFileId   string                `json:"sticker_file_id"`
 }
 
+type InlineQueryResultArticle struct {
+	Type                string                  `json:"type"`
+	Id                  string                  `json:"id"`
+	Title               string                  `json:"title"`
+	Description         string                  `json:"description,omitempty"`
+	InputMessageContent InputTextMessageContent `json:"input_message_content"`
+}
+
+type InputTextMessageContent struct {
+	MessageText     string                `json:"message_text"`
+	ParseMode       string                `json:"parse_mode,omitempty"`
+}
+
 type AnswerInlineQuery struct {
-	InlineQueryId   string                           `json:"inline_query_id"`
-	Results         []InlineQueryResultCachedSticker `json:"results"`
+	InlineQueryId   string                `json:"inline_query_id"`
+	// InlineQueryResult* structures
+	Results         []interface{}         `json:"results"`
+	// Telegram caches results for 300 seconds unless told otherwise
+	CacheTime       int                   `json:"cache_time"`
+	IsPersonal      bool                  `json:"is_personal,omitempty"`
 }
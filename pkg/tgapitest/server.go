@@ -0,0 +1,793 @@
+// Package tgapitest runs an in-process fake of the Telegram Bot API for tests.
+// Point tgapi.MakeBot at Server.URL to use it.
+package tgapitest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/ovandriyanov/tgpunch/pkg/tgapi"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxUpdatesLimit      = 100
+	webhookRetryInterval = 100 * time.Millisecond
+)
+
+var botCommandPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+type injectedError struct {
+	code        int
+	description string
+	parameters  *tgapi.ResponseParameters
+}
+
+type rateLimit struct {
+	limit  int
+	window time.Duration
+	calls  []time.Time
+}
+
+type Server struct {
+	URL   string
+	Token string
+	Bot   tgapi.User
+
+	httpServer *httptest.Server
+
+	mu             sync.Mutex
+	chats          map[int64]*tgapi.Chat
+	messages       map[int64][]tgapi.Message
+	nextMessageId  map[int64]int
+	updates        []tgapi.Update
+	nextUpdateId   int
+	allowedUpdates []string
+	updated        chan struct{}
+	pollGeneration int
+	webhookStop    chan struct{}
+	// Answers to callback queries by query ID, nil until answered
+	callbackQueries map[string]*tgapi.AnswerCallbackQuery
+	inlineQueries   map[string]*tgapi.AnswerInlineQuery
+	nextQueryId     int
+	commands        []tgapi.BotCommand
+
+	errors     map[string][]injectedError
+	delays     map[string]time.Duration
+	rateLimits map[string]*rateLimit
+}
+
+func NewServer(token string) *Server {
+	server := &Server{
+		Token: token,
+		Bot: tgapi.User{
+			Id:        1,
+			IsBot:     true,
+			FirstName: "tgpunch",
+		},
+		chats:         make(map[int64]*tgapi.Chat),
+		messages:      make(map[int64][]tgapi.Message),
+		nextMessageId: make(map[int64]int),
+		nextUpdateId:  1,
+		updated:       make(chan struct{}),
+		errors:        make(map[string][]injectedError),
+		delays:        make(map[string]time.Duration),
+		rateLimits:    make(map[string]*rateLimit),
+
+		callbackQueries: make(map[string]*tgapi.AnswerCallbackQuery),
+		inlineQueries:   make(map[string]*tgapi.AnswerInlineQuery),
+	}
+	server.httpServer = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	server.URL = server.httpServer.URL
+	return server
+}
+
+// Cuts off getUpdates long polls still in progress rather than waiting them out
+func (server *Server) Close() {
+	server.mu.Lock()
+	server.stopWebhookLocked()
+	server.mu.Unlock()
+	server.httpServer.CloseClientConnections()
+	server.httpServer.Close()
+}
+
+func (server *Server) AddChannel(chatId int64, title string) {
+	server.AddChat(tgapi.Chat{Id: chatId, ChatType: "channel", Title: &title})
+}
+
+func (server *Server) AddChat(chat tgapi.Chat) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.chats[chat.Id] = &chat
+}
+
+// Posts a message to a chat as if someone other than the bot sent it
+func (server *Server) PostMessage(chatId int64, text string) (*tgapi.Message, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.postLocked(chatId, 0, nil, text, nil)
+}
+
+// Posts a message from the user, to a forum topic unless threadId is zero
+func (server *Server) PostUserMessage(chatId int64, threadId int, from tgapi.User, text string) (*tgapi.Message, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.postLocked(chatId, threadId, &from, text, nil)
+}
+
+// Presses the inline keyboard button with the callback data under the
+// message as the user. Returns the ID of the resulting callback query.
+func (server *Server) PressButton(chatId int64, messageId int, from tgapi.User, data string) (string, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	i, err := server.findMessageLocked(chatId, messageId)
+	if err != nil {
+		return "", err
+	}
+	message := server.messages[chatId][i]
+	found := false
+	if message.ReplyMarkup != nil {
+		for _, row := range message.ReplyMarkup.InlineKeyboard {
+			for _, button := range row {
+				found = found || button.CallbackData == data
+			}
+		}
+	}
+	if !found {
+		return "", &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: no such button"}
+	}
+
+	server.nextQueryId++
+	queryId := strconv.Itoa(server.nextQueryId)
+	server.callbackQueries[queryId] = nil
+	server.pushUpdateLocked(tgapi.Update{CallbackQuery: &tgapi.CallbackQuery{
+		Id:      queryId,
+		From:    from,
+		Message: &message,
+		Data:    data,
+	}})
+	return queryId, nil
+}
+
+// Types the query after the bot's username as the user. Returns the ID
+// of the resulting inline query.
+func (server *Server) SendInlineQuery(from tgapi.User, query string) string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.nextQueryId++
+	queryId := strconv.Itoa(server.nextQueryId)
+	server.inlineQueries[queryId] = nil
+	server.pushUpdateLocked(tgapi.Update{InlineQuery: &tgapi.InlineQuery{
+		Id:    queryId,
+		From:  from,
+		Query: query,
+	}})
+	return queryId
+}
+
+// Returns the bot's answer to the inline query, false if there is none yet
+func (server *Server) InlineAnswer(queryId string) (*tgapi.AnswerInlineQuery, bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	answer := server.inlineQueries[queryId]
+	return answer, answer != nil
+}
+
+// Returns the command list set by setMyCommands
+func (server *Server) Commands() []tgapi.BotCommand {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]tgapi.BotCommand(nil), server.commands...)
+}
+
+// Returns the bot's answer to the callback query, false if there is none
+// yet
+func (server *Server) CallbackAnswer(queryId string) (*tgapi.AnswerCallbackQuery, bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	answer := server.callbackQueries[queryId]
+	return answer, answer != nil
+}
+
+// Returns the messages currently present in the chat history
+func (server *Server) Messages(chatId int64) []tgapi.Message {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]tgapi.Message(nil), server.messages[chatId]...)
+}
+
+// Makes the next call of the method fail with the given error. Several
+// injected errors for the same method are returned in order.
+func (server *Server) InjectError(method string, code int, description string, parameters *tgapi.ResponseParameters) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.errors[method] = append(server.errors[method], injectedError{
+		code:        code,
+		description: description,
+		parameters:  parameters,
+	})
+}
+
+// Delays every call of the method before it is handled
+func (server *Server) SetDelay(method string, delay time.Duration) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.delays[method] = delay
+}
+
+// Answers with 429 and retry_after once the method is called more than
+// limit times within the window. A zero limit removes the rate limit.
+func (server *Server) SetRateLimit(method string, limit int, window time.Duration) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if limit == 0 {
+		delete(server.rateLimits, method)
+		return
+	}
+	server.rateLimits[method] = &rateLimit{limit: limit, window: window}
+}
+
+// Channel posts have no sender and reach every bot in the channel, the
+// bot's own ones included, which keeps a single fake usable by both peers.
+// Like Telegram, groups and private chats show bots only what people post
+// there, so messages of bots, ours included, do not become message updates.
+func (server *Server) postLocked(chatId int64, threadId int, from *tgapi.User, text string, markup *tgapi.InlineKeyboardMarkup) (*tgapi.Message, error) {
+	chat, ok := server.chats[chatId]
+	if !ok {
+		return nil, &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: chat not found"}
+	}
+	if threadId != 0 && !chat.IsForum {
+		return nil, &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: message thread not found"}
+	}
+
+	server.nextMessageId[chatId]++
+	message := tgapi.Message{
+		Id:              server.nextMessageId[chatId],
+		MessageThreadId: threadId,
+		Date:            time.Now().Unix(),
+		Chat:            *chat,
+		IsTopicMessage:  threadId != 0,
+		Text:            &text,
+		ReplyMarkup:     markup,
+	}
+	if chat.ChatType != "channel" {
+		message.From = from
+	}
+	server.messages[chatId] = append(server.messages[chatId], message)
+
+	update := message
+	if chat.ChatType == "channel" {
+		server.pushUpdateLocked(tgapi.Update{ChannelPost: &update})
+	} else if from == nil || !from.IsBot {
+		server.pushUpdateLocked(tgapi.Update{Message: &update})
+	}
+	return &message, nil
+}
+
+func (server *Server) pushUpdateLocked(update tgapi.Update) {
+	update.Id = server.nextUpdateId
+	server.nextUpdateId++
+	server.updates = append(server.updates, update)
+	server.notifyLocked()
+}
+
+// Wakes up all long polling getUpdates requests
+func (server *Server) notifyLocked() {
+	close(server.updated)
+	server.updated = make(chan struct{})
+}
+
+func (server *Server) findMessageLocked(chatId int64, messageId int) (int, error) {
+	if _, ok := server.chats[chatId]; !ok {
+		return 0, &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: chat not found"}
+	}
+	for i, message := range server.messages[chatId] {
+		if message.Id == messageId {
+			return i, nil
+		}
+	}
+	return 0, &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: message to edit not found"}
+}
+
+// Returns the hook-injected error for this call, if any
+func (server *Server) checkHooksLocked(method string) *tgapi.Error {
+	if injected := server.errors[method]; len(injected) > 0 {
+		server.errors[method] = injected[1:]
+		return &tgapi.Error{
+			Code:        injected[0].code,
+			Description: injected[0].description,
+			Parameters:  injected[0].parameters,
+		}
+	}
+
+	limit, ok := server.rateLimits[method]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	recent := limit.calls[:0]
+	for _, call := range limit.calls {
+		if now.Sub(call) < limit.window {
+			recent = append(recent, call)
+		}
+	}
+	limit.calls = recent
+
+	if len(limit.calls) >= limit.limit {
+		retryAfter := int((limit.window - now.Sub(limit.calls[0]) + time.Second - 1) / time.Second)
+		return &tgapi.Error{
+			Code:        http.StatusTooManyRequests,
+			Description: fmt.Sprintf("Too Many Requests: retry after %d", retryAfter),
+			Parameters:  &tgapi.ResponseParameters{RetryAfter: &retryAfter},
+		}
+	}
+	limit.calls = append(limit.calls, now)
+	return nil
+}
+
+func (server *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/bot")
+	slash := strings.LastIndex(path, "/")
+	if path == r.URL.Path || slash < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	token, method := path[:slash], path[slash+1:]
+	if token != server.Token {
+		writeError(w, &tgapi.Error{Code: http.StatusUnauthorized, Description: "Unauthorized"})
+		return
+	}
+
+	server.mu.Lock()
+	delay := server.delays[method]
+	server.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	server.mu.Lock()
+	hookErr := server.checkHooksLocked(method)
+	server.mu.Unlock()
+	if hookErr != nil {
+		writeError(w, hookErr)
+		return
+	}
+
+	var result interface{}
+	var err error
+	switch method {
+	case "getMe":
+		result = server.Bot
+	case "getUpdates":
+		var params tgapi.GetUpdates
+		if err = decodeParams(r, &params); err == nil {
+			result, err = server.getUpdates(r, &params)
+		}
+	case "sendMessage":
+		var params tgapi.SendMessage
+		if err = decodeParams(r, &params); err == nil {
+			result, err = server.sendMessage(&params)
+		}
+	case "editMessageText":
+		var params tgapi.EditMessageText
+		if err = decodeParams(r, &params); err == nil {
+			result, err = server.editMessageText(&params)
+		}
+	case "answerCallbackQuery":
+		var params tgapi.AnswerCallbackQuery
+		if err = decodeParams(r, &params); err == nil {
+			result, err = true, server.answerCallbackQuery(&params)
+		}
+	case "answerInlineQuery":
+		var params tgapi.AnswerInlineQuery
+		if err = decodeParams(r, &params); err == nil {
+			result, err = true, server.answerInlineQuery(&params)
+		}
+	case "setMyCommands":
+		var params tgapi.SetMyCommands
+		if err = decodeParams(r, &params); err == nil {
+			result, err = true, server.setMyCommands(&params)
+		}
+	case "deleteMessage":
+		var params tgapi.DeleteMessage
+		if err = decodeParams(r, &params); err == nil {
+			result, err = true, server.deleteMessage(&params)
+		}
+	case "setWebhook":
+		var params tgapi.SetWebhook
+		if err = decodeWebhookParams(r, &params); err == nil {
+			result, err = true, server.setWebhook(&params)
+		}
+	case "deleteWebhook":
+		var params tgapi.DeleteWebhook
+		if err = decodeParams(r, &params); err == nil {
+			result, err = true, server.deleteWebhook(&params)
+		}
+	case "getChat":
+		var params tgapi.GetChat
+		if err = decodeParams(r, &params); err == nil {
+			result, err = server.getChat(&params)
+		}
+	default:
+		err = &tgapi.Error{Code: http.StatusNotFound, Description: "Not Found"}
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, result)
+}
+
+func (server *Server) getUpdates(r *http.Request, params *tgapi.GetUpdates) ([]tgapi.Update, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.webhookStop != nil {
+		return nil, &tgapi.Error{
+			Code:        http.StatusConflict,
+			Description: "Conflict: can't use getUpdates method while webhook is active; use deleteWebhook to delete the webhook first",
+		}
+	}
+
+	// Only one getUpdates request may be active at a time; a newer one
+	// terminates the older one just like the real Bot API does.
+	server.pollGeneration++
+	generation := server.pollGeneration
+	server.notifyLocked()
+
+	if params.AllowedUpdates != nil {
+		server.allowedUpdates = params.AllowedUpdates
+	}
+
+	if params.Offset > 0 {
+		confirmed := 0
+		for confirmed < len(server.updates) && server.updates[confirmed].Id < params.Offset {
+			confirmed++
+		}
+		server.updates = server.updates[confirmed:]
+	}
+
+	limit := params.Limit
+	if limit <= 0 || limit > maxUpdatesLimit {
+		limit = maxUpdatesLimit
+	}
+	deadline := time.After(time.Duration(params.Timeout) * time.Second)
+
+	for {
+		var result []tgapi.Update
+		if params.Offset < 0 {
+			// Negative offsets count from the end of the queue and forget
+			// everything before the returned updates
+			first := len(server.updates) + params.Offset
+			if first < 0 {
+				first = 0
+			}
+			server.updates = server.updates[first:]
+		}
+		for _, update := range server.updates {
+			if len(result) == limit {
+				break
+			}
+			if update.Id >= params.Offset && server.isAllowedLocked(&update) {
+				result = append(result, update)
+			}
+		}
+		if len(result) > 0 || params.Timeout == 0 {
+			return result, nil
+		}
+
+		updated := server.updated
+		server.mu.Unlock()
+		select {
+		case <-updated:
+		case <-deadline:
+			server.mu.Lock()
+			return []tgapi.Update{}, nil
+		case <-r.Context().Done():
+			server.mu.Lock()
+			return nil, r.Context().Err()
+		}
+		server.mu.Lock()
+
+		if server.pollGeneration != generation {
+			return nil, &tgapi.Error{
+				Code:        http.StatusConflict,
+				Description: "Conflict: terminated by other getUpdates request; make sure that only one bot instance is running",
+			}
+		}
+	}
+}
+
+func (server *Server) setWebhook(params *tgapi.SetWebhook) error {
+	if params.Url == "" {
+		return server.deleteWebhook(&tgapi.DeleteWebhook{DropPendingUpdates: params.DropPendingUpdates})
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.stopWebhookLocked()
+	if params.DropPendingUpdates {
+		server.updates = nil
+	}
+	if params.AllowedUpdates != nil {
+		server.allowedUpdates = params.AllowedUpdates
+	}
+
+	// Terminate long polling requests, they are not allowed from now on
+	server.pollGeneration++
+	server.notifyLocked()
+
+	stop := make(chan struct{})
+	server.webhookStop = stop
+	go server.deliverWebhook(params.Url, params.SecretToken, stop)
+	return nil
+}
+
+func (server *Server) deleteWebhook(params *tgapi.DeleteWebhook) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.stopWebhookLocked()
+	if params.DropPendingUpdates {
+		server.updates = nil
+	}
+	return nil
+}
+
+func (server *Server) stopWebhookLocked() {
+	if server.webhookStop != nil {
+		close(server.webhookStop)
+		server.webhookStop = nil
+	}
+}
+
+// POSTs pending updates to the webhook one by one until stopped. An
+// update is confirmed once the webhook answers with 2xx.
+func (server *Server) deliverWebhook(url string, secretToken string, stop chan struct{}) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// Webhooks in tests use self-signed certificates
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	for {
+		server.mu.Lock()
+		for len(server.updates) > 0 && !server.isAllowedLocked(&server.updates[0]) {
+			server.updates = server.updates[1:]
+		}
+		if len(server.updates) == 0 {
+			updated := server.updated
+			server.mu.Unlock()
+			select {
+			case <-updated:
+				continue
+			case <-stop:
+				return
+			}
+		}
+		update := server.updates[0]
+		server.mu.Unlock()
+
+		if server.postUpdate(client, url, secretToken, &update) {
+			server.mu.Lock()
+			if len(server.updates) > 0 && server.updates[0].Id == update.Id {
+				server.updates = server.updates[1:]
+			}
+			server.mu.Unlock()
+			continue
+		}
+
+		select {
+		case <-time.After(webhookRetryInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (server *Server) postUpdate(client *http.Client, url string, secretToken string, update *tgapi.Update) bool {
+	body, err := json.Marshal(update)
+	if err != nil {
+		return false
+	}
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if secretToken != "" {
+		request.Header.Set(tgapi.SecretTokenHeader, secretToken)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode >= 200 && response.StatusCode < 300
+}
+
+func (server *Server) isAllowedLocked(update *tgapi.Update) bool {
+	if len(server.allowedUpdates) == 0 {
+		return true
+	}
+	for _, allowed := range server.allowedUpdates {
+		switch {
+		case allowed == "message" && update.Message != nil:
+			return true
+		case allowed == "channel_post" && update.ChannelPost != nil:
+			return true
+		case allowed == "inline_query" && update.InlineQuery != nil:
+			return true
+		case allowed == "callback_query" && update.CallbackQuery != nil:
+			return true
+		}
+	}
+	return false
+}
+
+func (server *Server) sendMessage(params *tgapi.SendMessage) (*tgapi.Message, error) {
+	if params.Text == "" {
+		return nil, &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: message text is empty"}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.postLocked(params.ChatId, params.MessageThreadId, &server.Bot, params.Text, params.ReplyMarkup)
+}
+
+func (server *Server) editMessageText(params *tgapi.EditMessageText) (*tgapi.Message, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	i, err := server.findMessageLocked(params.ChatId, params.MessageId)
+	if err != nil {
+		return nil, err
+	}
+	message := &server.messages[params.ChatId][i]
+	if message.Text != nil && *message.Text == params.Text && reflect.DeepEqual(message.ReplyMarkup, params.ReplyMarkup) {
+		return nil, &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: message is not modified"}
+	}
+	text := params.Text
+	message.Text = &text
+	message.ReplyMarkup = params.ReplyMarkup
+	return message, nil
+}
+
+func (server *Server) answerCallbackQuery(params *tgapi.AnswerCallbackQuery) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	answer, ok := server.callbackQueries[params.CallbackQueryId]
+	if !ok || answer != nil {
+		return &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: query is too old and response timeout expired or query ID is invalid"}
+	}
+	answered := *params
+	server.callbackQueries[params.CallbackQueryId] = &answered
+	return nil
+}
+
+// Results are kept as decoded JSON since their structure depends on type
+func (server *Server) answerInlineQuery(params *tgapi.AnswerInlineQuery) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	answer, ok := server.inlineQueries[params.InlineQueryId]
+	if !ok || answer != nil {
+		return &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: query is too old and response timeout expired or query ID is invalid"}
+	}
+	answered := *params
+	server.inlineQueries[params.InlineQueryId] = &answered
+	return nil
+}
+
+func (server *Server) setMyCommands(params *tgapi.SetMyCommands) error {
+	for _, command := range params.Commands {
+		if !botCommandPattern.MatchString(command.Command) || command.Description == "" {
+			return &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: BOT_COMMAND_INVALID"}
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.commands = params.Commands
+	return nil
+}
+
+func (server *Server) deleteMessage(params *tgapi.DeleteMessage) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	i, err := server.findMessageLocked(params.ChatId, params.MessageId)
+	if err != nil {
+		return &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: message to delete not found"}
+	}
+	messages := server.messages[params.ChatId]
+	server.messages[params.ChatId] = append(messages[:i:i], messages[i+1:]...)
+	return nil
+}
+
+func (server *Server) getChat(params *tgapi.GetChat) (*tgapi.Chat, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	chat, ok := server.chats[params.ChatId]
+	if !ok {
+		return nil, &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: chat not found"}
+	}
+	return chat, nil
+}
+
+func decodeParams(r *http.Request, params interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: " + err.Error()}
+	}
+	return nil
+}
+
+// setWebhook comes as multipart/form-data when a certificate is uploaded
+func decodeWebhookParams(r *http.Request, params *tgapi.SetWebhook) error {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return decodeParams(r, params)
+	}
+
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		return &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: " + err.Error()}
+	}
+	params.Url = r.FormValue("url")
+	params.SecretToken = r.FormValue("secret_token")
+	params.DropPendingUpdates = r.FormValue("drop_pending_updates") == "true"
+	if allowedUpdates := r.FormValue("allowed_updates"); allowedUpdates != "" {
+		if err := json.Unmarshal([]byte(allowedUpdates), &params.AllowedUpdates); err != nil {
+			return &tgapi.Error{Code: http.StatusBadRequest, Description: "Bad Request: can't parse allowed updates"}
+		}
+	}
+	return nil
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, http.StatusOK, &tgapi.Response{Ok: true, Result: encoded})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*tgapi.Error)
+	if !ok {
+		apiErr = &tgapi.Error{Code: http.StatusInternalServerError, Description: err.Error()}
+	}
+	writeResponse(w, apiErr.Code, &tgapi.Response{
+		Ok:          false,
+		ErrorCode:   &apiErr.Code,
+		Description: &apiErr.Description,
+		Parameters:  apiErr.Parameters,
+	})
+}
+
+func writeResponse(w http.ResponseWriter, status int, response *tgapi.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,360 @@
+// Package ticket mints and checks invite tickets. A ticket lets a peer
+// request punching from one server until it expires, without an allow rule
+// in the server's policy or a key in its peer keys file. It also tells the
+// holder where the server meets its clients. Tickets are signed with a
+// secret only the server knows, so clients can read them but not forge
+// them. Since a ticket is easily copied, the server only accepts it in
+// sealed requests, and binds it to the key that uses it first.
+package ticket
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every ticket starts with this, so that it is easy to tell apart from
+// manual signaling tokens
+const Prefix = "TGT1-"
+
+const keySize = 32
+
+// Where the server meets its clients, so that a ticket holder needs no hub
+// options of its own. Every secret in here is handed out with the tickets,
+// so servers only put in credentials meant for guests.
+type Hub struct {
+	Signaling string `json:"signaling"`
+
+	ApiToken string `json:"api_token,omitempty"`
+	ChatId   int64  `json:"chat_id,omitempty"`
+	TopicId  int    `json:"topic_id,omitempty"`
+
+	RendezvousUrl string `json:"rendezvous_url,omitempty"`
+	Room          string `json:"room,omitempty"`
+	RoomSecret    string `json:"room_secret,omitempty"`
+
+	MatrixHomeserver string `json:"matrix_homeserver,omitempty"`
+	MatrixToken      string `json:"matrix_token,omitempty"`
+	MatrixRoom       string `json:"matrix_room,omitempty"`
+
+	MqttBroker      string `json:"mqtt_broker,omitempty"`
+	MqttUsername    string `json:"mqtt_username,omitempty"`
+	MqttPassword    string `json:"mqtt_password,omitempty"`
+	MqttTopicPrefix string `json:"mqtt_topic_prefix,omitempty"`
+
+	// The key the server seals its messages with
+	ServerKey *e2e.PublicKey `json:"server_key,omitempty"`
+}
+
+type Ticket struct {
+	Id string `json:"id"`
+	// Name of the server the ticket is good for
+	Server string `json:"server"`
+	// Where to find the server, nil if the server has not told the issuer
+	Hub *Hub `json:"hub,omitempty"`
+	// Services the holder may ask for, any if empty
+	Services []string `json:"services,omitempty"`
+	// Name or key ID of the only peer that may use the ticket. If empty,
+	// the first key to use the ticket is the only one that may use it
+	// again.
+	PeerKey string `json:"peer_key,omitempty"`
+	// Unix time
+	Expires   int64 `json:"expires"`
+	SingleUse bool  `json:"single_use,omitempty"`
+}
+
+func (ticket *Ticket) Expiry() time.Time {
+	return time.Unix(ticket.Expires, 0)
+}
+
+func (ticket *Ticket) Allows(service string) bool {
+	if len(ticket.Services) == 0 {
+		return true
+	}
+	for _, allowed := range ticket.Services {
+		if allowed == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Tells whether the peer that sealed a request may use the ticket. Only
+// Redeem knows which key the ticket is bound to.
+func (ticket *Ticket) AllowsKey(key *e2e.PublicKey) bool {
+	if key == nil {
+		return false
+	}
+	return ticket.PeerKey == "" || ticket.PeerKey == key.Id() || (key.Name != "" && ticket.PeerKey == key.Name)
+}
+
+// Reads the ticket without checking the signature, which only the server
+// can do
+func Parse(text string) (*Ticket, error) {
+	ticket, _, _, err := split(text)
+	return ticket, err
+}
+
+func split(text string) (*Ticket, []byte, []byte, error) {
+	text = strings.Join(strings.Fields(text), "")
+	if !strings.HasPrefix(text, Prefix) {
+		return nil, nil, nil, errors.New("Not a tgpunch ticket")
+	}
+	encodedBody, encodedSignature, ok := strings.Cut(strings.TrimPrefix(text, Prefix), ".")
+	if !ok {
+		return nil, nil, nil, errors.New("Ticket has no signature")
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(encodedBody)
+	if err != nil {
+		return nil, nil, nil, errors.New("Ticket is damaged: " + err.Error())
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, nil, nil, errors.New("Ticket is damaged: " + err.Error())
+	}
+
+	var ticket Ticket
+	if err = json.Unmarshal(body, &ticket); err != nil {
+		return nil, nil, nil, errors.New("Cannot parse ticket: " + err.Error())
+	}
+	return &ticket, body, signature, nil
+}
+
+// A ticket that has been used, and by whom
+type redemption struct {
+	// Unix time, when the entry can go
+	Expires int64 `json:"expires"`
+	// ID of the key the ticket is bound to
+	Key string `json:"key"`
+	// Set once a single-use ticket is used up
+	Used bool `json:"used,omitempty"`
+}
+
+// Mints and checks tickets. Tickets are written down in the ledger file
+// next to the key once redeemed, so that restarting the server neither
+// unbinds them nor makes single-use ones valid again. The hub file next to
+// the key tells where the server meets its clients.
+type Issuer struct {
+	key        []byte
+	ledgerPath string
+	hubPath    string
+
+	mu     sync.Mutex
+	hub    *Hub
+	ledger map[string]*redemption
+}
+
+// Writes a new random key to a file only the owner can read. Fails if the
+// file exists, so that a key in use is never replaced.
+func GenerateKey(keyPath string) error {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(key); err != nil {
+		file.Close()
+		os.Remove(keyPath)
+		return err
+	}
+	if err = file.Close(); err != nil {
+		os.Remove(keyPath)
+		return err
+	}
+	return nil
+}
+
+// Fails if the key file does not exist, see GenerateKey
+func LoadIssuer(keyPath string) (*Issuer, error) {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, errors.New(keyPath + " is not a ticket key")
+	}
+
+	issuer := &Issuer{
+		key:        key,
+		ledgerPath: keyPath + ".redeemed",
+		hubPath:    keyPath + ".hub",
+		ledger:     make(map[string]*redemption),
+	}
+	ledger, err := os.ReadFile(issuer.ledgerPath)
+	if err == nil {
+		err = issuer.loadLedger(ledger)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("Cannot load redeemed tickets: " + err.Error())
+	}
+	hub, err := os.ReadFile(issuer.hubPath)
+	if err == nil {
+		err = json.Unmarshal(hub, &issuer.hub)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("Cannot load hub: " + err.Error())
+	}
+	return issuer, nil
+}
+
+// Older ledgers only hold the expiry of single-use tickets that are used up
+func (issuer *Issuer) loadLedger(ledger []byte) error {
+	if json.Unmarshal(ledger, &issuer.ledger) == nil {
+		return nil
+	}
+	var redeemed map[string]int64
+	if err := json.Unmarshal(ledger, &redeemed); err != nil {
+		return err
+	}
+	issuer.ledger = make(map[string]*redemption)
+	for id, expires := range redeemed {
+		issuer.ledger[id] = &redemption{Expires: expires, Used: true}
+	}
+	return nil
+}
+
+// Puts the hub into the tickets minted from now on and saves it next to the
+// key, for other issuers using the same key
+func (issuer *Issuer) SetHub(hub *Hub) error {
+	contents, err := json.Marshal(hub)
+	if err != nil {
+		return err
+	}
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	issuer.hub = hub
+	return writeAtomically(issuer.hubPath, contents)
+}
+
+func (issuer *Issuer) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, issuer.key)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func (issuer *Issuer) Mint(server string, services []string, peerKey string, validFor time.Duration, singleUse bool) (string, *Ticket, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", nil, err
+	}
+	issuer.mu.Lock()
+	hub := issuer.hub
+	issuer.mu.Unlock()
+
+	ticket := &Ticket{
+		Id:        hex.EncodeToString(id[:]),
+		Server:    server,
+		Hub:       hub,
+		Services:  services,
+		PeerKey:   peerKey,
+		Expires:   time.Now().Add(validFor).Unix(),
+		SingleUse: singleUse,
+	}
+
+	body, err := json.Marshal(ticket)
+	if err != nil {
+		return "", nil, err
+	}
+	text := Prefix + base64.RawURLEncoding.EncodeToString(body) + "." + base64.RawURLEncoding.EncodeToString(issuer.sign(body))
+	return text, ticket, nil
+}
+
+// Checks that we have signed the ticket for the server and that it is
+// still good. Does not use the ticket up, see Redeem.
+func (issuer *Issuer) Verify(text string, server string) (*Ticket, error) {
+	ticket, body, signature, err := split(text)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(signature, issuer.sign(body)) {
+		return nil, errors.New("Ticket signature mismatch")
+	}
+	if ticket.Server != server {
+		return nil, errors.New("Ticket is for server " + ticket.Server)
+	}
+	if !time.Now().Before(ticket.Expiry()) {
+		return nil, errors.New("Ticket has expired")
+	}
+
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	if entry, ok := issuer.ledger[ticket.Id]; ok && entry.Used {
+		return nil, errors.New("Ticket has been used already")
+	}
+	return ticket, nil
+}
+
+// Binds a verified ticket to the key on first use and uses up single-use
+// tickets. Fails if the ticket is bound to another key or has been used
+// up, e.g. by someone quicker.
+func (issuer *Issuer) Redeem(ticket *Ticket, key *e2e.PublicKey) error {
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+
+	entry, ok := issuer.ledger[ticket.Id]
+	if ok && entry.Used {
+		return errors.New("Ticket has been used already")
+	}
+	if ok && entry.Key != key.Id() {
+		return errors.New("Ticket is bound to another key")
+	}
+	if ok && !ticket.SingleUse {
+		return nil
+	}
+	issuer.ledger[ticket.Id] = &redemption{Expires: ticket.Expires, Key: key.Id(), Used: ticket.SingleUse}
+
+	// Expired tickets are refused anyway
+	now := time.Now().Unix()
+	for id, entry := range issuer.ledger {
+		if entry.Expires <= now {
+			delete(issuer.ledger, id)
+		}
+	}
+
+	ledger, err := json.Marshal(issuer.ledger)
+	if err == nil {
+		err = writeAtomically(issuer.ledgerPath, ledger)
+	}
+	if err != nil {
+		return errors.New("Cannot save redeemed tickets: " + err.Error())
+	}
+	return nil
+}
+
+// Replaces the file atomically so that a crash never loses what it held
+// before
+func writeAtomically(path string, contents []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,241 @@
+package ticket
+
+import (
+	"github.com/ovandriyanov/tgpunch/pkg/e2e"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func makeIssuer(t *testing.T) (*Issuer, string) {
+	t.Helper()
+	keyPath := filepath.Join(t.TempDir(), "ticket.key")
+	if err := GenerateKey(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := LoadIssuer(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer, keyPath
+}
+
+func generateKey(t *testing.T, name string) *e2e.PublicKey {
+	t.Helper()
+	identity, err := e2e.GenerateIdentity(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity.Public()
+}
+
+func TestLoadIssuerNeedsKey(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "ticket.key")
+	if _, err := LoadIssuer(keyPath); !os.IsNotExist(err) {
+		t.Fatalf("Got %v, want the key missing", err)
+	}
+	if _, err := os.Stat(keyPath); !os.IsNotExist(err) {
+		t.Fatal("Loading created the key")
+	}
+}
+
+func TestGenerateKeyKeepsExistingKey(t *testing.T) {
+	issuer, keyPath := makeIssuer(t)
+	text, _, err := issuer.Mint("server", nil, "", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = GenerateKey(keyPath); !os.IsExist(err) {
+		t.Fatalf("Got %v, want the key to exist", err)
+	}
+	issuer, err = LoadIssuer(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = issuer.Verify(text, "server"); err != nil {
+		t.Fatalf("Tickets stopped working: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer, _ := makeIssuer(t)
+	other, _ := makeIssuer(t)
+
+	good, _, err := issuer.Mint("server", []string{"ssh"}, "", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := issuer.Mint("server", nil, "", -time.Second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _, err := other.Mint("server", nil, "", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invite, err := issuer.Verify(good, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !invite.Allows("ssh") || invite.Allows("web") {
+		t.Fatalf("Ticket allows the wrong services: %v", invite.Services)
+	}
+	if _, err = issuer.Verify(good, "other"); err == nil {
+		t.Fatal("Accepted a ticket for another server")
+	}
+	if _, err = issuer.Verify(expired, "server"); err == nil {
+		t.Fatal("Accepted an expired ticket")
+	}
+	if _, err = issuer.Verify(forged, "server"); err == nil {
+		t.Fatal("Accepted a ticket signed with another key")
+	}
+}
+
+func TestAllowsKey(t *testing.T) {
+	laptop := generateKey(t, "laptop")
+	phone := generateKey(t, "phone")
+	unnamed := generateKey(t, "")
+
+	tests := []struct {
+		peerKey string
+		key     *e2e.PublicKey
+		allowed bool
+	}{
+		{"", laptop, true},
+		{"", nil, false},
+		{"laptop", laptop, true},
+		{"laptop", phone, false},
+		{"laptop", nil, false},
+		{unnamed.Id(), unnamed, true},
+		{unnamed.Id(), laptop, false},
+		{"", unnamed, true},
+	}
+	for _, test := range tests {
+		ticket := &Ticket{PeerKey: test.peerKey}
+		if ticket.AllowsKey(test.key) != test.allowed {
+			t.Errorf("Ticket for %q allows %v: %v", test.peerKey, test.key, !test.allowed)
+		}
+	}
+}
+
+func TestRedeemSurvivesRestart(t *testing.T) {
+	issuer, keyPath := makeIssuer(t)
+	text, _, err := issuer.Mint("server", nil, "", time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := issuer.Verify(text, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := generateKey(t, "phone")
+	if err = issuer.Redeem(invite, key); err != nil {
+		t.Fatal(err)
+	}
+	if err = issuer.Redeem(invite, key); err == nil {
+		t.Fatal("Redeemed a single-use ticket twice")
+	}
+
+	issuer, err = LoadIssuer(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = issuer.Verify(text, "server"); err == nil {
+		t.Fatal("A redeemed ticket is valid again after a restart")
+	}
+
+	// Nothing but the key and the ledger
+	entries, err := os.ReadDir(filepath.Dir(keyPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d files left next to the key", len(entries))
+	}
+}
+
+func TestRedeemBindsKey(t *testing.T) {
+	issuer, keyPath := makeIssuer(t)
+	text, _, err := issuer.Mint("server", nil, "", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := issuer.Verify(text, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phone := generateKey(t, "")
+	laptop := generateKey(t, "")
+	if err = issuer.Redeem(invite, phone); err != nil {
+		t.Fatal(err)
+	}
+	if err = issuer.Redeem(invite, phone); err != nil {
+		t.Fatalf("The first key cannot use the ticket again: %v", err)
+	}
+	if err = issuer.Redeem(invite, laptop); err == nil {
+		t.Fatal("Another key used a bound ticket")
+	}
+
+	issuer, err = LoadIssuer(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = issuer.Redeem(invite, laptop); err == nil {
+		t.Fatal("The ticket is unbound after a restart")
+	}
+	if err = issuer.Redeem(invite, phone); err != nil {
+		t.Fatalf("The first key lost the ticket in a restart: %v", err)
+	}
+}
+
+func TestLoadIssuerReadsOldLedger(t *testing.T) {
+	issuer, keyPath := makeIssuer(t)
+	text, invite, err := issuer.Mint("server", nil, "", time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger := []byte(`{"` + invite.Id + `":` + strconv.FormatInt(invite.Expires, 10) + `}`)
+	if err = os.WriteFile(keyPath+".redeemed", ledger, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if issuer, err = LoadIssuer(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = issuer.Verify(text, "server"); err == nil {
+		t.Fatal("A ticket used up before the upgrade is valid again")
+	}
+}
+
+func TestHubGoesIntoTickets(t *testing.T) {
+	issuer, keyPath := makeIssuer(t)
+	text, _, err := issuer.Mint("server", nil, "", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invite, _ := Parse(text); invite.Hub != nil {
+		t.Fatalf("Got hub %+v before the server told one", invite.Hub)
+	}
+
+	hub := &Hub{Signaling: "rendezvous", RendezvousUrl: "https://example.com", Room: "room", RoomSecret: "secret", ServerKey: generateKey(t, "server")}
+	if err = issuer.SetHub(hub); err != nil {
+		t.Fatal(err)
+	}
+	// Issuers started on their own, e.g. by the ticket command, learn
+	// the hub from the file
+	if issuer, err = LoadIssuer(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if text, _, err = issuer.Mint("server", nil, "", time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	invite, err := Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invite.Hub == nil || invite.Hub.Room != "room" || invite.Hub.RoomSecret != "secret" || invite.Hub.ServerKey.Id() != hub.ServerKey.Id() {
+		t.Fatalf("Got hub %+v", invite.Hub)
+	}
+}